@@ -0,0 +1,578 @@
+package modbus
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// errNotConnected is returned by a Client which isn't connected.
+var errNotConnected = errors.New("client isn't connected")
+
+// Client is a Modbus TCP client, also known as master. It's safe for
+// concurrent use, requests executed concurrently are sent without waiting for
+// the responses to earlier requests. Every request gets a transaction ID which
+// isn't used by another request waiting for its response, responses are
+// matched to requests by their transaction ID, so they may arrive in any
+// order. Responses with an unknown transaction ID, for example the response
+// to a request which timed out, are logged and discarded.
+//
+// Every method has a variant receiving a context. When the context is done
+// before the response arrived, the method returns the error of the context.
+// The connection stays usable, the response is discarded when it arrives.
+//
+// Exception responses are returned as Error, so errors.Is(err,
+// IllegalAddressError) reports whether the server rejected the addresses. When
+// sending a request or receiving a response fails the connection is closed
+// and all waiting requests fail. Call Connect to connect again.
+type Client struct {
+	// Logger logs discarded responses. When nil, the standard logger of
+	// package log is used. It must be set before calling Connect.
+	Logger Logger
+
+	address string
+
+	mu      sync.Mutex
+	timeout time.Duration
+	conn    *clientConn
+}
+
+// NewClient creates a new Client for the server at address.
+func NewClient(address string) *Client {
+	return &Client{
+		address: address,
+	}
+}
+
+// SetTimeout sets the maximum duration of connecting and of executing a
+// request, which includes waiting for the response. By default there's no
+// timeout.
+func (c *Client) SetTimeout(t time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.timeout = t
+}
+
+// Connect connects to the server. It closes the current connection, if any.
+func (c *Client) Connect() error {
+	return c.ConnectContext(context.Background())
+}
+
+// ConnectContext is like Connect, but it gives up connecting when ctx is done.
+func (c *Client) ConnectContext(ctx context.Context) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn != nil {
+		_ = c.conn.close(errNotConnected)
+		c.conn = nil
+	}
+
+	d := net.Dialer{Timeout: c.timeout}
+	conn, err := d.DialContext(ctx, "tcp", c.address)
+	if err != nil {
+		return fmt.Errorf("failed to connect to Modbus server: %v", err)
+	}
+
+	logger := c.Logger
+	if logger == nil {
+		logger = NewStdLogger(nil)
+	}
+
+	c.conn = newClientConn(conn, logger)
+	go c.conn.readResponses()
+	return nil
+}
+
+// Close closes the connection to the server. Requests waiting for their
+// response fail.
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.conn == nil {
+		return nil
+	}
+
+	err := c.conn.close(errNotConnected)
+	c.conn = nil
+	return err
+}
+
+// execute sends req and returns the response. It returns the Error of an
+// exception response.
+func (c *Client) execute(ctx context.Context, req Request) (*Response, error) {
+	c.mu.Lock()
+	conn, timeout := c.conn, c.timeout
+	c.mu.Unlock()
+
+	if conn == nil {
+		return nil, errNotConnected
+	}
+
+	resp, err := conn.roundTrip(ctx, req, timeout)
+	if err != nil {
+		if conn.closed() {
+			c.mu.Lock()
+			if c.conn == conn {
+				c.conn = nil
+			}
+			c.mu.Unlock()
+		}
+
+		return nil, err
+	}
+
+	if code, ok := resp.Exception(); ok {
+		if resp.FunctionCode != req.FunctionCode+0x80 {
+			return nil, fmt.Errorf("invalid response: exception response has function code %d, request has function code %d", resp.FunctionCode, req.FunctionCode)
+		}
+
+		return nil, exceptionError(code)
+	}
+
+	if resp.FunctionCode != req.FunctionCode {
+		return nil, fmt.Errorf("invalid response: response has function code %d, request has function code %d", resp.FunctionCode, req.FunctionCode)
+	}
+
+	return resp, nil
+}
+
+// clientResult is the response to a request, or the reason there's none.
+type clientResult struct {
+	resp *Response
+	err  error
+}
+
+// clientConn is a connection of a Client. It keeps the requests waiting for
+// their response by transaction ID.
+type clientConn struct {
+	conn   net.Conn
+	logger Logger
+
+	// writeMu serializes writing requests.
+	writeMu sync.Mutex
+
+	mu            sync.Mutex
+	transactionID uint16
+	pending       map[uint16]chan clientResult
+
+	// err is set when the connection is closed.
+	err error
+}
+
+func newClientConn(conn net.Conn, logger Logger) *clientConn {
+	return &clientConn{
+		conn:    conn,
+		logger:  logger,
+		pending: make(map[uint16]chan clientResult),
+	}
+}
+
+// close closes the connection, requests waiting for their response fail with
+// err.
+func (c *clientConn) close(err error) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return nil
+	}
+
+	c.err = err
+	for id, ch := range c.pending {
+		ch <- clientResult{err: err}
+		delete(c.pending, id)
+	}
+
+	return c.conn.Close()
+}
+
+// closed returns true when the connection is closed.
+func (c *clientConn) closed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.err != nil
+}
+
+// roundTrip writes req to the connection and waits for its response, until
+// the timeout expired or ctx is done.
+func (c *clientConn) roundTrip(ctx context.Context, req Request, timeout time.Duration) (*Response, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	ch := make(chan clientResult, 1)
+
+	c.mu.Lock()
+	if c.err != nil {
+		c.mu.Unlock()
+		return nil, c.err
+	}
+
+	if len(c.pending) > 0xffff {
+		c.mu.Unlock()
+		return nil, errors.New("too many requests waiting for their response")
+	}
+
+	// Skip the transaction IDs of requests still waiting for their
+	// response.
+	for {
+		c.transactionID++
+		if _, ok := c.pending[c.transactionID]; !ok {
+			break
+		}
+	}
+
+	id := c.transactionID
+	req.TransactionID = id
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	// forget removes the request, a late response is discarded.
+	forget := func() {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+	}
+
+	b, err := req.MarshalBinary()
+	if err != nil {
+		forget()
+		return nil, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		t := time.NewTimer(timeout)
+		defer t.Stop()
+		expired = t.C
+	}
+
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if d, ok := ctx.Deadline(); ok && (deadline.IsZero() || d.Before(deadline)) {
+		deadline = d
+	}
+
+	c.writeMu.Lock()
+	err = c.conn.SetWriteDeadline(deadline)
+	if err == nil {
+		_, err = c.conn.Write(b)
+	}
+	c.writeMu.Unlock()
+
+	if err != nil {
+		err = fmt.Errorf("failed to write request: %v", err)
+		_ = c.close(err)
+		return nil, err
+	}
+
+	select {
+	case r := <-ch:
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if r.resp.UnitID != req.UnitID {
+			return nil, fmt.Errorf("invalid response: unit ID %d doesn't match unit ID %d of request", r.resp.UnitID, req.UnitID)
+		}
+
+		return r.resp, nil
+	case <-expired:
+		forget()
+		return nil, fmt.Errorf("no response within %v", timeout)
+	case <-ctx.Done():
+		forget()
+		return nil, ctx.Err()
+	}
+}
+
+// readResponses reads responses and delivers them to the requests waiting for
+// them, until reading fails.
+func (c *clientConn) readResponses() {
+	for {
+		id, r, err := c.readResponse()
+		if err != nil {
+			_ = c.close(err)
+			return
+		}
+
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+
+		if !ok {
+			c.logger.Info("discarded response with unknown transaction ID", Field{Key: "transaction_id", Value: id})
+			continue
+		}
+
+		ch <- r
+	}
+}
+
+// readResponse reads the next response and returns its transaction ID. It
+// only returns an error when the connection is unusable. When a complete
+// response has been read, but it's invalid, the result contains the reason.
+func (c *clientConn) readResponse() (uint16, clientResult, error) {
+	// Read the MBAP header first, its length field contains the number of
+	// bytes following the header, starting with the unit ID.
+	b := make([]byte, maxADULength)
+	if _, err := io.ReadFull(c.conn, b[:7]); err != nil {
+		return 0, clientResult{}, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	length := int(binary.BigEndian.Uint16(b[4:6]))
+	if length < 2 || length+6 > maxADULength {
+		return 0, clientResult{}, fmt.Errorf("invalid response: length field of %d is invalid", length)
+	}
+
+	if _, err := io.ReadFull(c.conn, b[7:length+6]); err != nil {
+		return 0, clientResult{}, fmt.Errorf("failed to read response: %v", err)
+	}
+
+	id := binary.BigEndian.Uint16(b[0:2])
+
+	resp := new(Response)
+	if err := resp.UnmarshalBinary(b[:length+6]); err != nil {
+		return id, clientResult{err: fmt.Errorf("invalid response: %v", err)}, nil
+	}
+
+	if resp.ProtocolID != modbusProtocolID {
+		return id, clientResult{err: fmt.Errorf("invalid response: protocol ID %d isn't Modbus", resp.ProtocolID)}, nil
+	}
+
+	return id, clientResult{resp: resp}, nil
+}
+
+// EchoMismatchError is returned when the response to a write request doesn't
+// echo the address, value or quantity of the request. The write may or may not
+// have been executed, so it's usually safe to retry it.
+type EchoMismatchError struct {
+	// Field is the field which doesn't match, like "address".
+	Field string
+
+	Sent     int
+	Received int
+}
+
+func (e EchoMismatchError) Error() string {
+	return fmt.Sprintf("invalid response: %s %d doesn't match %s %d of request", e.Field, e.Received, e.Field, e.Sent)
+}
+
+// exceptionError returns the Error for an exception code.
+func exceptionError(code uint8) Error {
+	for _, e := range []Error{
+		IllegalFunctionError,
+		IllegalAddressError,
+		IllegalDataValueError,
+		SlaveDeviceFailureError,
+		AcknowledgeError,
+		SlaveDeviceBusyError,
+		NegativeAcknowledgeError,
+		MemoryParityError,
+		GatewayPathUnavailableError,
+		GatewayTargetDeviceFailedToRespondError,
+	} {
+		if e.Code == code {
+			return e
+		}
+	}
+
+	return Error{Code: code, msg: "unknown exception"}
+}
+
+// read executes a read request with function code 1, 2, 3 or 4 and returns
+// the data of the response, which has a length of byteCount(quantity).
+func (c *Client) read(ctx context.Context, unitID, functionCode uint8, start, quantity uint16, limit int, byteCount func(int) int) ([]byte, error) {
+	if quantity < 1 || int(quantity) > limit {
+		return nil, fmt.Errorf("quantity of %d is invalid, it must be 1 through %d", quantity, limit)
+	}
+
+	if int(start)+int(quantity) > addressSpace {
+		return nil, fmt.Errorf("reading %d addresses starting at %d exceeds the address space", quantity, start)
+	}
+
+	resp, err := c.execute(ctx, NewReadRequest(unitID, functionCode, start, quantity))
+	if err != nil {
+		return nil, err
+	}
+
+	if n := byteCount(int(quantity)); len(resp.Data) != n {
+		return nil, fmt.Errorf("invalid response: response contains %d bytes instead of %d", len(resp.Data), n)
+	}
+
+	return resp.Data, nil
+}
+
+// readBits reads quantity coils or discrete inputs.
+func (c *Client) readBits(ctx context.Context, unitID, functionCode uint8, start, quantity uint16) ([]bool, error) {
+	data, err := c.read(ctx, unitID, functionCode, start, quantity, maxReadBits, coilBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	bits := make([]bool, quantity)
+	for i := range bits {
+		bits[i] = data[i/8]&(1<<uint(i%8)) != 0
+	}
+
+	return bits, nil
+}
+
+// readRegisters reads quantity holding or input registers.
+func (c *Client) readRegisters(ctx context.Context, unitID, functionCode uint8, start, quantity uint16) ([]Value, error) {
+	data, err := c.read(ctx, unitID, functionCode, start, quantity, maxReadRegisters, registerBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return UnmarshalValues(data, Unsigned)
+}
+
+// ReadCoils reads quantity coils starting at start.
+func (c *Client) ReadCoils(unitID uint8, start, quantity uint16) ([]bool, error) {
+	return c.ReadCoilsContext(context.Background(), unitID, start, quantity)
+}
+
+// ReadCoilsContext is like ReadCoils, but it gives up when ctx is done.
+func (c *Client) ReadCoilsContext(ctx context.Context, unitID uint8, start, quantity uint16) ([]bool, error) {
+	return c.readBits(ctx, unitID, ReadCoils, start, quantity)
+}
+
+// ReadDiscreteInputs reads quantity discrete inputs starting at start.
+func (c *Client) ReadDiscreteInputs(unitID uint8, start, quantity uint16) ([]bool, error) {
+	return c.ReadDiscreteInputsContext(context.Background(), unitID, start, quantity)
+}
+
+// ReadDiscreteInputsContext is like ReadDiscreteInputs, but it gives up when
+// ctx is done.
+func (c *Client) ReadDiscreteInputsContext(ctx context.Context, unitID uint8, start, quantity uint16) ([]bool, error) {
+	return c.readBits(ctx, unitID, ReadDiscreteInputs, start, quantity)
+}
+
+// ReadHoldingRegisters reads quantity holding registers starting at start.
+// The values are unsigned.
+func (c *Client) ReadHoldingRegisters(unitID uint8, start, quantity uint16) ([]Value, error) {
+	return c.ReadHoldingRegistersContext(context.Background(), unitID, start, quantity)
+}
+
+// ReadHoldingRegistersContext is like ReadHoldingRegisters, but it gives up
+// when ctx is done.
+func (c *Client) ReadHoldingRegistersContext(ctx context.Context, unitID uint8, start, quantity uint16) ([]Value, error) {
+	return c.readRegisters(ctx, unitID, ReadHoldingRegisters, start, quantity)
+}
+
+// ReadInputRegisters reads quantity input registers starting at start. The
+// values are unsigned.
+func (c *Client) ReadInputRegisters(unitID uint8, start, quantity uint16) ([]Value, error) {
+	return c.ReadInputRegistersContext(context.Background(), unitID, start, quantity)
+}
+
+// ReadInputRegistersContext is like ReadInputRegisters, but it gives up when
+// ctx is done.
+func (c *Client) ReadInputRegistersContext(ctx context.Context, unitID uint8, start, quantity uint16) ([]Value, error) {
+	return c.readRegisters(ctx, unitID, ReadInputRegisters, start, quantity)
+}
+
+// write executes a write request with function code 5, 6, 15 or 16 and
+// verifies that the response echoes the request.
+func (c *Client) write(ctx context.Context, unitID, functionCode uint8, start uint16, values []Value) error {
+	for _, v := range values {
+		if v.Get() < -32768 || v.Get() > 65535 {
+			return fmt.Errorf("value %d doesn't fit in a register", v.Get())
+		}
+	}
+
+	req, err := NewWriteRequest(unitID, functionCode, start, values)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.execute(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	if len(resp.Data) != 4 {
+		return fmt.Errorf("invalid response: response contains %d bytes instead of 4", len(resp.Data))
+	}
+
+	// The response of a write single request echoes the address and the
+	// value, that of a write multiple request the starting address and
+	// the quantity.
+	second := "value"
+	if functionCode == WriteMultipleCoils || functionCode == WriteMultipleRegisters {
+		second = "quantity"
+	}
+
+	for i, field := range []string{"address", second} {
+		sent := int(binary.BigEndian.Uint16(req.Data[i*2:]))
+		received := int(binary.BigEndian.Uint16(resp.Data[i*2:]))
+		if sent != received {
+			return EchoMismatchError{Field: field, Sent: sent, Received: received}
+		}
+	}
+
+	return nil
+}
+
+// WriteSingleCoil turns the coil at addr on or off.
+func (c *Client) WriteSingleCoil(unitID uint8, addr uint16, on bool) error {
+	return c.WriteSingleCoilContext(context.Background(), unitID, addr, on)
+}
+
+// WriteSingleCoilContext is like WriteSingleCoil, but it gives up when ctx is
+// done. The coil may have been written anyway.
+func (c *Client) WriteSingleCoilContext(ctx context.Context, unitID uint8, addr uint16, on bool) error {
+	return c.write(ctx, unitID, WriteSingleCoil, addr, []Value{NewBoolValue(on)})
+}
+
+// WriteSingleRegister writes v to the holding register at addr.
+func (c *Client) WriteSingleRegister(unitID uint8, addr uint16, v Value) error {
+	return c.WriteSingleRegisterContext(context.Background(), unitID, addr, v)
+}
+
+// WriteSingleRegisterContext is like WriteSingleRegister, but it gives up when
+// ctx is done. The register may have been written anyway.
+func (c *Client) WriteSingleRegisterContext(ctx context.Context, unitID uint8, addr uint16, v Value) error {
+	return c.write(ctx, unitID, WriteSingleRegister, addr, []Value{v})
+}
+
+// WriteMultipleCoils turns the coils starting at start on or off.
+func (c *Client) WriteMultipleCoils(unitID uint8, start uint16, coils []bool) error {
+	return c.WriteMultipleCoilsContext(context.Background(), unitID, start, coils)
+}
+
+// WriteMultipleCoilsContext is like WriteMultipleCoils, but it gives up when
+// ctx is done. The coils may have been written anyway.
+func (c *Client) WriteMultipleCoilsContext(ctx context.Context, unitID uint8, start uint16, coils []bool) error {
+	values := make([]Value, len(coils))
+	for i, on := range coils {
+		values[i] = NewBoolValue(on)
+	}
+
+	return c.write(ctx, unitID, WriteMultipleCoils, start, values)
+}
+
+// WriteMultipleRegisters writes values to the holding registers starting at
+// start.
+func (c *Client) WriteMultipleRegisters(unitID uint8, start uint16, values []Value) error {
+	return c.WriteMultipleRegistersContext(context.Background(), unitID, start, values)
+}
+
+// WriteMultipleRegistersContext is like WriteMultipleRegisters, but it gives
+// up when ctx is done. The registers may have been written anyway.
+func (c *Client) WriteMultipleRegistersContext(ctx context.Context, unitID uint8, start uint16, values []Value) error {
+	return c.write(ctx, unitID, WriteMultipleRegisters, start, values)
+}
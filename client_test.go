@@ -0,0 +1,385 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newClientTestServer starts a server serving h and returns a client connected
+// to it.
+func newClientTestServer(t *testing.T, h Handler, functionCodes ...uint8) (*Client, func()) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	for _, fc := range functionCodes {
+		assert.Nil(t, s.Handle(fc, h))
+	}
+	go s.Listen()
+
+	c := NewClient(s.Addr().String())
+	c.SetTimeout(time.Second)
+	assert.Nil(t, c.Connect())
+
+	return c, func() {
+		c.Close()
+		s.Close()
+	}
+}
+
+func TestClientRead(t *testing.T) {
+	h := NewMemoryHandler(10, 10, 10, 10)
+	assert.Nil(t, h.SetCoil(1, true))
+	assert.Nil(t, h.SetCoil(9, true))
+	assert.Nil(t, h.SetDiscreteInput(0, true))
+	assert.Nil(t, h.SetRegister(2, Value{0xfff3}))
+	assert.Nil(t, h.SetInputRegister(9, Value{498}))
+
+	c, stop := newClientTestServer(t, h, ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters)
+	defer stop()
+
+	coils, err := c.ReadCoils(1, 0, 10)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{false, true, false, false, false, false, false, false, false, true}, coils)
+
+	inputs, err := c.ReadDiscreteInputs(1, 0, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []bool{true, false}, inputs)
+
+	registers, err := c.ReadHoldingRegisters(1, 1, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []Value{{0}, {0xfff3}}, registers)
+
+	registers, err = c.ReadInputRegisters(1, 9, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Value{{498}}, registers)
+
+	// Exception responses are returned as Error.
+	_, err = c.ReadHoldingRegisters(1, 9, 2)
+	assert.Equal(t, IllegalAddressError, err)
+
+	// Invalid quantities aren't sent.
+	_, err = c.ReadHoldingRegisters(1, 0, 126)
+	assert.EqualError(t, err, "quantity of 126 is invalid, it must be 1 through 125")
+	_, err = c.ReadCoils(1, 0, 0)
+	assert.NotNil(t, err)
+	_, err = c.ReadCoils(1, 65535, 2)
+	assert.NotNil(t, err)
+
+	// The connection is still usable.
+	_, err = c.ReadCoils(1, 0, 1)
+	assert.Nil(t, err)
+
+	assert.Nil(t, c.Close())
+	_, err = c.ReadCoils(1, 0, 1)
+	assert.Equal(t, errNotConnected, err)
+}
+
+func TestClientWrite(t *testing.T) {
+	h := NewMemoryHandler(20, 0, 10, 0)
+	c, stop := newClientTestServer(t, h, WriteSingleCoil, WriteSingleRegister, WriteMultipleCoils, WriteMultipleRegisters)
+	defer stop()
+
+	assert.Nil(t, c.WriteSingleCoil(1, 19, true))
+	assert.Nil(t, c.WriteSingleRegister(1, 0, Value{-3}))
+	assert.Nil(t, c.WriteMultipleCoils(1, 2, []bool{true, false, true}))
+	assert.Nil(t, c.WriteMultipleRegisters(1, 8, []Value{{1}, {0xffff}}))
+
+	for addr, expected := range map[int]bool{19: true, 2: true, 3: false, 4: true} {
+		on, err := h.GetCoil(addr)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, on)
+	}
+
+	for addr, expected := range map[int]Value{0: {0xfffd}, 8: {1}, 9: {0xffff}} {
+		v, err := h.GetRegister(addr)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, v)
+	}
+
+	assert.Equal(t, IllegalAddressError, c.WriteMultipleRegisters(1, 9, []Value{{1}, {2}}))
+
+	// Invalid writes aren't sent.
+	assert.NotNil(t, c.WriteMultipleRegisters(1, 0, nil))
+	assert.NotNil(t, c.WriteMultipleRegisters(1, 0, make([]Value, 124)))
+	assert.EqualError(t, c.WriteSingleRegister(1, 0, Value{70000}), "value 70000 doesn't fit in a register")
+	assert.NotNil(t, c.WriteMultipleCoils(1, 65535, []bool{true, true}))
+}
+
+func TestClientWriteEchoMismatch(t *testing.T) {
+	tests := []struct {
+		respond  func(req []byte) []byte
+		expected EchoMismatchError
+	}{
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x2, req[10], req[11]}
+			},
+			EchoMismatchError{Field: "address", Sent: 1, Received: 2},
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, req[8], req[9], 0x0, 0x0}
+			},
+			EchoMismatchError{Field: "value", Sent: 498, Received: 0},
+		},
+	}
+
+	for _, test := range tests {
+		c := NewClient(fakeServer(t, test.respond))
+		assert.Nil(t, c.Connect())
+
+		err := c.WriteSingleRegister(1, 1, Value{498})
+		var mismatch EchoMismatchError
+		if assert.True(t, errors.As(err, &mismatch)) {
+			assert.Equal(t, test.expected, mismatch)
+		}
+
+		c.Close()
+	}
+
+	// The quantity of a write multiple request is echoed.
+	c := NewClient(fakeServer(t, func(req []byte) []byte {
+		return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x6, 0x1, 0x10, 0x0, 0x0, 0x0, 0x2}
+	}))
+	assert.Nil(t, c.Connect())
+	defer c.Close()
+
+	assert.EqualError(t, c.WriteMultipleRegisters(1, 0, []Value{{1}}), "invalid response: quantity 2 doesn't match quantity 1 of request")
+}
+
+// fakeServer accepts a single connection and answers every request with the
+// response returned by respond.
+func fakeServer(t *testing.T, respond func(req []byte) []byte) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+
+	go func() {
+		defer l.Close()
+
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		for {
+			req := make([]byte, 12)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+
+			conn.Write(respond(req))
+		}
+	}()
+
+	return l.Addr().String()
+}
+
+func TestClientInvalidResponse(t *testing.T) {
+	tests := []struct {
+		respond  func(req []byte) []byte
+		expected string
+		closed   bool
+	}{
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x5, 0x1, 0x4, 0x2, 0x0, 0x1}
+			},
+			"invalid response: response has function code 4, request has function code 3",
+			false,
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0x1}
+			},
+			"invalid response: response contains 2 bytes instead of 4",
+			false,
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x3, 0x0, 0x1}
+			},
+			"invalid response: failed to unmarshal byte slice to response: byte count doesn't match length of data",
+			false,
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1] + 1, 0x0, 0x0, 0x0, 0x7, 0x1, 0x3, 0x4, 0x0, 0x1, 0x0, 0x2}
+			},
+			// The response is discarded.
+			"no response within 100ms",
+			false,
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x7, 0x2, 0x3, 0x4, 0x0, 0x1, 0x0, 0x2}
+			},
+			"invalid response: unit ID 2 doesn't match unit ID 1 of request",
+			false,
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x1, 0x1}
+			},
+			"invalid response: length field of 1 is invalid",
+			true,
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x3, 0x1, 0x84, 0x2}
+			},
+			"invalid response: exception response has function code 132, request has function code 3",
+			false,
+		},
+		{
+			func(req []byte) []byte {
+				return []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x3, 0x1, 0x83, 0x42}
+			},
+			"Modbus exception code: 66: unknown exception",
+			false,
+		},
+	}
+
+	for _, test := range tests {
+		c := NewClient(fakeServer(t, test.respond))
+		c.Logger = NewStdLogger(log.New(ioutil.Discard, "", 0))
+		c.SetTimeout(100 * time.Millisecond)
+		assert.Nil(t, c.Connect())
+
+		_, err := c.ReadHoldingRegisters(1, 0, 2)
+		assert.EqualError(t, err, test.expected)
+
+		_, err = c.ReadHoldingRegisters(1, 0, 2)
+		assert.Equal(t, test.closed, errors.Is(err, errNotConnected))
+
+		c.Close()
+	}
+}
+
+// TestClientReorderedResponses verifies that responses are matched to
+// requests by their transaction ID, using a server which answers two requests
+// in reverse order. Every response contains the starting address of its
+// request.
+func TestClientReorderedResponses(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer l.Close()
+
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		var responses [][]byte
+		for i := 0; i < 2; i++ {
+			req := make([]byte, 12)
+			if _, err := io.ReadFull(conn, req); err != nil {
+				return
+			}
+
+			responses = append(responses, []byte{req[0], req[1], 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, req[8], req[9]})
+		}
+
+		// Respond to an unknown transaction first, which is discarded.
+		conn.Write([]byte{0xff, 0xff, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0x0})
+		conn.Write(responses[1])
+		conn.Write(responses[0])
+	}()
+
+	logs := new(bytes.Buffer)
+	c := NewClient(l.Addr().String())
+	c.Logger = NewStdLogger(log.New(logs, "", 0))
+	c.SetTimeout(time.Second)
+	assert.Nil(t, c.Connect())
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for _, start := range []uint16{0x10, 0x20} {
+		wg.Add(1)
+		go func(start uint16) {
+			defer wg.Done()
+
+			values, err := c.ReadHoldingRegisters(1, start, 1)
+			assert.Nil(t, err)
+			assert.Equal(t, []Value{{int(start)}}, values)
+		}(start)
+	}
+	wg.Wait()
+
+	assert.Equal(t, "goldfish: discarded response with unknown transaction ID transaction_id=65535\n", logs.String())
+}
+
+func TestClientClose(t *testing.T) {
+	// The server never responds.
+	addr := fakeServer(t, func(req []byte) []byte { return nil })
+
+	c := NewClient(addr)
+	assert.Nil(t, c.Connect())
+
+	done := make(chan error)
+	go func() {
+		_, err := c.ReadCoils(1, 0, 1)
+		done <- err
+	}()
+
+	// Closing the client makes the waiting request fail.
+	time.Sleep(50 * time.Millisecond)
+	assert.Nil(t, c.Close())
+	assert.Equal(t, errNotConnected, <-done)
+}
+
+func TestClientContext(t *testing.T) {
+	block := make(chan struct{})
+	h := NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		if start == 1 {
+			<-block
+		}
+		return []Value{{start}}, nil
+	})
+
+	logs := new(bytes.Buffer)
+	c, stop := newClientTestServer(t, h, ReadHoldingRegisters)
+	defer stop()
+	c.Close()
+	c.Logger = NewStdLogger(log.New(logs, "", 0))
+	assert.Nil(t, c.Connect())
+
+	// Cancel the request while the server handles it.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		cancel()
+	}()
+
+	_, err := c.ReadHoldingRegistersContext(ctx, 1, 1, 1)
+	assert.Equal(t, context.Canceled, err)
+
+	// The late response is discarded, the next request gets its own
+	// response.
+	close(block)
+	values, err := c.ReadHoldingRegistersContext(context.Background(), 1, 2, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Value{{2}}, values)
+	assert.Contains(t, logs.String(), "discarded response with unknown transaction ID transaction_id=1")
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Nanosecond)
+	defer cancel()
+	<-ctx.Done()
+	assert.Equal(t, context.DeadlineExceeded, c.WriteSingleRegisterContext(ctx, 1, 0, Value{1}))
+
+	values, err = c.ReadHoldingRegisters(1, 3, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []Value{{3}}, values)
+}
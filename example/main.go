@@ -14,17 +14,12 @@ import (
 // The handler is called with 3 parameters: the unit/slave id, the number of
 // the first requested address and the total address requested.
 //
-// The handler must return a slice representing the values of the requested
-// addresses like [0, 1, 0, 1, 0, 1].
-func handleReadCoils(unitID, start, quantity int) ([]modbus.Value, error) {
-	coils := make([]modbus.Value, quantity)
+// The handler must return a slice representing the states of the requested
+// addresses like [false, true, false, true].
+func handleReadCoils(unitID, start, quantity int) ([]bool, error) {
+	coils := make([]bool, quantity)
 	for i := 0; i < quantity; i++ {
-		v, err := modbus.NewValue((i + start) % 2)
-		if err != nil {
-			return coils, modbus.SlaveDeviceFailureError
-		}
-
-		coils[i] = v
+		coils[i] = (i+start)%2 == 1
 	}
 
 	return coils, nil
@@ -60,7 +55,7 @@ func handleWriteRegisters(unitID, start int, values []modbus.Value) error {
 	return nil
 }
 
-func handleWriteCoils(unitID, start int, values []modbus.Value) error {
+func handleWriteCoils(unitID, start int, values []bool) error {
 	if start == 1 {
 		return modbus.IllegalAddressError
 	}
@@ -77,11 +72,13 @@ func main() {
 		log.Fatal(fmt.Sprintf("Failed to start Modbus server: %v", err))
 	}
 
-	s.Handle(modbus.ReadCoils, modbus.NewReadHandler(handleReadCoils))
+	s.Handle(modbus.ReadCoils, modbus.NewCoilReadHandler(handleReadCoils))
 	s.Handle(modbus.ReadHoldingRegisters, modbus.NewReadHandler(handleRegisters))
-	s.Handle(modbus.WriteSingleCoil, modbus.NewWriteHandler(handleWriteCoils, modbus.Signed))
+	s.Handle(modbus.WriteSingleCoil, modbus.NewCoilWriteHandler(handleWriteCoils))
+	s.Handle(modbus.WriteMultipleCoils, modbus.NewCoilWriteHandler(handleWriteCoils))
 	s.Handle(modbus.WriteSingleRegister, modbus.NewWriteHandler(handleWriteRegisters, modbus.Signed))
 	s.Handle(modbus.WriteMultipleRegisters, modbus.NewWriteHandler(handleWriteRegisters, modbus.Signed))
 
+	log.Printf("Listening on %v", s.Addr())
 	s.Listen()
 }
@@ -0,0 +1,74 @@
+package modbus
+
+import (
+	"fmt"
+	"net"
+)
+
+// ConnFilterFunc decides if a client with given address may talk to the
+// server. A client is rejected when a non-nil error is returned.
+type ConnFilterFunc func(addr net.Addr) error
+
+// SetConnFilter sets the filter which is evaluated for every accepted
+// connection, before any bytes are read from it. Rejected connections are
+// closed. Servers listening on UDP evaluate the filter for every datagram and
+// drop the datagrams from rejected clients. It returns an error when the server
+// already started.
+func (s *Server) SetConnFilter(f ConnFilterFunc) error {
+	return s.configure(func() {
+		s.connFilter = f
+	})
+}
+
+// filterConn returns an error when the client with given address has been
+// rejected by the filter.
+func (s *Server) filterConn(addr net.Addr) error {
+	if s.connFilter == nil {
+		return nil
+	}
+
+	return s.connFilter(addr)
+}
+
+// AllowCIDRs returns a ConnFilterFunc which only allows clients with an IP
+// address within one of the given networks, like "192.168.1.0/24" or
+// "fd00::/8". It returns an error when a network can't be parsed.
+func AllowCIDRs(cidrs ...string) (ConnFilterFunc, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse network: %v", err)
+		}
+		nets = append(nets, n)
+	}
+
+	return func(addr net.Addr) error {
+		ip := addrIP(addr)
+		if ip == nil {
+			return fmt.Errorf("address %v is not an IP address", addr)
+		}
+
+		for _, n := range nets {
+			if n.Contains(ip) {
+				return nil
+			}
+		}
+
+		return fmt.Errorf("address %v is not allowed", addr)
+	}, nil
+}
+
+// addrIP returns the IP address of addr, or nil if addr has no IP address.
+func addrIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	case *net.IPAddr:
+		return a.IP
+	}
+
+	return nil
+}
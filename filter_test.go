@@ -0,0 +1,61 @@
+package modbus
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAllowCIDRs(t *testing.T) {
+	f, err := AllowCIDRs("192.168.1.0/24", "fd00::/8")
+	assert.Nil(t, err)
+
+	tests := []struct {
+		addr    net.Addr
+		allowed bool
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 502}, true},
+		{&net.UDPAddr{IP: net.ParseIP("192.168.1.255"), Port: 502}, true},
+		{&net.TCPAddr{IP: net.ParseIP("fd00::1"), Port: 502}, true},
+		{&net.TCPAddr{IP: net.ParseIP("192.168.2.10"), Port: 502}, false},
+		{&net.IPAddr{IP: net.ParseIP("10.0.0.1")}, false},
+		{&net.UnixAddr{Name: "pipe", Net: "pipe"}, false},
+	}
+
+	for _, test := range tests {
+		err := f(test.addr)
+		assert.Equal(t, test.allowed, err == nil, test.addr.String())
+	}
+
+	_, err = AllowCIDRs("192.168.1.0")
+	assert.NotNil(t, err)
+}
+
+func TestConnFilter(t *testing.T) {
+	logs := new(bytes.Buffer)
+
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+	s.ErrorLog = log.New(logs, "", 0)
+
+	f, err := AllowCIDRs("10.0.0.0/8")
+	assert.Nil(t, err)
+	s.SetConnFilter(f)
+
+	go s.Listen()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// The connection is closed before a request has been read.
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	assert.Nil(t, s.Close())
+	assert.Contains(t, logs.String(), "goldfish: rejected connection remote_addr=127.0.0.1")
+}
@@ -1,10 +1,12 @@
 package modbus
 
 import (
+	"context"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
-	"log"
+	"sync"
 )
 
 // Signedness controls the signedness of values for Writehandler's. A value can
@@ -25,96 +27,302 @@ type Handler interface {
 	ServeModbus(w io.Writer, r Request)
 }
 
+// HandlerE is a Handler which reports when it failed to write the response or
+// when the connection is unusable otherwise. The server closes the connection
+// when ServeModbusE returns an error. The handlers of this package, except
+// HandlerFunc, implement HandlerE.
+type HandlerE interface {
+	Handler
+	ServeModbusE(w io.Writer, r Request) error
+}
+
+// serveModbusE lets h handle r. It returns the error of h when h implements
+// HandlerE.
+func serveModbusE(h Handler, w io.Writer, r Request) error {
+	if he, ok := h.(HandlerE); ok {
+		return he.ServeModbusE(w, r)
+	}
+
+	h.ServeModbus(w, r)
+	return nil
+}
+
+// HandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers.
+type HandlerFunc func(w io.Writer, r Request)
+
+// ServeModbus calls f(w, r).
+func (f HandlerFunc) ServeModbus(w io.Writer, r Request) {
+	f(w, r)
+}
+
 // ReadHandlerFunc is an adapter to allow the use of ordinary functions as
 // handlers for Modbus read functions.
 type ReadHandlerFunc func(unitID, start, quantity int) ([]Value, error)
 
+// ReadHandlerContextFunc is like ReadHandlerFunc, but it receives the context
+// of the request. The context is canceled when the connection is closed or
+// when the server shuts down. It has a deadline when the request timeout of
+// the server is set.
+type ReadHandlerContextFunc func(ctx context.Context, unitID, start, quantity int) ([]Value, error)
+
+// maxReadBits and maxReadRegisters are the maximum number of coils or
+// discrete inputs and of registers which can be read with a single request.
+const (
+	maxReadBits      = 2000
+	maxReadRegisters = 125
+)
+
+// maxWriteBits and maxWriteRegisters are the maximum number of coils and of
+// registers which can be written with a single request. Read/write multiple
+// registers requests can write at most maxReadWriteRegisters registers.
+const (
+	maxWriteBits          = 1968
+	maxWriteRegisters     = 123
+	maxReadWriteRegisters = 121
+)
+
+// addressSpace is the number of addresses of every data table. A request
+// must not address coils or registers beyond the end of the address space.
+const addressSpace = 0x10000
+
 // ReadHandler can be used to respond on Modbus request with function codes
 // 1, 2, 3 and 4.
 type ReadHandler struct {
-	handle ReadHandlerFunc
+	handle ReadHandlerContextFunc
 }
 
 // NewReadHandler creates a new ReadHandler.
 func NewReadHandler(h ReadHandlerFunc) *ReadHandler {
+	return NewReadHandlerCtx(func(ctx context.Context, unitID, start, quantity int) ([]Value, error) {
+		return h(unitID, start, quantity)
+	})
+}
+
+// NewReadHandlerCtx creates a new ReadHandler which passes the context of the
+// request to h.
+func NewReadHandlerCtx(h ReadHandlerContextFunc) *ReadHandler {
 	return &ReadHandler{
 		handle: h,
 	}
 }
 
+// parseReadRequest returns the starting address and the quantity of a read
+// request with function code 1, 2, 3 or 4.
+func parseReadRequest(req Request) (start, quantity int, err error) {
+	// The byte slice request.Data contains the starting address and the
+	// quantity, both 2 bytes long.
+	if len(req.Data) != 4 {
+		return 0, 0, IllegalDataValueError
+	}
+
+	if start, err = req.Start(); err != nil {
+		return 0, 0, err
+	}
+
+	if quantity, err = req.Quantity(); err != nil {
+		return 0, 0, err
+	}
+
+	limit := maxReadRegisters
+	if isBitFunctionCode(req.FunctionCode) {
+		limit = maxReadBits
+	}
+
+	if quantity < 1 || quantity > limit {
+		return 0, 0, IllegalDataValueError
+	}
+
+	if start+quantity > addressSpace {
+		return 0, 0, IllegalAddressError
+	}
+
+	return start, quantity, nil
+}
+
+// isBitFunctionCode returns true if requests with given function code read
+// coils or discrete inputs.
+func isBitFunctionCode(functionCode uint8) bool {
+	return functionCode == ReadCoils || functionCode == ReadDiscreteInputs
+}
+
 // ServeModbus writes a Modbus response.
 func (h ReadHandler) ServeModbus(w io.Writer, req Request) {
-	start := int(binary.BigEndian.Uint16(req.Data[:2]))
-	quantity := int(binary.BigEndian.Uint16(req.Data[2:4]))
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h ReadHandler) ServeModbusE(w io.Writer, req Request) error {
+	start, quantity, err := parseReadRequest(req)
+	if err != nil {
+		return respond(w, NewErrorResponse(req, err))
+	}
 
-	values, err := h.handle(int(req.UnitID), start, quantity)
+	values, err := h.handle(req.Context(), int(req.UnitID), start, quantity)
 	if err != nil {
-		respond(w, NewErrorResponse(req, err))
-		return
+		return respondError(w, req, err)
+	}
+
+	if ok, err := checkQuantity(w, req, quantity, values); !ok {
+		return err
 	}
 
 	var data []byte
 
 	switch req.FunctionCode {
 	case ReadCoils, ReadDiscreteInputs:
-		data = append(data, reduce(values)...)
+		data = reduce(values)
 	default:
-		for _, v := range values {
-			b, err := v.MarshalBinary()
-			if err != nil {
-				respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
-				return
-			}
-
-			data = append(data, b...)
+		data, err = MarshalValues(values)
+		if err != nil {
+			return respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
 		}
 	}
 
-	respond(w, NewResponse(req, data))
+	return respond(w, NewResponse(req, data))
 }
 
-func respond(w io.Writer, resp *Response) {
-	data, err := resp.MarshalBinary()
+// RawReadHandlerFunc is an adapter to allow the use of ordinary functions
+// returning data in wire format as handlers for Modbus read functions. For
+// function codes 1 and 2 it must return the packed coils, for function codes 3
+// and 4 the registers, 2 bytes big-endian each.
+type RawReadHandlerFunc func(unitID, start, quantity int) ([]byte, error)
+
+// RawReadHandler can be used to respond on Modbus request with function codes
+// 1, 2, 3 and 4. Unlike ReadHandler, the data returned by the
+// RawReadHandlerFunc is sent as is.
+type RawReadHandler struct {
+	handle RawReadHandlerFunc
+}
+
+// NewRawReadHandler creates a new RawReadHandler.
+func NewRawReadHandler(h RawReadHandlerFunc) *RawReadHandler {
+	return &RawReadHandler{
+		handle: h,
+	}
+}
+
+// ServeModbus writes a Modbus response.
+func (h RawReadHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h RawReadHandler) ServeModbusE(w io.Writer, req Request) error {
+	start, quantity, err := parseReadRequest(req)
 	if err != nil {
-		log.Printf("Failed to marshal response: %v", err)
-		return
+		return respond(w, NewErrorResponse(req, err))
 	}
 
-	if _, err := w.Write(data); err != nil {
-		log.Printf("Failed to respond to client: %v", err)
+	data, err := h.handle(int(req.UnitID), start, quantity)
+	if err != nil {
+		return respondError(w, req, err)
 	}
+
+	length := quantity * 2
+	if isBitFunctionCode(req.FunctionCode) {
+		length = (quantity + 7) / 8
+	}
+
+	if len(data) != length {
+		writerLogger(w).Error("read handler returned invalid number of bytes", append(requestFields(req),
+			Field{Key: "expected", Value: length},
+			Field{Key: "actual", Value: len(data)},
+		)...)
+		return respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+	}
+
+	return respond(w, NewResponse(req, data))
 }
 
-// reduce takes slice like [1, 0, 1, 0, 0, 1] and reduces that to a byte.
-func reduce(values []Value) []byte {
-	length := len(values) / 8
-	if len(values)%8 > 0 {
-		length++
+// checkQuantity verifies that a ReadHandlerFunc returned exactly quantity
+// values. Otherwise the response wouldn't match what the client expects, so
+// the mistake is logged and a SlaveDeviceFailureError is sent. It returns
+// false when the quantity is wrong, together with the error of writing the
+// response.
+func checkQuantity(w io.Writer, req Request, quantity int, values []Value) (bool, error) {
+	if len(values) == quantity {
+		return true, nil
 	}
-	reduced := make([]byte, length)
 
-	n := length - 1
+	writerLogger(w).Error("read handler returned invalid number of values", append(requestFields(req),
+		Field{Key: "expected", Value: quantity},
+		Field{Key: "actual", Value: len(values)},
+	)...)
+	return false, respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+}
 
-	// Iterate over 8 values a time.
-	for i := 0; i <= len(values); i = i + 8 {
-		end := i + 8
-		if end > len(values)-1 {
-			end = len(values)
+// respondError responds with an exception for an error returned by a handler
+// func. An error which isn't an Error and doesn't wrap one is logged and
+// translated by the error mapper of the server, if any.
+func respondError(w io.Writer, req Request, err error) error {
+	var e Error
+	if !errors.As(err, &e) {
+		writerLogger(w).Error("handler failed", append(requestFields(req), errField(err))...)
+
+		if req.errorMapper != nil {
+			err = req.errorMapper(err)
 		}
+	}
 
-		b := values[i:end]
-		for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
-			b[i], b[j] = b[j], b[i]
+	return respond(w, NewErrorResponse(req, err))
+}
+
+// respond writes resp to w. It returns an error when writing fails, a
+// response which can't be marshaled is logged instead.
+func respond(w io.Writer, resp *Response) error {
+	data, err := resp.MarshalBinary()
+	if err != nil {
+		writerLogger(w).Error("failed to marshal response", append(messageFields(resp.MBAP, resp.FunctionCode), errField(err))...)
+		return nil
+	}
+
+	// Write errors are reported by the server as well, which closes the
+	// connection.
+	if _, err := w.Write(data); err != nil {
+		writerLogger(w).Debug("failed to write response", append(messageFields(resp.MBAP, resp.FunctionCode), errField(err))...)
+		return fmt.Errorf("failed to write response: %v", err)
+	}
+
+	return nil
+}
+
+// ReadCoilsHandlerFunc is an adapter to allow the use of ordinary functions
+// returning booleans as handlers for Modbus read coils and read discrete
+// inputs requests.
+type ReadCoilsHandlerFunc func(unitID, start, quantity int) ([]bool, error)
+
+// NewCoilReadHandler creates a ReadHandler for function codes 1 and 2 which
+// converts the booleans returned by h to values.
+func NewCoilReadHandler(h ReadCoilsHandlerFunc) *ReadHandler {
+	return NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		coils, err := h(unitID, start, quantity)
+		if err != nil {
+			return nil, err
 		}
 
-		for _, v := range b {
-			reduced[n] = reduced[n] << 1
-			if v.Get() > 0 {
-				reduced[n] = reduced[n] | 1
-			}
+		values := make([]Value, len(coils))
+		for i, c := range coils {
+			values[i] = NewBoolValue(c)
 		}
 
-		n--
+		return values, nil
+	})
+}
+
+// reduce packs values like [1, 0, 1, 0, 0, 1] into bytes, every non-zero value
+// is packed as 1. The first value is stored in the least significant bit of
+// the first byte, the last byte is padded with zeros towards the most
+// significant bit.
+func reduce(values []Value) []byte {
+	reduced := make([]byte, (len(values)+7)/8)
+
+	for i, v := range values {
+		if v.Bool() {
+			reduced[i/8] |= 1 << uint(i%8)
+		}
 	}
 
 	return reduced
@@ -124,15 +332,32 @@ func reduce(values []Value) []byte {
 // handlers for Modbus write functions.
 type WriteHandlerFunc func(unitID, start int, values []Value) error
 
+// WriteHandlerContextFunc is like WriteHandlerFunc, but it receives the
+// context of the request, see ReadHandlerContextFunc.
+type WriteHandlerContextFunc func(ctx context.Context, unitID, start int, values []Value) error
+
 // WriteHandler can be used to respond on Modbus request with function codes
-// 5 and 6.
+// 5, 6, 15 and 16.
 type WriteHandler struct {
-	handler    WriteHandlerFunc
+	handler    WriteHandlerContextFunc
 	signedness Signedness
+
+	// LenientCoilValues makes the handler treat every non-zero value of a
+	// write single coil request as on. By default only 0x0000 (off) and
+	// 0xFF00 (on) are accepted, as the specification requires.
+	LenientCoilValues bool
 }
 
 // NewWriteHandler creates a new WriteHandler.
 func NewWriteHandler(h WriteHandlerFunc, s Signedness) *WriteHandler {
+	return NewWriteHandlerCtx(func(ctx context.Context, unitID, start int, values []Value) error {
+		return h(unitID, start, values)
+	}, s)
+}
+
+// NewWriteHandlerCtx creates a new WriteHandler which passes the context of
+// the request to h.
+func NewWriteHandlerCtx(h WriteHandlerContextFunc, s Signedness) *WriteHandler {
 	return &WriteHandler{
 		handler:    h,
 		signedness: s,
@@ -141,91 +366,756 @@ func NewWriteHandler(h WriteHandlerFunc, s Signedness) *WriteHandler {
 
 // ServeModbus handles a Modbus request and returns a response.
 func (h WriteHandler) ServeModbus(w io.Writer, req Request) {
-	var err error
-	var resp *Response
-	var values []Value
-	start := int(binary.BigEndian.Uint16(req.Data[:2]))
+	_ = h.ServeModbusE(w, req)
+}
 
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h WriteHandler) ServeModbusE(w io.Writer, req Request) error {
 	switch req.FunctionCode {
-	case WriteSingleCoil:
-		values, err = h.handleWriteSingleCoil(req)
-	case WriteSingleRegister:
-		values, err = h.handleWriteSingleRegister(req)
-	case WriteMultipleRegisters:
-		values, err = h.handleWriteMultipleRegisters(req)
+	case WriteSingleCoil, WriteSingleRegister, WriteMultipleCoils, WriteMultipleRegisters:
+	default:
+		return respond(w, NewErrorResponse(req, IllegalFunctionError))
+	}
+
+	values, err := req.writeValues(h.signedness, h.LenientCoilValues)
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	start, err := req.Start()
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	if err := h.handler(req.Context(), int(req.UnitID), start, values); err != nil {
+		return respondError(w, req, err)
+	}
+
+	return respond(w, NewResponse(req, req.Data[0:4]))
+}
+
+// NewTransactionalWriteHandler creates a WriteHandler which writes all values
+// of a request or none of them. It calls validate, when not nil, with all
+// values of the request and rejects the request without writing when it
+// returns an error. Otherwise it saves the current values using read and
+// writes the new values using write. When write fails, the saved values are
+// written back using write before the error of write is returned.
+//
+// The handler executes one request at a time, so other requests served by it
+// never see a partial write.
+func NewTransactionalWriteHandler(validate WriteHandlerFunc, read ReadHandlerFunc, write WriteHandlerFunc, s Signedness) *WriteHandler {
+	var mu sync.Mutex
+
+	return NewWriteHandler(func(unitID, start int, values []Value) error {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if validate != nil {
+			if err := validate(unitID, start, values); err != nil {
+				return err
+			}
+		}
+
+		old, err := read(unitID, start, len(values))
+		if err != nil {
+			return err
+		}
+		if len(old) != len(values) {
+			return fmt.Errorf("read handler returned %d values instead of %d", len(old), len(values))
+		}
+
+		if err := write(unitID, start, values); err != nil {
+			if rerr := write(unitID, start, old); rerr != nil {
+				return fmt.Errorf("%w, rolling back failed: %v", err, rerr)
+			}
+
+			return err
+		}
+
+		return nil
+	}, s)
+}
+
+// CoilWriteHandlerFunc is an adapter to allow the use of ordinary functions
+// receiving booleans as handlers for Modbus write coil requests.
+type CoilWriteHandlerFunc func(unitID, start int, values []bool) error
+
+// CoilWriteHandler can be used to respond on Modbus request with function
+// codes 5 and 15.
+type CoilWriteHandler struct {
+	h *WriteHandler
+}
+
+// NewCoilWriteHandler creates a new CoilWriteHandler.
+func NewCoilWriteHandler(h CoilWriteHandlerFunc) *CoilWriteHandler {
+	return &CoilWriteHandler{
+		h: NewWriteHandler(func(unitID, start int, values []Value) error {
+			coils := make([]bool, len(values))
+			for i := range values {
+				coils[i] = values[i].Bool()
+			}
+
+			return h(unitID, start, coils)
+		}, Unsigned),
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h CoilWriteHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h CoilWriteHandler) ServeModbusE(w io.Writer, req Request) error {
+	if req.FunctionCode != WriteSingleCoil && req.FunctionCode != WriteMultipleCoils {
+		return respond(w, NewErrorResponse(req, IllegalFunctionError))
+	}
+
+	return serveModbusE(h.h, w, req)
+}
+
+// MaskWriteHandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers for Modbus mask write register requests. The content of the
+// register at addr must be modified like this:
+//
+//	result = (current AND andMask) OR (orMask AND (NOT andMask))
+type MaskWriteHandlerFunc func(unitID, addr int, andMask, orMask uint16) error
+
+// MaskWriteHandler can be used to respond on Modbus request with function
+// code 22.
+type MaskWriteHandler struct {
+	handler MaskWriteHandlerFunc
+}
+
+// NewMaskWriteHandler creates a new MaskWriteHandler.
+func NewMaskWriteHandler(h MaskWriteHandlerFunc) *MaskWriteHandler {
+	return &MaskWriteHandler{
+		handler: h,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h MaskWriteHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h MaskWriteHandler) ServeModbusE(w io.Writer, req Request) error {
+	// The byte slice request.Data follows this format:
+	//
+	// ================= ===============
+	// Field             Length (bytes)
+	// ================= ===============
+	// Reference Address 2
+	// And_Mask          2
+	// Or_Mask           2
+	// ================= ===============
+	if len(req.Data) != 6 {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	addr := int(binary.BigEndian.Uint16(req.Data[:2]))
+	andMask := binary.BigEndian.Uint16(req.Data[2:4])
+	orMask := binary.BigEndian.Uint16(req.Data[4:6])
+
+	if err := h.handler(int(req.UnitID), addr, andMask, orMask); err != nil {
+		return respondError(w, req, err)
+	}
+
+	return respond(w, NewResponse(req, req.Data))
+}
+
+// ReadWriteHandler can be used to respond on Modbus request with function
+// code 23. The write is executed before the read.
+type ReadWriteHandler struct {
+	read       ReadHandlerFunc
+	write      WriteHandlerFunc
+	signedness Signedness
+}
+
+// NewReadWriteHandler creates a new ReadWriteHandler.
+func NewReadWriteHandler(r ReadHandlerFunc, w WriteHandlerFunc, s Signedness) *ReadWriteHandler {
+	return &ReadWriteHandler{
+		read:       r,
+		write:      w,
+		signedness: s,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h ReadWriteHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h ReadWriteHandler) ServeModbusE(w io.Writer, req Request) error {
+	values, err := req.WriteValues(h.signedness)
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	// WriteValues validated the data, so it contains the starting
+	// addresses and the quantity to read.
+	readStart, _ := req.Start()
+	readQuantity, _ := req.Quantity()
+	writeStart := int(binary.BigEndian.Uint16(req.Data[4:6]))
+
+	if readQuantity < 1 || readQuantity > maxReadRegisters {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	if readStart+readQuantity > addressSpace {
+		return respond(w, NewErrorResponse(req, IllegalAddressError))
+	}
+
+	if err := h.write(int(req.UnitID), writeStart, values); err != nil {
+		return respondError(w, req, err)
+	}
+
+	values, err = h.read(int(req.UnitID), readStart, readQuantity)
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	if ok, err := checkQuantity(w, req, readQuantity, values); !ok {
+		return err
+	}
+
+	data, err := MarshalValues(values)
+	if err != nil {
+		return respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+	}
+
+	return respond(w, NewResponse(req, data))
+}
+
+// ExceptionStatusHandlerFunc is an adapter to allow the use of ordinary
+// functions as handlers for Modbus read exception status requests. It must
+// return the 8 exception status outputs of the unit packed in a single byte.
+type ExceptionStatusHandlerFunc func(unitID int) (uint8, error)
+
+// ExceptionStatusHandler can be used to respond on Modbus request with
+// function code 7.
+type ExceptionStatusHandler struct {
+	handler ExceptionStatusHandlerFunc
+}
+
+// NewExceptionStatusHandler creates a new ExceptionStatusHandler.
+func NewExceptionStatusHandler(h ExceptionStatusHandlerFunc) *ExceptionStatusHandler {
+	return &ExceptionStatusHandler{
+		handler: h,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h ExceptionStatusHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h ExceptionStatusHandler) ServeModbusE(w io.Writer, req Request) error {
+	status, err := h.handler(int(req.UnitID))
+	if err != nil {
+		return respondError(w, req, err)
 	}
 
+	return respond(w, NewResponse(req, []byte{status}))
+}
+
+// ReturnQueryData is the diagnostics sub-function code 0. The data of the
+// request is echoed in the response.
+const ReturnQueryData uint16 = 0
+
+// DiagnosticsHandlerFunc is an adapter to allow the use of ordinary functions
+// as handlers for a diagnostics sub-function. It's called with the data of the
+// request and must return the data for the response.
+type DiagnosticsHandlerFunc func(unitID int, data []byte) ([]byte, error)
+
+// DiagnosticsHandler can be used to respond on Modbus request with function
+// code 8. It dispatches the request based on the sub-function code.
+type DiagnosticsHandler struct {
+	handlers map[uint16]DiagnosticsHandlerFunc
+}
+
+// NewDiagnosticsHandler creates a new DiagnosticsHandler. The handler
+// implements the sub-function ReturnQueryData out of the box.
+func NewDiagnosticsHandler() *DiagnosticsHandler {
+	h := &DiagnosticsHandler{
+		handlers: make(map[uint16]DiagnosticsHandlerFunc),
+	}
+
+	h.Handle(ReturnQueryData, func(unitID int, data []byte) ([]byte, error) {
+		return data, nil
+	})
+
+	return h
+}
+
+// Handle registers the handler for the given sub-function code.
+func (h *DiagnosticsHandler) Handle(subFunction uint16, f DiagnosticsHandlerFunc) {
+	h.handlers[subFunction] = f
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h DiagnosticsHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h DiagnosticsHandler) ServeModbusE(w io.Writer, req Request) error {
+	if len(req.Data) < 2 {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	f, ok := h.handlers[binary.BigEndian.Uint16(req.Data[:2])]
+	if !ok {
+		return respond(w, NewErrorResponse(req, IllegalFunctionError))
+	}
+
+	data, err := f(int(req.UnitID), req.Data[2:])
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	return respond(w, NewResponse(req, append(req.Data[:2:2], data...)))
+}
+
+// CommEventLog is the communication event log of a unit.
+type CommEventLog struct {
+	// Status is 0xFFFF when the unit is still processing a previous
+	// command, otherwise it's 0.
+	Status uint16
+
+	// EventCount is the number of successful message completions.
+	EventCount uint16
+
+	// MessageCount is the number of messages processed by the unit.
+	MessageCount uint16
+
+	// Events contains the event bytes, the most recent event first. Only
+	// the 64 most recent events are sent to the client.
+	Events []byte
+}
+
+// CommEventLogHandlerFunc is an adapter to allow the use of ordinary functions
+// as handlers for Modbus get comm event log requests.
+type CommEventLogHandlerFunc func(unitID int) (CommEventLog, error)
+
+// CommEventLogHandler can be used to respond on Modbus request with function
+// code 12.
+type CommEventLogHandler struct {
+	handler CommEventLogHandlerFunc
+}
+
+// NewCommEventLogHandler creates a new CommEventLogHandler.
+func NewCommEventLogHandler(h CommEventLogHandlerFunc) *CommEventLogHandler {
+	return &CommEventLogHandler{
+		handler: h,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h CommEventLogHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h CommEventLogHandler) ServeModbusE(w io.Writer, req Request) error {
+	log, err := h.handler(int(req.UnitID))
 	if err != nil {
-		respond(w, NewErrorResponse(req, err))
-		return
+		return respondError(w, req, err)
 	}
 
-	err = h.handler(int(req.UnitID), start, values)
+	events := log.Events
+	if len(events) > 64 {
+		events = events[:64]
+	}
+
+	// The response data follows this format, the byte count is prepended
+	// when the response is marshaled:
+	//
+	// ============= ===============
+	// Field         Length (bytes)
+	// ============= ===============
+	// Status        2
+	// Event Count   2
+	// Message Count 2
+	// Events        0 up to 64
+	// ============= ===============
+	data := make([]byte, 6, 6+len(events))
+	binary.BigEndian.PutUint16(data[0:2], log.Status)
+	binary.BigEndian.PutUint16(data[2:4], log.EventCount)
+	binary.BigEndian.PutUint16(data[4:6], log.MessageCount)
+	data = append(data, events...)
+
+	return respond(w, NewResponse(req, data))
+}
+
+// ServerIDHandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers for Modbus report server ID requests. It returns the server ID,
+// whether the unit is running and optional additional data.
+type ServerIDHandlerFunc func(unitID int) (id []byte, running bool, extra []byte, err error)
 
+// ServerIDHandler can be used to respond on Modbus request with function code
+// 17.
+type ServerIDHandler struct {
+	handler ServerIDHandlerFunc
+}
+
+// NewServerIDHandler creates a new ServerIDHandler.
+func NewServerIDHandler(h ServerIDHandlerFunc) *ServerIDHandler {
+	return &ServerIDHandler{
+		handler: h,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h ServerIDHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h ServerIDHandler) ServeModbusE(w io.Writer, req Request) error {
+	id, running, extra, err := h.handler(int(req.UnitID))
 	if err != nil {
-		respond(w, NewErrorResponse(req, err))
-		return
+		return respondError(w, req, err)
 	}
 
-	resp = NewResponse(req, req.Data[0:4])
-	respond(w, resp)
+	indicator := byte(0x00)
+	if running {
+		indicator = 0xff
+	}
+
+	data := append([]byte{}, id...)
+	data = append(data, indicator)
+	data = append(data, extra...)
+
+	// The byte count is stored in a single byte.
+	if len(data) > 255 {
+		return respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+	}
+
+	return respond(w, NewResponse(req, data))
 }
 
-func (h WriteHandler) handleWriteSingleCoil(req Request) ([]Value, error) {
-	var v Value
-	values := make([]Value, 1)
-	if err := v.UnmarshalBinary(req.Data[2:4], Unsigned); err != nil {
-		return values, fmt.Errorf("failed to hande write single coil request: %v", err)
+// fileReferenceType is the reference type of every sub-request of a file
+// record request.
+const fileReferenceType = 6
+
+// maxRecordNumber is the highest record number of a file.
+const maxRecordNumber = 0x270f
+
+// ReadFileHandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers for Modbus read file record requests. It's called for every
+// sub-request and must return exactly length values.
+type ReadFileHandlerFunc func(unitID, file, record, length int) ([]Value, error)
+
+// ReadFileHandler can be used to respond on Modbus request with function code
+// 20.
+type ReadFileHandler struct {
+	handler ReadFileHandlerFunc
+}
+
+// NewReadFileHandler creates a new ReadFileHandler.
+func NewReadFileHandler(h ReadFileHandlerFunc) *ReadFileHandler {
+	return &ReadFileHandler{
+		handler: h,
 	}
+}
 
-	if v.Get() != 0 {
-		if err := v.Set(1); err != nil {
-			return values, IllegalDataValueError
+// ServeModbus handles a Modbus request and returns a response.
+func (h ReadFileHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h ReadFileHandler) ServeModbusE(w io.Writer, req Request) error {
+	// The byte slice request.Data follows this format:
+	//
+	// ================ ===============
+	// Field            Length (bytes)
+	// ================ ===============
+	// Byte count       1
+	// Sub-requests     n * 7
+	// ================ ===============
+	//
+	// Every sub-request follows this format:
+	//
+	// ================ ===============
+	// Field            Length (bytes)
+	// ================ ===============
+	// Reference Type   1
+	// File Number      2
+	// Record Number    2
+	// Record Length    2
+	// ================ ===============
+	if len(req.Data) < 1 {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	byteCount := int(req.Data[0])
+	if byteCount < 7 || byteCount > 0xf5 || byteCount%7 != 0 || len(req.Data) != 1+byteCount {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	type subRequest struct {
+		file, record, length int
+	}
+
+	// All sub-requests are validated before calling the handler func. Every
+	// sub-response takes 2 bytes plus 2 bytes per register and the
+	// sub-responses together must fit in 0xf5 bytes.
+	var subRequests []subRequest
+	size := 0
+	for i := 1; i < len(req.Data); i += 7 {
+		group := req.Data[i : i+7]
+		if group[0] != fileReferenceType {
+			return respond(w, NewErrorResponse(req, IllegalDataValueError))
+		}
+
+		r := subRequest{
+			file:   int(binary.BigEndian.Uint16(group[1:3])),
+			record: int(binary.BigEndian.Uint16(group[3:5])),
+			length: int(binary.BigEndian.Uint16(group[5:7])),
+		}
+
+		if r.record > maxRecordNumber {
+			return respond(w, NewErrorResponse(req, IllegalAddressError))
 		}
+
+		size += 2 + r.length*2
+		if r.length == 0 || size > 0xf5 {
+			return respond(w, NewErrorResponse(req, IllegalDataValueError))
+		}
+
+		subRequests = append(subRequests, r)
 	}
-	values[0] = v
 
-	return values, nil
+	var data []byte
+	for _, r := range subRequests {
+		values, err := h.handler(int(req.UnitID), r.file, r.record, r.length)
+		if err != nil {
+			return respondError(w, req, err)
+		}
+
+		if len(values) != r.length {
+			return respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+		}
+
+		// Every sub-response starts with its length, followed by the
+		// reference type and the record data.
+		b, err := MarshalValues(values)
+		if err != nil {
+			return respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+		}
+
+		data = append(data, uint8(1+r.length*2), fileReferenceType)
+		data = append(data, b...)
+	}
+
+	return respond(w, NewResponse(req, data))
 }
 
-func (h WriteHandler) handleWriteSingleRegister(req Request) ([]Value, error) {
-	var v Value
-	if err := v.UnmarshalBinary(req.Data[2:4], h.signedness); err != nil {
-		return []Value{}, fmt.Errorf("failed to hande write single register request: %v", err)
+// WriteFileHandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers for Modbus write file record requests. It's called for every
+// sub-request.
+type WriteFileHandlerFunc func(unitID, file, record int, values []Value) error
+
+// WriteFileHandler can be used to respond on Modbus request with function code
+// 21.
+type WriteFileHandler struct {
+	handler    WriteFileHandlerFunc
+	signedness Signedness
+}
+
+// NewWriteFileHandler creates a new WriteFileHandler.
+func NewWriteFileHandler(h WriteFileHandlerFunc, s Signedness) *WriteFileHandler {
+	return &WriteFileHandler{
+		handler:    h,
+		signedness: s,
 	}
-	return []Value{v}, nil
 }
 
-func (h WriteHandler) handleWriteMultipleRegisters(req Request) ([]Value, error) {
-	quantity := int(binary.BigEndian.Uint16(req.Data[2:4]))
-	values := []Value{}
+// fileRecord is a single sub-request of a write file record request.
+type fileRecord struct {
+	file   int
+	record int
+	values []Value
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h WriteFileHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h WriteFileHandler) ServeModbusE(w io.Writer, req Request) error {
+	records, err := h.parseRecords(req)
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	for _, r := range records {
+		if err := h.handler(int(req.UnitID), r.file, r.record, r.values); err != nil {
+			return respondError(w, req, err)
+		}
+	}
+
+	return respond(w, NewResponse(req, req.Data))
+}
 
+// parseRecords parses all sub-requests. No handler is invoked before every
+// sub-request has been validated, so a malformed request never results in a
+// partial write.
+func (h WriteFileHandler) parseRecords(req Request) ([]fileRecord, error) {
 	// The byte slice request.Data follows this format:
 	//
 	// ================ ===============
 	// Field            Length (bytes)
 	// ================ ===============
-	// Starting Address 2
-	// Quantity         2
 	// Byte count       1
-	// Values           n
+	// Sub-requests     n
 	// ================ ===============
 	//
-	// The values are prepended with 5 bytes of meta data.
-	// Every value is 2 bytes long.
-	offset := 5
-	if len(req.Data) != offset+(quantity*2) {
-		return values, IllegalDataValueError
+	// Every sub-request follows this format:
+	//
+	// ================ ===============
+	// Field            Length (bytes)
+	// ================ ===============
+	// Reference Type   1
+	// File Number      2
+	// Record Number    2
+	// Record Length    2
+	// Record Data      Record Length * 2
+	// ================ ===============
+	records := []fileRecord{}
+	if len(req.Data) < 1 {
+		return records, IllegalDataValueError
 	}
 
-	for i := 0; i < quantity*2; i += 2 {
-		var v Value
-		if err := v.UnmarshalBinary(req.Data[offset+i:offset+i+2], h.signedness); err != nil {
-			return values, fmt.Errorf("failed to hande write multiple registers request: %v", err)
+	byteCount := int(req.Data[0])
+	if byteCount < 9 || byteCount > 0xfb || len(req.Data) != 1+byteCount {
+		return records, IllegalDataValueError
+	}
+
+	for i := 1; i < len(req.Data); {
+		if len(req.Data) < i+7 || req.Data[i] != fileReferenceType {
+			return records, IllegalDataValueError
+		}
+
+		r := fileRecord{
+			file:   int(binary.BigEndian.Uint16(req.Data[i+1 : i+3])),
+			record: int(binary.BigEndian.Uint16(req.Data[i+3 : i+5])),
+		}
+
+		length := int(binary.BigEndian.Uint16(req.Data[i+5 : i+7]))
+		i += 7
+
+		if r.record > maxRecordNumber {
+			return records, IllegalAddressError
 		}
 
-		values = append(values, v)
+		if length == 0 || len(req.Data) < i+length*2 {
+			return records, IllegalDataValueError
+		}
+
+		values, err := UnmarshalValues(req.Data[i:i+length*2], h.signedness)
+		if err != nil {
+			return records, fmt.Errorf("failed to handle write file record request: %v", err)
+		}
+
+		r.values = values
+		i += length * 2
+
+		records = append(records, r)
+	}
+
+	return records, nil
+}
+
+// FIFOHandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers for Modbus read FIFO queue requests. It's called with the FIFO
+// pointer address and must return the values in the queue, at most 31.
+type FIFOHandlerFunc func(unitID, addr int) ([]Value, error)
+
+// FIFOHandler can be used to respond on Modbus request with function code 24.
+type FIFOHandler struct {
+	handler FIFOHandlerFunc
+}
+
+// NewFIFOHandler creates a new FIFOHandler.
+func NewFIFOHandler(h FIFOHandlerFunc) *FIFOHandler {
+	return &FIFOHandler{
+		handler: h,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h FIFOHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h FIFOHandler) ServeModbusE(w io.Writer, req Request) error {
+	if len(req.Data) != 2 {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	values, err := h.handler(int(req.UnitID), int(binary.BigEndian.Uint16(req.Data)))
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	resp, err := NewFIFOQueueResponse(req, values)
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	return respond(w, resp)
+}
+
+// PDUHandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers for user-defined function codes. It's called with the data of the
+// request and must return the data of the response.
+type PDUHandlerFunc func(unitID int, data []byte) ([]byte, error)
+
+// PDUHandler can be used to respond on Modbus request with any function code,
+// for example the user-defined function codes 65 through 72 and 100 through
+// 110. The data returned by the PDUHandlerFunc is sent verbatim.
+type PDUHandler struct {
+	handler PDUHandlerFunc
+}
+
+// NewPDUHandler creates a new PDUHandler.
+func NewPDUHandler(h PDUHandlerFunc) *PDUHandler {
+	return &PDUHandler{
+		handler: h,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h PDUHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h PDUHandler) ServeModbusE(w io.Writer, req Request) error {
+	data, err := h.handler(int(req.UnitID), req.Data)
+	if err != nil {
+		return respondError(w, req, err)
 	}
 
-	return values, nil
+	return respond(w, NewRawResponse(req, data))
 }
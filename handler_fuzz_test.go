@@ -0,0 +1,97 @@
+//go:build go1.18
+// +build go1.18
+
+package modbus
+
+import (
+	"bytes"
+	"testing"
+)
+
+// FuzzHandlers feeds arbitrary PDUs to the handlers of every supported
+// function code. A handler must never panic, it must always respond.
+func FuzzHandlers(f *testing.F) {
+	read := func(unitID, start, quantity int) ([]Value, error) {
+		return make([]Value, quantity), nil
+	}
+	write := func(unitID, start int, values []Value) error {
+		return nil
+	}
+
+	handlers := map[uint8]Handler{
+		ReadCoils:              NewReadHandler(read),
+		ReadDiscreteInputs:     NewReadHandler(read),
+		ReadHoldingRegisters:   NewReadHandler(read),
+		ReadInputRegisters:     NewReadHandler(read),
+		WriteSingleCoil:        NewWriteHandler(write, Unsigned),
+		WriteSingleRegister:    NewWriteHandler(write, Signed),
+		WriteMultipleCoils:     NewWriteHandler(write, Unsigned),
+		WriteMultipleRegisters: NewWriteHandler(write, Signed),
+		ReadExceptionStatus: NewExceptionStatusHandler(func(unitID int) (uint8, error) {
+			return 0, nil
+		}),
+		Diagnostics: NewDiagnosticsHandler(),
+		GetCommEventLog: NewCommEventLogHandler(func(unitID int) (CommEventLog, error) {
+			return CommEventLog{}, nil
+		}),
+		ReportServerID: NewServerIDHandler(func(unitID int) ([]byte, bool, []byte, error) {
+			return []byte{0x1}, true, nil, nil
+		}),
+		ReadFileRecord: NewReadFileHandler(func(unitID, file, record, length int) ([]Value, error) {
+			return make([]Value, length), nil
+		}),
+		WriteFileRecord: NewWriteFileHandler(func(unitID, file, record int, values []Value) error {
+			return nil
+		}, Unsigned),
+		MaskWriteRegister: NewMaskWriteHandler(func(unitID, addr int, andMask, orMask uint16) error {
+			return nil
+		}),
+		ReadWriteMultipleRegisters: NewReadWriteHandler(read, write, Unsigned),
+		ReadFIFOQueue: NewFIFOHandler(func(unitID, addr int) ([]Value, error) {
+			return nil, nil
+		}),
+		EncapsulatedInterfaceTransport: NewMEIHandler(),
+	}
+
+	// Seed the corpus with valid requests and every truncation of them.
+	seeds := map[uint8][]byte{
+		ReadCoils:                      {0x0, 0x0, 0x0, 0x8},
+		ReadDiscreteInputs:             {0x0, 0x0, 0x0, 0x8},
+		ReadHoldingRegisters:           {0x0, 0x0, 0x0, 0x2},
+		ReadInputRegisters:             {0x0, 0x0, 0x0, 0x2},
+		WriteSingleCoil:                {0x0, 0x0, 0xff, 0x0},
+		WriteSingleRegister:            {0x0, 0x0, 0x0, 0x1},
+		WriteMultipleCoils:             {0x0, 0x0, 0x0, 0x2, 0x1, 0x3},
+		WriteMultipleRegisters:         {0x0, 0x0, 0x0, 0x1, 0x2, 0x0, 0x1},
+		ReadExceptionStatus:            {},
+		Diagnostics:                    {0x0, 0x0, 0x12, 0x34},
+		GetCommEventLog:                {},
+		ReportServerID:                 {},
+		ReadFileRecord:                 {0x7, 0x6, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1},
+		WriteFileRecord:                {0x9, 0x6, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1},
+		MaskWriteRegister:              {0x0, 0x0, 0x0, 0xf2, 0x0, 0x25},
+		ReadWriteMultipleRegisters:     {0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x2, 0x0, 0x1},
+		ReadFIFOQueue:                  {0x0, 0x0},
+		EncapsulatedInterfaceTransport: {0xe, 0x1, 0x0},
+	}
+
+	for fc, data := range seeds {
+		for i := 0; i <= len(data); i++ {
+			f.Add(fc, data[:i])
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, fc uint8, data []byte) {
+		h, ok := handlers[fc]
+		if !ok {
+			return
+		}
+
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, Request{FunctionCode: fc, Data: data})
+
+		if buf.Len() == 0 {
+			t.Errorf("handler for function code %d didn't respond to %x", fc, data)
+		}
+	})
+}
@@ -2,6 +2,9 @@ package modbus
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -21,11 +24,11 @@ func TestReadHandler(t *testing.T) {
 		expected []byte
 	}{
 		{
-			Request{MBAP{}, ReadCoils, []byte{0x0, 0x5, 0x0, 0x3}},
+			Request{MBAP: MBAP{}, FunctionCode: ReadCoils, Data: []byte{0x0, 0x5, 0x0, 0x3}},
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x1, 0x1, 0x6},
 		},
 		{
-			Request{MBAP{}, ReadHoldingRegisters, []byte{0x0, 0x5, 0x0, 0x3}},
+			Request{MBAP: MBAP{}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x5, 0x0, 0x3}},
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x9, 0x0, 0x3, 0x6, 0x0, 0x0, 0x0, 0x1, 0x0, 0x1},
 		},
 	}
@@ -37,14 +40,328 @@ func TestReadHandler(t *testing.T) {
 	}
 }
 
+func TestCoilReadHandler(t *testing.T) {
+	h := NewCoilReadHandler(func(unitID, start, quantity int) ([]bool, error) {
+		if start == 1 {
+			return nil, IllegalAddressError
+		}
+
+		return []bool{true, false, true, true, false, false, true, true, true}, nil
+	})
+
+	buf := new(bytes.Buffer)
+	h.ServeModbus(buf, Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x0, 0x0, 0x9}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x1, 0x2, 0xcd, 0x1}, buf.Bytes())
+
+	buf.Reset()
+	h.ServeModbus(buf, Request{FunctionCode: ReadDiscreteInputs, Data: []byte{0x0, 0x1, 0x0, 0x9}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x82, 0x2}, buf.Bytes())
+}
+
+func TestContextHandlers(t *testing.T) {
+	type key struct{}
+	ctx := context.WithValue(context.Background(), key{}, "pump")
+
+	var got []interface{}
+	r := NewReadHandlerCtx(func(ctx context.Context, unitID, start, quantity int) ([]Value, error) {
+		got = append(got, ctx.Value(key{}))
+		return []Value{Value{0xa}}, nil
+	})
+	w := NewWriteHandlerCtx(func(ctx context.Context, unitID, start int, values []Value) error {
+		got = append(got, ctx.Value(key{}))
+		return ctx.Err()
+	}, Unsigned)
+
+	buf := new(bytes.Buffer)
+	r.ServeModbus(buf, Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}.WithContext(ctx))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3, 0x2, 0x0, 0xa}, buf.Bytes())
+
+	buf.Reset()
+	w.ServeModbus(buf, Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x1, 0x0, 0x3}}.WithContext(ctx))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x6, 0x0, 0x1, 0x0, 0x3}, buf.Bytes())
+	assert.Equal(t, []interface{}{"pump", "pump"}, got)
+
+	// A handler failing because the context is canceled results in a
+	// SlaveDeviceFailureError.
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+
+	buf.Reset()
+	w.ServeModbus(buf, Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x1, 0x0, 0x3}}.WithContext(canceled))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x4}, buf.Bytes())
+}
+
+func TestRawReadHandler(t *testing.T) {
+	h := NewRawReadHandler(func(unitID, start, quantity int) ([]byte, error) {
+		switch start {
+		case 1:
+			return nil, IllegalAddressError
+		case 2:
+			return []byte{0x1}, nil
+		case 3:
+			return []byte{0xcd, 0x1}, nil
+		}
+
+		return []byte{0x0, 0xa, 0xff, 0xfe}, nil
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x7, 0x0, 0x3, 0x4, 0x0, 0xa, 0xff, 0xfe},
+		},
+		{
+			Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x3, 0x0, 0xa}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x1, 0x2, 0xcd, 0x1},
+		},
+		{
+			Request{FunctionCode: ReadInputRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x84, 0x2},
+		},
+		{
+			// The length of the data doesn't match the quantity.
+			Request{FunctionCode: ReadInputRegisters, Data: []byte{0x0, 0x0, 0x0, 0x3}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x84, 0x4},
+		},
+		{
+			Request{FunctionCode: ReadDiscreteInputs, Data: []byte{0x0, 0x2, 0x0, 0x9}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x82, 0x4},
+		},
+		{
+			Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func BenchmarkReadHandler(b *testing.B) {
+	values := make([]Value, maxReadRegisters)
+	h := NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return values, nil
+	})
+
+	benchmarkReadHandler(b, h)
+}
+
+func BenchmarkRawReadHandler(b *testing.B) {
+	data := make([]byte, maxReadRegisters*2)
+	h := NewRawReadHandler(func(unitID, start, quantity int) ([]byte, error) {
+		return data, nil
+	})
+
+	benchmarkReadHandler(b, h)
+}
+
+func benchmarkReadHandler(b *testing.B, h Handler) {
+	req := Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, maxReadRegisters}}
+
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		h.ServeModbus(ioutil.Discard, req)
+	}
+}
+
+func TestReadHandlerQuantity(t *testing.T) {
+	var called bool
+	h := NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		called = true
+		return make([]Value, quantity), nil
+	})
+
+	tests := []struct {
+		functionCode uint8
+		quantity     uint16
+		valid        bool
+	}{
+		{ReadCoils, 0, false},
+		{ReadCoils, 1, true},
+		{ReadCoils, 2000, true},
+		{ReadCoils, 2001, false},
+		{ReadDiscreteInputs, 0, false},
+		{ReadDiscreteInputs, 2000, true},
+		{ReadDiscreteInputs, 0xffff, false},
+		{ReadHoldingRegisters, 0, false},
+		{ReadHoldingRegisters, 1, true},
+		{ReadHoldingRegisters, 125, true},
+		{ReadHoldingRegisters, 126, false},
+		{ReadInputRegisters, 125, true},
+		{ReadInputRegisters, 126, false},
+		{ReadInputRegisters, 2000, false},
+	}
+
+	for _, test := range tests {
+		called = false
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, Request{FunctionCode: test.functionCode, Data: []byte{0x0, 0x0, byte(test.quantity >> 8), byte(test.quantity)}})
+
+		assert.Equal(t, test.valid, called)
+		if !test.valid {
+			assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, test.functionCode + 0x80, 0x3}, buf.Bytes())
+		}
+	}
+}
+
+func TestReadHandlerInvalidValues(t *testing.T) {
+	tests := []struct {
+		functionCode uint8
+		n            int
+	}{
+		{ReadCoils, 9},
+		{ReadDiscreteInputs, 7},
+		{ReadHoldingRegisters, 0},
+		{ReadInputRegisters, 9},
+	}
+
+	for _, test := range tests {
+		h := NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+			return make([]Value, test.n), nil
+		})
+
+		l := new(recordingLogger)
+		buf := new(bytes.Buffer)
+		h.ServeModbus(&errWriter{w: buf, l: l}, Request{FunctionCode: test.functionCode, Data: []byte{0x0, 0x0, 0x0, 0x8}})
+
+		assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, test.functionCode + 0x80, 0x4}, buf.Bytes())
+		assert.Equal(t, []string{"read handler returned invalid number of values"}, l.messages["error"])
+	}
+}
+
+func TestZeroQuantity(t *testing.T) {
+	read := NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		t.Errorf("read handler called with quantity %d", quantity)
+		return nil, nil
+	})
+	write := NewWriteHandler(func(unitID, start int, values []Value) error {
+		t.Errorf("write handler called with %d values", len(values))
+		return nil
+	}, Unsigned)
+
+	tests := []struct {
+		h   Handler
+		req Request
+	}{
+		{read, Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x1, 0x0, 0x0}}},
+		{read, Request{FunctionCode: ReadDiscreteInputs, Data: []byte{0x0, 0x1, 0x0, 0x0}}},
+		{read, Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x1, 0x0, 0x0}}},
+		{read, Request{FunctionCode: ReadInputRegisters, Data: []byte{0x0, 0x1, 0x0, 0x0}}},
+		{write, Request{FunctionCode: WriteMultipleCoils, Data: []byte{0x0, 0x1, 0x0, 0x0, 0x0}}},
+		{write, Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x0, 0x0}}},
+	}
+
+	for _, test := range tests {
+		test.req.MBAP = MBAP{TransactionID: 1, UnitID: 1}
+
+		buf := new(bytes.Buffer)
+		test.h.ServeModbus(buf, test.req)
+		assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x1, test.req.FunctionCode + 0x80, 0x3}, buf.Bytes())
+	}
+}
+
+func TestWriteMultipleRegistersQuantity(t *testing.T) {
+	var called bool
+	h := NewWriteHandler(func(unitID, start int, values []Value) error {
+		called = true
+		return nil
+	}, Unsigned)
+
+	// data returns the data of a request writing quantity registers with
+	// given byte count.
+	data := func(quantity int, byteCount byte) []byte {
+		d := []byte{0x0, 0x0, byte(quantity >> 8), byte(quantity), byteCount}
+		return append(d, make([]byte, quantity*2)...)
+	}
+
+	tests := []struct {
+		data  []byte
+		valid bool
+	}{
+		{data(0, 0), false},
+		{data(1, 2), true},
+		{data(123, 246), true},
+		{data(124, 248), false},
+		// The byte count doesn't match the quantity, although the
+		// length of the data does.
+		{data(2, 0xff), false},
+		{data(2, 2), false},
+	}
+
+	for _, test := range tests {
+		called = false
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, Request{FunctionCode: WriteMultipleRegisters, Data: test.data})
+
+		assert.Equal(t, test.valid, called)
+		if !test.valid {
+			assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x90, 0x3}, buf.Bytes())
+		}
+	}
+}
+
+func TestAddressOverflow(t *testing.T) {
+	var called bool
+	read := func(unitID, start, quantity int) ([]Value, error) {
+		called = true
+		return make([]Value, quantity), nil
+	}
+	write := func(unitID, start int, values []Value) error {
+		called = true
+		return nil
+	}
+
+	tests := []struct {
+		h     Handler
+		req   Request
+		valid bool
+	}{
+		{NewReadHandler(read), Request{FunctionCode: ReadCoils, Data: []byte{0xff, 0xf6, 0x0, 0xa}}, true},
+		{NewReadHandler(read), Request{FunctionCode: ReadCoils, Data: []byte{0xff, 0xf7, 0x0, 0xa}}, false},
+		{NewReadHandler(read), Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0xff, 0xff, 0x0, 0x1}}, true},
+		{NewReadHandler(read), Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0xff, 0xfa, 0x0, 0xa}}, false},
+		{NewWriteHandler(write, Unsigned), Request{FunctionCode: WriteMultipleCoils, Data: []byte{0xff, 0xff, 0x0, 0x2, 0x1, 0x3}}, false},
+		{NewWriteHandler(write, Unsigned), Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0xff, 0xff, 0x0, 0x1, 0x2, 0x0, 0x1}}, true},
+		{NewWriteHandler(write, Unsigned), Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0xff, 0xff, 0x0, 0x2, 0x4, 0x0, 0x1, 0x0, 0x2}}, false},
+		{NewReadWriteHandler(read, write, Unsigned), Request{FunctionCode: ReadWriteMultipleRegisters, Data: []byte{0xff, 0xff, 0x0, 0x2, 0x0, 0x0, 0x0, 0x1, 0x2, 0x0, 0x1}}, false},
+		{NewReadWriteHandler(read, write, Unsigned), Request{FunctionCode: ReadWriteMultipleRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1, 0xff, 0xff, 0x0, 0x2, 0x4, 0x0, 0x1, 0x0, 0x2}}, false},
+	}
+
+	for _, test := range tests {
+		called = false
+		buf := new(bytes.Buffer)
+		test.h.ServeModbus(buf, test.req)
+
+		assert.Equal(t, test.valid, called)
+		if !test.valid {
+			assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, test.req.FunctionCode + 0x80, 0x2}, buf.Bytes())
+		}
+	}
+}
+
 func TestReduce(t *testing.T) {
 	tests := []struct {
 		input    []Value
 		expected []byte
 	}{
 		{[]Value{Value{0}, Value{1}, Value{1}, Value{1}}, []byte{0xe}},
-		{[]Value{Value{1}, Value{0}, Value{1}, Value{0}, Value{1}, Value{0}, Value{1}, Value{0}, Value{1}}, []byte{0x1, 0x55}},
-		{[]Value{Value{1}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{1}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}}, []byte{0x0, 0x1, 0x1}},
+		{[]Value{Value{1}, Value{0}, Value{1}, Value{0}, Value{1}, Value{0}, Value{1}, Value{0}, Value{1}}, []byte{0x55, 0x1}},
+		{[]Value{Value{1}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{1}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}, Value{0}}, []byte{0x1, 0x1, 0x0}},
+		// The status of coils 20 through 38, taken from the example of
+		// the read coils request in the Modbus specification.
+		{[]Value{
+			Value{1}, Value{0}, Value{1}, Value{1}, Value{0}, Value{0}, Value{1}, Value{1},
+			Value{1}, Value{1}, Value{0}, Value{1}, Value{0}, Value{1}, Value{1}, Value{0},
+			Value{1}, Value{0}, Value{1},
+		}, []byte{0xcd, 0x6b, 0x5}},
+		// Negative values are on too.
+		{[]Value{Value{-1}, Value{0}, Value{-32768}}, []byte{0x5}},
 	}
 
 	for _, test := range tests {
@@ -69,48 +386,79 @@ func TestWriteHandler(t *testing.T) {
 		expected []byte
 	}{
 		{
-			Request{MBAP{}, WriteSingleCoil, []byte{0x0, 0x1, 0x0, 0x0}},
+			Request{MBAP: MBAP{}, FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x1, 0x0, 0x0}},
 			newWriteHandler(t, 0, 1, []Value{Value{0}}, nil, Signed),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x5, 0x0, 0x01, 0x0, 0x0},
 		},
 		{
-			Request{MBAP{}, WriteSingleCoil, []byte{0x0, 0x1, 0xc, 0x1}},
+			Request{MBAP: MBAP{}, FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x1, 0xff, 0x0}},
 			newWriteHandler(t, 0, 1, []Value{Value{1}}, IllegalFunctionError, Signed),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x85, 0x01},
 		},
 		{
-			Request{MBAP{}, WriteSingleRegister, []byte{0x0, 0x1, 0xf3, 0x88}},
+			// Invalid write single coil request, the value is neither
+			// 0x0000 nor 0xFF00.
+			Request{MBAP: MBAP{}, FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x1, 0x0, 0x1}},
+			newWriteHandler(t, 0, 1, []Value{}, nil, Signed),
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x85, 0x3},
+		},
+		{
+			Request{MBAP: MBAP{}, FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x1, 0xf3, 0x88}},
 			newWriteHandler(t, 0, 1, []Value{Value{-3192}}, nil, Signed),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x6, 0x0, 0x01, 0xf3, 0x88},
 		},
 		{
-			Request{MBAP{}, WriteSingleRegister, []byte{0x0, 0x1, 0xf3, 0x88}},
+			Request{MBAP: MBAP{}, FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x1, 0xf3, 0x88}},
 			newWriteHandler(t, 0, 1, []Value{Value{62344}}, nil, Unsigned),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x6, 0x0, 0x01, 0xf3, 0x88},
 		},
 		{
-			Request{MBAP{}, WriteSingleRegister, []byte{0x0, 0x1, 0xc, 0x78}},
+			Request{MBAP: MBAP{}, FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x1, 0xc, 0x78}},
 			newWriteHandler(t, 0, 1, []Value{Value{3192}}, SlaveDeviceBusyError, Signed),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x6},
 		},
 		{
 			// Valid write multiple registers request.
-			Request{MBAP{}, WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x3c, 0x13, 0xf3, 0x88}},
+			Request{MBAP: MBAP{}, FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x3c, 0x13, 0xf3, 0x88}},
 			newWriteHandler(t, 0, 1, []Value{Value{0x3c13}, Value{-3192}}, nil, Signed),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x1, 0x0, 0x2},
 		},
 		{
 			// Valid write multiple registers request.
-			Request{MBAP{}, WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x3c, 0x13, 0xf3, 0x88}},
+			Request{MBAP: MBAP{}, FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x3c, 0x13, 0xf3, 0x88}},
 			newWriteHandler(t, 0, 1, []Value{Value{0x3c13}, Value{62344}}, nil, Unsigned),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x1, 0x0, 0x2},
 		},
 		{
 			// Invalid write multiple registers request, the length doesn't match.
-			Request{MBAP{}, WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x3c, 0x13, 0x01}},
+			Request{MBAP: MBAP{}, FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x3c, 0x13, 0x01}},
 			newWriteHandler(t, 0, 1, []Value{}, nil, Signed),
 			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x90, 0x3},
 		},
+		{
+			// Valid write multiple coils request, writing 10 coils.
+			Request{MBAP: MBAP{}, FunctionCode: WriteMultipleCoils, Data: []byte{0x0, 0x13, 0x0, 0xa, 0x2, 0xcd, 0x1}},
+			newWriteHandler(t, 0, 19, []Value{Value{1}, Value{0}, Value{1}, Value{1}, Value{0}, Value{0}, Value{1}, Value{1}, Value{1}, Value{0}}, nil, Signed),
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0xf, 0x0, 0x13, 0x0, 0xa},
+		},
+		{
+			// Invalid write multiple coils request, the byte count doesn't match the quantity.
+			Request{MBAP: MBAP{}, FunctionCode: WriteMultipleCoils, Data: []byte{0x0, 0x13, 0x0, 0xa, 0x1, 0xcd}},
+			newWriteHandler(t, 0, 19, []Value{}, nil, Signed),
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x8f, 0x3},
+		},
+		{
+			// Invalid write multiple coils request, the quantity is 0.
+			Request{MBAP: MBAP{}, FunctionCode: WriteMultipleCoils, Data: []byte{0x0, 0x13, 0x0, 0x0, 0x0}},
+			newWriteHandler(t, 0, 19, []Value{}, nil, Signed),
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x8f, 0x3},
+		},
+		{
+			// Invalid write multiple coils request, the quantity exceeds 1968.
+			Request{MBAP: MBAP{}, FunctionCode: WriteMultipleCoils, Data: []byte{0x0, 0x13, 0x7, 0xb1, 0xf7}},
+			newWriteHandler(t, 0, 19, []Value{}, nil, Signed),
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x8f, 0x3},
+		},
 	}
 
 	for _, test := range tests {
@@ -119,3 +467,647 @@ func TestWriteHandler(t *testing.T) {
 		assert.Equal(t, test.expected, buf.Bytes())
 	}
 }
+
+func TestTransactionalWriteHandler(t *testing.T) {
+	registers := []Value{{1}, {2}, {3}}
+	writes := 0
+
+	read := func(unitID, start, quantity int) ([]Value, error) {
+		return append([]Value(nil), registers[start:start+quantity]...), nil
+	}
+
+	// write validates and writes the registers one by one.
+	write := func(unitID, start int, values []Value) error {
+		writes++
+		for i, v := range values {
+			if v.Get() > 100 {
+				return IllegalDataValueError
+			}
+			registers[start+i] = v
+		}
+		return nil
+	}
+
+	validate := func(unitID, start int, values []Value) error {
+		if start+len(values) > len(registers) {
+			return IllegalAddressError
+		}
+		return nil
+	}
+
+	h := NewTransactionalWriteHandler(validate, read, write, Unsigned)
+
+	tests := []struct {
+		req       Request
+		expected  []byte
+		registers []Value
+		writes    int
+	}{
+		{
+			Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x0, 0x0, 0x2, 0x4, 0x0, 0xa, 0x0, 0xb}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x0, 0x0, 0x2},
+			[]Value{{10}, {11}, {3}},
+			1,
+		},
+		{
+			// The second register fails after the first one has been
+			// written, so the first one is rolled back.
+			Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x0, 0xc, 0x0, 0xff}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x90, 0x3},
+			[]Value{{10}, {11}, {3}},
+			3,
+		},
+		{
+			// Rejected by validate, without writing.
+			Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x2, 0x0, 0x2, 0x4, 0x0, 0xc, 0x0, 0xd}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x90, 0x2},
+			[]Value{{10}, {11}, {3}},
+			3,
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+		assert.Equal(t, test.registers, registers)
+		assert.Equal(t, test.writes, writes)
+	}
+
+	// A failed roll back is reported as a slave device failure.
+	h = NewTransactionalWriteHandler(nil, read, func(unitID, start int, values []Value) error {
+		return errors.New("device unreachable")
+	}, Unsigned)
+
+	buf := new(bytes.Buffer)
+	h.ServeModbus(buf, Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x0, 0x0, 0x1}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x4}, buf.Bytes())
+}
+
+// TestWriteMultipleGolden verifies the responses to the write multiple coils
+// and write multiple registers requests from the examples in the Modbus
+// specification. The responses echo the starting address and quantity and
+// don't contain a byte count.
+func TestWriteMultipleGolden(t *testing.T) {
+	h := NewWriteHandler(func(unitID, start int, values []Value) error {
+		return nil
+	}, Unsigned)
+
+	tests := []struct {
+		req  []byte
+		resp []byte
+	}{
+		{
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x9, 0x1, 0xf, 0x0, 0x13, 0x0, 0xa, 0x2, 0xcd, 0x1},
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0xf, 0x0, 0x13, 0x0, 0xa},
+		},
+		{
+			[]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0xb, 0x1, 0x10, 0x0, 0x1, 0x0, 0x2, 0x4, 0x0, 0xa, 0x1, 0x2},
+			[]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x6, 0x1, 0x10, 0x0, 0x1, 0x0, 0x2},
+		},
+	}
+
+	for _, test := range tests {
+		var req Request
+		assert.Nil(t, req.UnmarshalBinary(test.req))
+
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, req)
+		assert.Equal(t, test.resp, buf.Bytes())
+	}
+}
+
+func TestCoilWriteHandler(t *testing.T) {
+	var coils []bool
+	h := NewCoilWriteHandler(func(unitID, start int, values []bool) error {
+		if start == 1 {
+			return IllegalAddressError
+		}
+
+		coils = values
+		return nil
+	})
+
+	tests := []struct {
+		req      Request
+		coils    []bool
+		expected []byte
+	}{
+		{
+			Request{FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x0, 0xff, 0x0}},
+			[]bool{true},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x5, 0x0, 0x0, 0xff, 0x0},
+		},
+		{
+			Request{FunctionCode: WriteMultipleCoils, Data: []byte{0x0, 0x13, 0x0, 0xa, 0x2, 0xcd, 0x1}},
+			[]bool{true, false, true, true, false, false, true, true, true, false},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0xf, 0x0, 0x13, 0x0, 0xa},
+		},
+		{
+			Request{FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+			nil,
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x85, 0x3},
+		},
+		{
+			Request{FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x1, 0x0, 0x0}},
+			nil,
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x85, 0x2},
+		},
+		{
+			// Registers can't be written.
+			Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+			nil,
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x1},
+		},
+	}
+
+	for _, test := range tests {
+		coils = nil
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+		assert.Equal(t, test.coils, coils)
+	}
+}
+
+func TestLenientCoilValues(t *testing.T) {
+	h := newWriteHandler(t, 0, 1, []Value{Value{1}}, nil, Signed)
+	h.LenientCoilValues = true
+
+	buf := new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{}, FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x1, 0x0, 0x1}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x5, 0x0, 0x1, 0x0, 0x1}, buf.Bytes())
+}
+
+func TestMaskWriteHandler(t *testing.T) {
+	registers := map[int]uint16{4: 0x12}
+	h := NewMaskWriteHandler(func(unitID, addr int, andMask, orMask uint16) error {
+		v, ok := registers[addr]
+		if !ok {
+			return IllegalAddressError
+		}
+
+		registers[addr] = (v & andMask) | (orMask & ^andMask)
+		return nil
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// Example from the Modbus specification.
+			Request{MBAP: MBAP{}, FunctionCode: MaskWriteRegister, Data: []byte{0x0, 0x4, 0x0, 0xf2, 0x0, 0x25}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x16, 0x0, 0x4, 0x0, 0xf2, 0x0, 0x25},
+		},
+		{
+			// Register doesn't exist.
+			Request{MBAP: MBAP{}, FunctionCode: MaskWriteRegister, Data: []byte{0x0, 0x5, 0x0, 0xf2, 0x0, 0x25}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x96, 0x2},
+		},
+		{
+			// Request is too short.
+			Request{MBAP: MBAP{}, FunctionCode: MaskWriteRegister, Data: []byte{0x0, 0x4, 0x0, 0xf2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x96, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+
+	assert.Equal(t, uint16(0x17), registers[4])
+}
+
+func TestReadWriteHandler(t *testing.T) {
+	registers := make([]Value, 16)
+	h := NewReadWriteHandler(func(unitID, start, quantity int) ([]Value, error) {
+		assert.Equal(t, 1, unitID)
+		return registers[start : start+quantity], nil
+	}, func(unitID, start int, values []Value) error {
+		assert.Equal(t, 1, unitID)
+		copy(registers[start:], values)
+		return nil
+	}, Signed)
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// Write 3 registers starting at address 2, then read 4 registers
+			// starting at address 1. The read contains the written values.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadWriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x4, 0x0, 0x2, 0x0, 0x3, 0x6, 0x0, 0xff, 0x0, 0xff, 0xff, 0x38}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x1, 0x17, 0x8, 0x0, 0x0, 0x0, 0xff, 0x0, 0xff, 0xff, 0x38},
+		},
+		{
+			// Quantity to read is 0.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadWriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x0, 0x1, 0x2, 0x0, 0xff}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x97, 0x3},
+		},
+		{
+			// Quantity to write exceeds 121.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadWriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x2, 0x0, 0x7a, 0xf4}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x97, 0x3},
+		},
+		{
+			// Byte count doesn't match quantity to write.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadWriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x2, 0x0, 0x2, 0x2, 0x0, 0xff}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x97, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func TestExceptionStatusHandler(t *testing.T) {
+	h := NewExceptionStatusHandler(func(unitID int) (uint8, error) {
+		if unitID != 1 {
+			return 0, SlaveDeviceFailureError
+		}
+
+		return 0x6d, nil
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			Request{MBAP: MBAP{TransactionID: 2, UnitID: 1}, FunctionCode: ReadExceptionStatus, Data: []byte{}},
+			[]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x3, 0x1, 0x7, 0x6d},
+		},
+		{
+			Request{MBAP: MBAP{TransactionID: 2, UnitID: 2}, FunctionCode: ReadExceptionStatus, Data: []byte{}},
+			[]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x3, 0x2, 0x87, 0x4},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+
+		// The response can be parsed by clients.
+		var resp Response
+		assert.Nil(t, resp.UnmarshalBinary(buf.Bytes()))
+
+		code, ok := resp.Exception()
+		if test.req.UnitID == 1 {
+			assert.False(t, ok)
+			assert.Equal(t, []byte{0x6d}, resp.Data)
+		} else {
+			assert.True(t, ok)
+			assert.Equal(t, ExceptionSlaveDeviceFailure, code)
+		}
+	}
+}
+
+func TestDiagnosticsHandler(t *testing.T) {
+	h := NewDiagnosticsHandler()
+	h.Handle(0xa, func(unitID int, data []byte) ([]byte, error) {
+		assert.Equal(t, []byte{0x0, 0x0}, data)
+		return data, nil
+	})
+	h.Handle(0xb, func(unitID int, data []byte) ([]byte, error) {
+		return []byte{0x0, 0x3}, nil
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// Return query data.
+			Request{MBAP: MBAP{}, FunctionCode: Diagnostics, Data: []byte{0x0, 0x0, 0xa5, 0x37}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x8, 0x0, 0x0, 0xa5, 0x37},
+		},
+		{
+			// Clear counters and diagnostic register.
+			Request{MBAP: MBAP{}, FunctionCode: Diagnostics, Data: []byte{0x0, 0xa, 0x0, 0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x8, 0x0, 0xa, 0x0, 0x0},
+		},
+		{
+			// Return bus message count.
+			Request{MBAP: MBAP{}, FunctionCode: Diagnostics, Data: []byte{0x0, 0xb, 0x0, 0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x8, 0x0, 0xb, 0x0, 0x3},
+		},
+		{
+			// Unknown sub-function.
+			Request{MBAP: MBAP{}, FunctionCode: Diagnostics, Data: []byte{0x0, 0xc, 0x0, 0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x88, 0x1},
+		},
+		{
+			// Request is too short.
+			Request{MBAP: MBAP{}, FunctionCode: Diagnostics, Data: []byte{0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x88, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func TestCommEventLogHandler(t *testing.T) {
+	events := make([]byte, 70)
+	for i := range events {
+		events[i] = byte(i)
+	}
+
+	h := NewCommEventLogHandler(func(unitID int) (CommEventLog, error) {
+		switch unitID {
+		case 1:
+			return CommEventLog{EventCount: 0x108, MessageCount: 0x121, Events: []byte{0x20, 0x0}}, nil
+		case 2:
+			return CommEventLog{Status: 0xffff, EventCount: 70, MessageCount: 70, Events: events}, nil
+		}
+
+		return CommEventLog{}, SlaveDeviceFailureError
+	})
+
+	// Example from the Modbus specification.
+	buf := new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{UnitID: 1}, FunctionCode: GetCommEventLog, Data: []byte{}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x1, 0xc, 0x8, 0x0, 0x0, 0x1, 0x8, 0x1, 0x21, 0x20, 0x0}, buf.Bytes())
+
+	// Only the 64 most recent events are sent.
+	buf = new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{UnitID: 2}, FunctionCode: GetCommEventLog, Data: []byte{}})
+	expected := append([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x49, 0x2, 0xc, 0x46, 0xff, 0xff, 0x0, 0x46, 0x0, 0x46}, events[:64]...)
+	assert.Equal(t, expected, buf.Bytes())
+
+	buf = new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{UnitID: 3}, FunctionCode: GetCommEventLog, Data: []byte{}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x3, 0x8c, 0x4}, buf.Bytes())
+}
+
+func TestServerIDHandler(t *testing.T) {
+	h := NewServerIDHandler(func(unitID int) ([]byte, bool, []byte, error) {
+		switch unitID {
+		case 1:
+			return []byte("gf"), true, []byte{0x1, 0x2}, nil
+		case 2:
+			return []byte{0x42}, false, nil, nil
+		}
+
+		return nil, false, nil, SlaveDeviceFailureError
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReportServerID, Data: []byte{}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x8, 0x1, 0x11, 0x5, 0x67, 0x66, 0xff, 0x1, 0x2},
+		},
+		{
+			Request{MBAP: MBAP{UnitID: 2}, FunctionCode: ReportServerID, Data: []byte{}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x2, 0x11, 0x2, 0x42, 0x0},
+		},
+		{
+			Request{MBAP: MBAP{UnitID: 3}, FunctionCode: ReportServerID, Data: []byte{}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x3, 0x91, 0x4},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func TestReadFileHandler(t *testing.T) {
+	files := map[int][]Value{
+		3: []Value{Value{0x0}, Value{0x0}, Value{0x0}, Value{0x0}, Value{0x6af}, Value{0x4be}, Value{0x100d}},
+		4: []Value{Value{0x0}, Value{0xdfe}, Value{0x20}},
+	}
+
+	h := NewReadFileHandler(func(unitID, file, record, length int) ([]Value, error) {
+		values, ok := files[file]
+		if !ok || record+length > len(values) {
+			return nil, IllegalAddressError
+		}
+
+		if file == 3 && record == 0 {
+			// Return too few values, failing the consistency check.
+			return values[:1], nil
+		}
+
+		return values[record : record+length], nil
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// Read 2 sub-requests in a single request.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0xe, 0x6, 0x0, 0x4, 0x0, 0x1, 0x0, 0x2, 0x6, 0x0, 0x3, 0x0, 0x4, 0x0, 0x3}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x11, 0x0, 0x14, 0xe, 0x5, 0x6, 0xd, 0xfe, 0x0, 0x20, 0x7, 0x6, 0x6, 0xaf, 0x4, 0xbe, 0x10, 0xd},
+		},
+		{
+			// Unknown file.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0x7, 0x6, 0x0, 0x5, 0x0, 0x1, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x2},
+		},
+		{
+			// Invalid reference type.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0x7, 0x5, 0x0, 0x4, 0x0, 0x1, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x3},
+		},
+		{
+			// Sub-request is incomplete.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0x8, 0x6, 0x0, 0x4, 0x0, 0x1, 0x0, 0x2, 0x6}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x3},
+		},
+		{
+			// Handler returns too few values.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0x7, 0x6, 0x0, 0x3, 0x0, 0x0, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x4},
+		},
+		{
+			// Record length of 0.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0x7, 0x6, 0x0, 0x4, 0x0, 0x1, 0x0, 0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x3},
+		},
+		{
+			// Record number above 0x270f.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0x7, 0x6, 0x0, 0x4, 0x27, 0x10, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x2},
+		},
+		{
+			// The response would exceed 0xf5 bytes.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0x7, 0x6, 0x0, 0x4, 0x0, 0x0, 0xff, 0xff}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x3},
+		},
+		{
+			// The sub-responses together would exceed 0xf5 bytes.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFileRecord, Data: []byte{0xe, 0x6, 0x0, 0x4, 0x0, 0x0, 0x0, 0x3d, 0x6, 0x0, 0x4, 0x0, 0x0, 0x0, 0x3d}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x94, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func TestWriteFileHandler(t *testing.T) {
+	var calls []fileRecord
+	h := NewWriteFileHandler(func(unitID, file, record int, values []Value) error {
+		if file == 5 {
+			return IllegalAddressError
+		}
+
+		calls = append(calls, fileRecord{file, record, values})
+		return nil
+	}, Unsigned)
+
+	// Write 2 sub-requests in a single request.
+	data := []byte{0x16, 0x6, 0x0, 0x4, 0x0, 0x7, 0x0, 0x3, 0x6, 0xaf, 0x4, 0xbe, 0x10, 0xd, 0x6, 0x0, 0x3, 0x0, 0x9, 0x0, 0x1, 0xff, 0xfe}
+	buf := new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{}, FunctionCode: WriteFileRecord, Data: data})
+
+	assert.Equal(t, append([]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x19, 0x0, 0x15}, data...), buf.Bytes())
+	assert.Equal(t, []fileRecord{
+		{4, 7, []Value{Value{0x6af}, Value{0x4be}, Value{0x100d}}},
+		{3, 9, []Value{Value{0xfffe}}},
+	}, calls)
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// Unknown file.
+			Request{MBAP: MBAP{}, FunctionCode: WriteFileRecord, Data: []byte{0x9, 0x6, 0x0, 0x5, 0x0, 0x1, 0x0, 0x1, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x95, 0x2},
+		},
+		{
+			// Invalid reference type.
+			Request{MBAP: MBAP{}, FunctionCode: WriteFileRecord, Data: []byte{0x9, 0x7, 0x0, 0x4, 0x0, 0x1, 0x0, 0x1, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x95, 0x3},
+		},
+		{
+			// The first sub-request is valid, but the second is incomplete.
+			Request{MBAP: MBAP{}, FunctionCode: WriteFileRecord, Data: []byte{0x10, 0x6, 0x0, 0x4, 0x0, 0x1, 0x0, 0x1, 0x0, 0x1, 0x6, 0x0, 0x4, 0x0, 0x2, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x95, 0x3},
+		},
+		{
+			// Byte count doesn't match the length of the request.
+			Request{MBAP: MBAP{}, FunctionCode: WriteFileRecord, Data: []byte{0xa, 0x6, 0x0, 0x4, 0x0, 0x1, 0x0, 0x1, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x95, 0x3},
+		},
+		{
+			// Record number exceeds 0x270f.
+			Request{MBAP: MBAP{}, FunctionCode: WriteFileRecord, Data: []byte{0x9, 0x6, 0x0, 0x4, 0x27, 0x10, 0x0, 0x1, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x95, 0x2},
+		},
+		{
+			// The first sub-request has a record length of 0.
+			Request{MBAP: MBAP{}, FunctionCode: WriteFileRecord, Data: []byte{0x10, 0x6, 0x0, 0x4, 0x0, 0x1, 0x0, 0x0, 0x6, 0x0, 0x4, 0x0, 0x2, 0x0, 0x1, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x95, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		calls = nil
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+		assert.Nil(t, calls)
+	}
+}
+
+func TestFIFOHandler(t *testing.T) {
+	h := NewFIFOHandler(func(unitID, addr int) ([]Value, error) {
+		switch addr {
+		case 0x4de:
+			return []Value{Value{0x1b8}, Value{0x1284}}, nil
+		case 0x4df:
+			return make([]Value, 32), nil
+		}
+
+		return nil, IllegalAddressError
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// Example from the Modbus specification.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFIFOQueue, Data: []byte{0x4, 0xde}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xa, 0x0, 0x18, 0x0, 0x6, 0x0, 0x2, 0x1, 0xb8, 0x12, 0x84},
+		},
+		{
+			// Queue contains more than 31 values.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFIFOQueue, Data: []byte{0x4, 0xdf}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x98, 0x3},
+		},
+		{
+			Request{MBAP: MBAP{}, FunctionCode: ReadFIFOQueue, Data: []byte{0x4, 0xe0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x98, 0x2},
+		},
+		{
+			// Request is too short.
+			Request{MBAP: MBAP{}, FunctionCode: ReadFIFOQueue, Data: []byte{0x4}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x98, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func TestPDUHandler(t *testing.T) {
+	h := NewPDUHandler(func(unitID int, data []byte) ([]byte, error) {
+		if len(data) == 0 {
+			return nil, IllegalDataValueError
+		}
+
+		return []byte{0x1, 0x2, 0x3}, nil
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			Request{MBAP: MBAP{}, FunctionCode: 65, Data: []byte{0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x41, 0x1, 0x2, 0x3},
+		},
+		{
+			// Function code 3 normally has a byte count, but not when
+			// using a PDUHandler.
+			Request{MBAP: MBAP{}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3, 0x1, 0x2, 0x3},
+		},
+		{
+			Request{MBAP: MBAP{}, FunctionCode: 65, Data: []byte{}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0xc1, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
@@ -0,0 +1,250 @@
+package modbus
+
+import (
+	"io"
+	"sort"
+)
+
+// ReadDeviceIdentification is the MEI type used with function code 43 to
+// read the identification of a device.
+const ReadDeviceIdentification uint8 = 14
+
+// Read device ID codes define the access type of a read device identification
+// request.
+const (
+	// ReadBasicDeviceID requests a stream of the basic device
+	// identification objects.
+	ReadBasicDeviceID uint8 = iota + 1
+
+	// ReadRegularDeviceID requests a stream of the basic and regular
+	// device identification objects.
+	ReadRegularDeviceID
+
+	// ReadExtendedDeviceID requests a stream of the basic, regular and
+	// extended device identification objects.
+	ReadExtendedDeviceID
+
+	// ReadSpecificDeviceID requests a single device identification object.
+	ReadSpecificDeviceID
+)
+
+// Object IDs of the basic and regular device identification objects.
+const (
+	// VendorNameObjectID is the object ID of the vendor name.
+	VendorNameObjectID uint8 = iota
+
+	// ProductCodeObjectID is the object ID of the product code.
+	ProductCodeObjectID
+
+	// MajorMinorRevisionObjectID is the object ID of the major minor
+	// revision.
+	MajorMinorRevisionObjectID
+
+	// VendorURLObjectID is the object ID of the vendor URL.
+	VendorURLObjectID
+
+	// ProductNameObjectID is the object ID of the product name.
+	ProductNameObjectID
+
+	// ModelNameObjectID is the object ID of the model name.
+	ModelNameObjectID
+
+	// UserApplicationNameObjectID is the object ID of the user application
+	// name.
+	UserApplicationNameObjectID
+)
+
+// Conformity levels indicate which device identification objects are
+// available. All levels support stream and individual access.
+const (
+	basicConformityLevel    uint8 = 0x81
+	regularConformityLevel  uint8 = 0x82
+	extendedConformityLevel uint8 = 0x83
+)
+
+// maxObjectsLength is the number of bytes available for objects in a single
+// response. A PDU is at most 253 bytes, of which 7 bytes are taken by the
+// function code and the header of the response.
+const maxObjectsLength = 253 - 7
+
+// DeviceIdentification contains the identification objects of a device.
+type DeviceIdentification struct {
+	// The basic objects are mandatory.
+	VendorName         string
+	ProductCode        string
+	MajorMinorRevision string
+
+	// The regular objects are optional, empty objects are omitted.
+	VendorURL           string
+	ProductName         string
+	ModelName           string
+	UserApplicationName string
+
+	// Objects contains the extended objects, which are user-defined
+	// objects with an ID ranging from 0x80 through 0xFF. Objects with an
+	// ID outside this range are ignored.
+	Objects map[uint8][]byte
+}
+
+// objects returns all available device identification objects by their
+// object ID.
+func (d DeviceIdentification) objects() map[uint8][]byte {
+	objects := map[uint8][]byte{
+		VendorNameObjectID:         []byte(d.VendorName),
+		ProductCodeObjectID:        []byte(d.ProductCode),
+		MajorMinorRevisionObjectID: []byte(d.MajorMinorRevision),
+	}
+
+	regular := map[uint8]string{
+		VendorURLObjectID:           d.VendorURL,
+		ProductNameObjectID:         d.ProductName,
+		ModelNameObjectID:           d.ModelName,
+		UserApplicationNameObjectID: d.UserApplicationName,
+	}
+
+	for id, v := range regular {
+		if v != "" {
+			objects[id] = []byte(v)
+		}
+	}
+
+	for id, v := range d.Objects {
+		if id >= 0x80 {
+			objects[id] = v
+		}
+	}
+
+	return objects
+}
+
+// conformityLevel returns the conformity level based on the available
+// objects.
+func (d DeviceIdentification) conformityLevel() uint8 {
+	level := basicConformityLevel
+	for id := range d.objects() {
+		if id >= 0x80 {
+			return extendedConformityLevel
+		}
+
+		if id > MajorMinorRevisionObjectID {
+			level = regularConformityLevel
+		}
+	}
+
+	return level
+}
+
+// DeviceIdentificationHandler can be used to respond on Modbus request with
+// function code 43 and MEI type 14.
+type DeviceIdentificationHandler struct {
+	id DeviceIdentification
+}
+
+// NewDeviceIdentificationHandler creates a new DeviceIdentificationHandler.
+func NewDeviceIdentificationHandler(id DeviceIdentification) *DeviceIdentificationHandler {
+	return &DeviceIdentificationHandler{
+		id: id,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h DeviceIdentificationHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h DeviceIdentificationHandler) ServeModbusE(w io.Writer, req Request) error {
+	// The byte slice request.Data follows this format:
+	//
+	// ================= ===============
+	// Field             Length (bytes)
+	// ================= ===============
+	// MEI Type          1
+	// Read Device ID    1
+	// Object ID         1
+	// ================= ===============
+	if len(req.Data) != 3 || req.Data[0] != ReadDeviceIdentification {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	code := req.Data[1]
+	start := req.Data[2]
+
+	// last is the highest object ID which can be returned.
+	var last uint8
+	switch code {
+	case ReadBasicDeviceID:
+		last = MajorMinorRevisionObjectID
+	case ReadRegularDeviceID:
+		last = 0x7f
+	case ReadExtendedDeviceID, ReadSpecificDeviceID:
+		last = 0xff
+	default:
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	objects := h.id.objects()
+	if _, ok := objects[start]; !ok || start > last {
+		return respond(w, NewErrorResponse(req, IllegalAddressError))
+	}
+
+	ids := []uint8{start}
+	if code != ReadSpecificDeviceID {
+		ids = ids[:0]
+		for id := range objects {
+			if id >= start && id <= last {
+				ids = append(ids, id)
+			}
+		}
+
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	}
+
+	// The response data follows this format:
+	//
+	// ================= ===============
+	// Field             Length (bytes)
+	// ================= ===============
+	// MEI Type          1
+	// Read Device ID    1
+	// Conformity Level  1
+	// More Follows      1
+	// Next Object ID    1
+	// Number of Objects 1
+	// Objects           n
+	// ================= ===============
+	//
+	// Every object consists of its ID, its length and its value. Objects
+	// which don't fit in the response are left for a next request, the
+	// client continues reading at Next Object ID.
+	data := []byte{
+		ReadDeviceIdentification,
+		code,
+		h.id.conformityLevel(),
+		0x00,
+		0x00,
+		0x00,
+	}
+
+	length := 0
+	for i, id := range ids {
+		v := objects[id]
+		if length+2+len(v) > maxObjectsLength {
+			if i == 0 {
+				return respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+			}
+
+			data[3] = 0xff
+			data[4] = id
+			break
+		}
+
+		data = append(data, id, uint8(len(v)))
+		data = append(data, v...)
+		data[5]++
+		length += 2 + len(v)
+	}
+
+	return respond(w, NewResponse(req, data))
+}
@@ -0,0 +1,130 @@
+package modbus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeviceIdentificationHandler(t *testing.T) {
+	h := NewDeviceIdentificationHandler(DeviceIdentification{
+		VendorName:         "ACS",
+		ProductCode:        "GF",
+		MajorMinorRevision: "V1.0",
+	})
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// Read all basic objects.
+			Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x1, 0x0}},
+			[]byte{
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x17, 0x0, 0x2b, 0xe, 0x1, 0x81, 0x0, 0x0, 0x3,
+				0x0, 0x3, 0x41, 0x43, 0x53,
+				0x1, 0x2, 0x47, 0x46,
+				0x2, 0x4, 0x56, 0x31, 0x2e, 0x30,
+			},
+		},
+		{
+			// Read basic objects starting at the product code.
+			Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x1, 0x1}},
+			[]byte{
+				0x0, 0x0, 0x0, 0x0, 0x0, 0x12, 0x0, 0x2b, 0xe, 0x1, 0x81, 0x0, 0x0, 0x2,
+				0x1, 0x2, 0x47, 0x46,
+				0x2, 0x4, 0x56, 0x31, 0x2e, 0x30,
+			},
+		},
+		{
+			// Object doesn't exist.
+			Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x1, 0x3}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0xab, 0x2},
+		},
+		{
+			// Read a regular object, which isn't available.
+			Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x4, 0x4}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0xab, 0x2},
+		},
+		{
+			// Read device ID code isn't supported.
+			Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x5, 0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0xab, 0x3},
+		},
+		{
+			// Request is too short.
+			Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0xab, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func TestExtendedDeviceIdentification(t *testing.T) {
+	h := NewDeviceIdentificationHandler(DeviceIdentification{
+		VendorName:         "ACS",
+		ProductCode:        "GF",
+		MajorMinorRevision: "V1.0",
+		ProductName:        "Goldfish",
+		Objects: map[uint8][]byte{
+			0x80: bytes.Repeat([]byte{0x1}, 100),
+			0x81: bytes.Repeat([]byte{0x2}, 100),
+			0x82: bytes.Repeat([]byte{0x3}, 100),
+			0x10: []byte{0x4},
+		},
+	})
+
+	// Read the regular objects.
+	buf := new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x2, 0x0}})
+	assert.Equal(t, []byte{
+		0x0, 0x0, 0x0, 0x0, 0x0, 0x21, 0x0, 0x2b, 0xe, 0x2, 0x83, 0x0, 0x0, 0x4,
+		0x0, 0x3, 0x41, 0x43, 0x53,
+		0x1, 0x2, 0x47, 0x46,
+		0x2, 0x4, 0x56, 0x31, 0x2e, 0x30,
+		0x4, 0x8, 0x47, 0x6f, 0x6c, 0x64, 0x66, 0x69, 0x73, 0x68,
+	}, buf.Bytes())
+
+	// Read the extended objects, which don't fit in a single response.
+	// The first response contains the objects up to 0x81 and points to
+	// 0x82 as the next object.
+	expected := []byte{
+		0x0, 0x0, 0x0, 0x0, 0x0, 0xed, 0x0, 0x2b, 0xe, 0x3, 0x83, 0xff, 0x82, 0x6,
+		0x0, 0x3, 0x41, 0x43, 0x53,
+		0x1, 0x2, 0x47, 0x46,
+		0x2, 0x4, 0x56, 0x31, 0x2e, 0x30,
+		0x4, 0x8, 0x47, 0x6f, 0x6c, 0x64, 0x66, 0x69, 0x73, 0x68,
+		0x80, 0x64,
+	}
+	expected = append(expected, bytes.Repeat([]byte{0x1}, 100)...)
+	expected = append(expected, 0x81, 0x64)
+	expected = append(expected, bytes.Repeat([]byte{0x2}, 100)...)
+
+	buf = new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x3, 0x0}})
+	assert.Equal(t, expected, buf.Bytes())
+
+	// The second response contains the remaining object.
+	expected = []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6e, 0x0, 0x2b, 0xe, 0x3, 0x83, 0x0, 0x0, 0x1, 0x82, 0x64}
+	expected = append(expected, bytes.Repeat([]byte{0x3}, 100)...)
+
+	buf = new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x3, 0x82}})
+	assert.Equal(t, expected, buf.Bytes())
+
+	// Read a single object using individual access.
+	buf = new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x4, 0x1}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xc, 0x0, 0x2b, 0xe, 0x4, 0x83, 0x0, 0x0, 0x1, 0x1, 0x2, 0x47, 0x46}, buf.Bytes())
+
+	// Objects with an ID below 0x80 can't be user-defined.
+	buf = new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x4, 0x10}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0xab, 0x2}, buf.Bytes())
+}
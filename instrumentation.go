@@ -0,0 +1,51 @@
+package modbus
+
+import (
+	"net"
+	"time"
+)
+
+// Instrumentation receives events of a Server, which can be used to collect
+// metrics. Its methods are called concurrently and must not block.
+type Instrumentation interface {
+	// ConnectionOpened is called when a connection has been accepted.
+	ConnectionOpened(addr net.Addr)
+
+	// ConnectionClosed is called when a connection has been closed.
+	ConnectionClosed(addr net.Addr)
+
+	// RequestStarted is called before a request is executed.
+	RequestStarted(functionCode, unitID uint8)
+
+	// RequestCompleted is called after a request has been answered. The
+	// exception is the exception code of the response, or 0 when the
+	// request succeeded.
+	RequestCompleted(functionCode uint8, dur time.Duration, exception uint8)
+}
+
+// instrumentedExecute executes req like executeAndRespond does, and reports
+// the request to the statistics and the instrumentation of the server.
+func (s *Server) instrumentedExecute(w *errWriter, req *Request) error {
+	if s.Instrumentation == nil {
+		err := s.executeAndRespond(w, req)
+		s.stats.request(req.FunctionCode, w.exception)
+		return err
+	}
+
+	s.Instrumentation.RequestStarted(req.FunctionCode, req.UnitID)
+	start := time.Now()
+
+	err := s.executeAndRespond(w, req)
+	s.stats.request(req.FunctionCode, w.exception)
+	s.Instrumentation.RequestCompleted(req.FunctionCode, time.Since(start), w.exception)
+
+	return err
+}
+
+// Instrument sets the instrumentation of the server. It returns an error when
+// the server already started.
+func (s *Server) Instrument(i Instrumentation) error {
+	return s.configure(func() {
+		s.Instrumentation = i
+	})
+}
@@ -0,0 +1,95 @@
+package modbus
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// recordingInstrumentation is an Instrumentation which records all events.
+type recordingInstrumentation struct {
+	mu     sync.Mutex
+	events []string
+	closed chan struct{}
+}
+
+func (r *recordingInstrumentation) record(e string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, e)
+}
+
+func (r *recordingInstrumentation) ConnectionOpened(addr net.Addr) {
+	r.record("opened " + addr.String())
+}
+
+func (r *recordingInstrumentation) ConnectionClosed(addr net.Addr) {
+	r.record("closed " + addr.String())
+	close(r.closed)
+}
+
+func (r *recordingInstrumentation) RequestStarted(functionCode, unitID uint8) {
+	r.record("started")
+}
+
+func (r *recordingInstrumentation) RequestCompleted(functionCode uint8, dur time.Duration, exception uint8) {
+	r.record(map[uint8]string{0: "completed", 2: "completed with IllegalAddress", 1: "completed with IllegalFunction"}[exception])
+}
+
+func TestInstrumentation(t *testing.T) {
+	inst := &recordingInstrumentation{closed: make(chan struct{})}
+
+	var s Server
+	s.Instrumentation = inst
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		if start > 0 {
+			return nil, IllegalAddressError
+		}
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn := l.dial()
+	requests := []struct {
+		req    []byte
+		length int
+	}{
+		{[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}, 11},
+		{[]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x1, 0x0, 0x1}, 9},
+		{[]byte{0x0, 0x3, 0x0, 0x0, 0x0, 0x6, 0x1, 0x4, 0x0, 0x0, 0x0, 0x1}, 9},
+	}
+
+	for _, r := range requests {
+		_, err := conn.Write(r.req)
+		assert.Nil(t, err)
+		_, err = io.ReadFull(conn, make([]byte, r.length))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, conn.Close())
+
+	select {
+	case <-inst.closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection hasn't been reported as closed")
+	}
+
+	inst.mu.Lock()
+	defer inst.mu.Unlock()
+	assert.Equal(t, []string{
+		"opened pipe",
+		"started",
+		"completed",
+		"started",
+		"completed with IllegalAddress",
+		"started",
+		"completed with IllegalFunction",
+		"closed pipe",
+	}, inst.events)
+}
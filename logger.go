@@ -0,0 +1,93 @@
+package modbus
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+)
+
+// Field is a key-value pair which adds context to a log message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger is a leveled logger with structured fields. Implement it to route
+// the logs of a Server to a logging library of choice.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+// NewStdLogger creates a Logger writing to l. The fields are appended to the
+// message as key=value pairs. Debug messages are discarded. When l is nil the
+// standard logger of package log is used.
+func NewStdLogger(l *log.Logger) Logger {
+	return stdLogger{l: l}
+}
+
+type stdLogger struct {
+	l *log.Logger
+}
+
+func (s stdLogger) Debug(msg string, fields ...Field) {}
+
+func (s stdLogger) Info(msg string, fields ...Field) {
+	s.print(msg, fields)
+}
+
+func (s stdLogger) Error(msg string, fields ...Field) {
+	s.print(msg, fields)
+}
+
+func (s stdLogger) print(msg string, fields []Field) {
+	var b strings.Builder
+	b.WriteString("goldfish: ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		fmt.Fprintf(&b, " %s=%v", f.Key, f.Value)
+	}
+
+	if s.l != nil {
+		s.l.Print(b.String())
+	} else {
+		log.Print(b.String())
+	}
+}
+
+// errField returns a field containing err.
+func errField(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+// remoteAddrField returns a field containing the address of a client.
+func remoteAddrField(addr net.Addr) Field {
+	return Field{Key: "remote_addr", Value: addr}
+}
+
+// requestFields returns fields identifying req.
+func requestFields(req Request) []Field {
+	return messageFields(req.MBAP, req.FunctionCode)
+}
+
+// messageFields returns fields identifying a request or response.
+func messageFields(m MBAP, functionCode uint8) []Field {
+	return []Field{
+		{Key: "transaction_id", Value: m.TransactionID},
+		{Key: "unit_id", Value: m.UnitID},
+		{Key: "function_code", Value: functionCode},
+	}
+}
+
+// writerLogger returns the logger of w when w is a writer created by the
+// server, otherwise it returns a logger using the standard logger.
+func writerLogger(w io.Writer) Logger {
+	if lw, ok := w.(interface{ logger() Logger }); ok {
+		return lw.logger()
+	}
+
+	return NewStdLogger(nil)
+}
@@ -0,0 +1,71 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"log"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStdLogger(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := NewStdLogger(log.New(buf, "", 0))
+
+	l.Debug("discarded")
+	l.Info("rejected connection", Field{Key: "remote_addr", Value: "pipe"})
+	l.Error("failed", requestFields(Request{MBAP: MBAP{TransactionID: 1, UnitID: 2}, FunctionCode: 3})...)
+
+	assert.Equal(t, "goldfish: rejected connection remote_addr=pipe\ngoldfish: failed transaction_id=1 unit_id=2 function_code=3\n", buf.String())
+}
+
+// recordingLogger is a Logger which records the messages per level.
+type recordingLogger struct {
+	mu       sync.Mutex
+	messages map[string][]string
+}
+
+func (r *recordingLogger) record(level, msg string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.messages == nil {
+		r.messages = make(map[string][]string)
+	}
+	r.messages[level] = append(r.messages[level], msg)
+}
+
+// recorded returns the messages recorded at level.
+func (r *recordingLogger) recorded(level string) []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.messages[level]
+}
+
+func (r *recordingLogger) Debug(msg string, fields ...Field) { r.record("debug", msg) }
+func (r *recordingLogger) Info(msg string, fields ...Field)  { r.record("info", msg) }
+func (r *recordingLogger) Error(msg string, fields ...Field) { r.record("error", msg) }
+
+func TestServerLogger(t *testing.T) {
+	errLog := new(bytes.Buffer)
+	l := new(recordingLogger)
+
+	// The Logger takes precedence over ErrorLog.
+	s := Server{
+		Logger:   l,
+		ErrorLog: log.New(errLog, "", 0),
+	}
+
+	w := &errWriter{w: ErrorWriter{}, l: s.logger()}
+	respond(w, NewResponse(Request{FunctionCode: ReadCoils}, nil))
+	s.logger().Error("failed", errField(errors.New("boom")))
+
+	assert.Equal(t, map[string][]string{
+		"debug": {"failed to write response"},
+		"error": {"failed"},
+	}, l.messages)
+	assert.Equal(t, "", errLog.String())
+}
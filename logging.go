@@ -0,0 +1,143 @@
+package modbus
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"time"
+)
+
+// pduSnippetLength is the maximum number of bytes of a PDU logged when the
+// address and quantity of a request can't be determined.
+const pduSnippetLength = 16
+
+// LoggingOption configures the middleware returned by LoggingMiddleware.
+type LoggingOption func(*loggingMiddleware)
+
+// WithFrameDump includes the full request and response frames in hex in
+// every log line.
+func WithFrameDump() LoggingOption {
+	return func(m *loggingMiddleware) {
+		m.dump = true
+	}
+}
+
+// LoggingMiddleware returns middleware logging a line for every request
+// through the logger of the server. The line contains the remote address, the
+// unit ID, the function code, the address and quantity, the outcome and the
+// duration of the request.
+func (s *Server) LoggingMiddleware(opts ...LoggingOption) Middleware {
+	m := &loggingMiddleware{s: s}
+	for _, opt := range opts {
+		opt(m)
+	}
+
+	return func(h Handler) Handler {
+		return loggingHandler{m: m, handler: h}
+	}
+}
+
+type loggingMiddleware struct {
+	s    *Server
+	dump bool
+}
+
+type loggingHandler struct {
+	m       *loggingMiddleware
+	handler Handler
+}
+
+// ServeModbus lets the wrapped handler handle the request and logs it.
+func (h loggingHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h loggingHandler) ServeModbusE(w io.Writer, req Request) error {
+	rw := &recordingWriter{w: w, record: h.m.dump}
+
+	start := time.Now()
+	err := serveModbusE(h.handler, rw, req)
+	dur := time.Since(start)
+
+	fields := append([]Field{remoteAddrField(req.remoteAddr)}, requestFields(req)...)
+	if address, quantity, ok := addressAndQuantity(req); ok {
+		fields = append(fields, Field{Key: "address", Value: address})
+		if quantity >= 0 {
+			fields = append(fields, Field{Key: "quantity", Value: quantity})
+		}
+	} else {
+		pdu := append([]byte{req.FunctionCode}, req.Data...)
+		if len(pdu) > pduSnippetLength {
+			pdu = pdu[:pduSnippetLength]
+		}
+		fields = append(fields, Field{Key: "pdu", Value: hex.EncodeToString(pdu)})
+	}
+
+	outcome := "ok"
+	if rw.exception != 0 {
+		outcome = fmt.Sprintf("exception %d", rw.exception)
+	}
+	fields = append(fields, Field{Key: "outcome", Value: outcome}, Field{Key: "duration", Value: dur})
+
+	if h.m.dump {
+		fields = append(fields,
+			Field{Key: "request", Value: hex.EncodeToString(requestFrame(req))},
+			Field{Key: "response", Value: hex.EncodeToString(rw.buf)},
+		)
+	}
+
+	h.m.s.logger().Info("handled request", fields...)
+
+	return err
+}
+
+// addressAndQuantity returns the address and quantity of a request. The
+// quantity is -1 for requests which only have an address. It returns false
+// when the function code doesn't have an address.
+func addressAndQuantity(req Request) (int, int, bool) {
+	switch req.FunctionCode {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters,
+		WriteMultipleCoils, WriteMultipleRegisters, ReadWriteMultipleRegisters:
+		if len(req.Data) >= 4 {
+			return int(binary.BigEndian.Uint16(req.Data[0:2])), int(binary.BigEndian.Uint16(req.Data[2:4])), true
+		}
+	case WriteSingleCoil, WriteSingleRegister, MaskWriteRegister, ReadFIFOQueue:
+		if len(req.Data) >= 2 {
+			return int(binary.BigEndian.Uint16(req.Data[0:2])), -1, true
+		}
+	}
+
+	return 0, 0, false
+}
+
+// requestFrame returns the binary form of req including its MBAP header.
+func requestFrame(req Request) []byte {
+	// MarshalBinary of MBAP never fails, it only writes to a buffer.
+	header, _ := req.MBAP.MarshalBinary()
+
+	return append(append(header, req.FunctionCode), req.Data...)
+}
+
+// recordingWriter remembers the exception code of the response written to w
+// and, if record is true, the response itself.
+type recordingWriter struct {
+	w         io.Writer
+	record    bool
+	buf       []byte
+	exception uint8
+}
+
+func (r *recordingWriter) Write(b []byte) (int, error) {
+	if code, ok := ExceptionCode(b); ok {
+		r.exception = code
+	}
+
+	if r.record {
+		r.buf = append(r.buf, b...)
+	}
+
+	return r.w.Write(b)
+}
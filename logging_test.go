@@ -0,0 +1,68 @@
+package modbus
+
+import (
+	"bytes"
+	"log"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoggingMiddleware(t *testing.T) {
+	logs := new(bytes.Buffer)
+
+	var s Server
+	s.ErrorLog = log.New(logs, "", 0)
+	s.Use(s.LoggingMiddleware())
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+	s.Handle(WriteSingleRegister, NewWriteHandler(func(unitID, start int, values []Value) error {
+		return IllegalAddressError
+	}, Unsigned))
+	s.Handle(ReportServerID, NewServerIDHandler(func(unitID int) ([]byte, bool, []byte, error) {
+		return []byte{0x1}, true, nil, nil
+	}))
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 1234}
+	requests := []Request{
+		{MBAP: MBAP{TransactionID: 1, UnitID: 1}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x2, 0x0, 0x1}, remoteAddr: addr},
+		{MBAP: MBAP{TransactionID: 2, UnitID: 1}, FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x3, 0x0, 0x1}, remoteAddr: addr},
+		{MBAP: MBAP{TransactionID: 3, UnitID: 1}, FunctionCode: ReportServerID, remoteAddr: addr},
+	}
+
+	for _, req := range requests {
+		assert.Nil(t, s.executeAndRespond(new(bytes.Buffer), &req))
+	}
+
+	lines := strings.Split(strings.TrimSpace(logs.String()), "\n")
+	assert.Len(t, lines, 3)
+
+	expected := []string{
+		"goldfish: handled request remote_addr=10.0.0.1:1234 transaction_id=1 unit_id=1 function_code=3 address=2 quantity=1 outcome=ok duration=",
+		"goldfish: handled request remote_addr=10.0.0.1:1234 transaction_id=2 unit_id=1 function_code=6 address=3 outcome=exception 2 duration=",
+		"goldfish: handled request remote_addr=10.0.0.1:1234 transaction_id=3 unit_id=1 function_code=17 pdu=11 outcome=ok duration=",
+	}
+
+	for i, line := range lines {
+		assert.True(t, strings.HasPrefix(line, expected[i]), line)
+	}
+}
+
+func TestLoggingMiddlewareFrameDump(t *testing.T) {
+	logs := new(bytes.Buffer)
+
+	var s Server
+	s.ErrorLog = log.New(logs, "", 0)
+	s.Use(s.LoggingMiddleware(WithFrameDump()))
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	req := Request{MBAP: MBAP{TransactionID: 1, Length: 6, UnitID: 1}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}
+	assert.Nil(t, s.executeAndRespond(new(bytes.Buffer), &req))
+
+	assert.Contains(t, logs.String(), "request=000100000006010300000001 response=000100000005010302000a\n")
+}
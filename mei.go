@@ -0,0 +1,85 @@
+package modbus
+
+import (
+	"io"
+)
+
+// CANopenGeneralReference is the MEI type used with function code 43 to
+// tunnel CANopen requests and responses.
+const CANopenGeneralReference uint8 = 13
+
+// MEIHandler can be used to respond on Modbus request with function code 43.
+// It dispatches the request based on the MEI type.
+type MEIHandler struct {
+	handlers map[uint8]Handler
+}
+
+// NewMEIHandler creates a new MEIHandler.
+func NewMEIHandler() *MEIHandler {
+	return &MEIHandler{
+		handlers: make(map[uint8]Handler),
+	}
+}
+
+// Handle registers the handler for the given MEI type.
+func (h *MEIHandler) Handle(meiType uint8, handler Handler) {
+	h.handlers[meiType] = handler
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h MEIHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h MEIHandler) ServeModbusE(w io.Writer, req Request) error {
+	if len(req.Data) < 1 {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	handler, ok := h.handlers[req.Data[0]]
+	if !ok {
+		return respond(w, NewErrorResponse(req, IllegalFunctionError))
+	}
+
+	return serveModbusE(handler, w, req)
+}
+
+// MEIHandlerFunc is an adapter to allow the use of ordinary functions as
+// handlers for a MEI type. It's called with the MEI data of the request and
+// must return the MEI data of the response, both without the MEI type.
+type MEIHandlerFunc func(unitID int, data []byte) ([]byte, error)
+
+// MEIFuncHandler can be used to respond on Modbus request with function code
+// 43 using a MEIHandlerFunc, for example to tunnel CANopen requests.
+type MEIFuncHandler struct {
+	handler MEIHandlerFunc
+}
+
+// NewMEIFuncHandler creates a new MEIFuncHandler.
+func NewMEIFuncHandler(h MEIHandlerFunc) *MEIFuncHandler {
+	return &MEIFuncHandler{
+		handler: h,
+	}
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h MEIFuncHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h MEIFuncHandler) ServeModbusE(w io.Writer, req Request) error {
+	if len(req.Data) < 1 {
+		return respond(w, NewErrorResponse(req, IllegalDataValueError))
+	}
+
+	data, err := h.handler(int(req.UnitID), req.Data[1:])
+	if err != nil {
+		return respondError(w, req, err)
+	}
+
+	return respond(w, NewResponse(req, append([]byte{req.Data[0]}, data...)))
+}
@@ -0,0 +1,61 @@
+package modbus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMEIHandler(t *testing.T) {
+	h := NewMEIHandler()
+	h.Handle(ReadDeviceIdentification, NewDeviceIdentificationHandler(DeviceIdentification{
+		VendorName:         "ACS",
+		ProductCode:        "GF",
+		MajorMinorRevision: "V1.0",
+	}))
+	h.Handle(CANopenGeneralReference, NewMEIFuncHandler(func(unitID int, data []byte) ([]byte, error) {
+		if unitID != 1 {
+			return nil, GatewayTargetDeviceFailedToRespondError
+		}
+
+		assert.Equal(t, []byte{0x40, 0x18, 0x10, 0x1}, data)
+		return []byte{0x43, 0x18, 0x10, 0x1, 0x7a, 0x1, 0x0, 0x0}, nil
+	}))
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			// CANopen SDO upload.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xd, 0x40, 0x18, 0x10, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x1, 0x2b, 0xd, 0x43, 0x18, 0x10, 0x1, 0x7a, 0x1, 0x0, 0x0},
+		},
+		{
+			Request{MBAP: MBAP{UnitID: 2}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xd, 0x40, 0x18, 0x10, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x2, 0xab, 0xb},
+		},
+		{
+			// Read device identification.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x4, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xc, 0x1, 0x2b, 0xe, 0x4, 0x81, 0x0, 0x0, 0x1, 0x1, 0x2, 0x47, 0x46},
+		},
+		{
+			// Unknown MEI type.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xc, 0x0}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0xab, 0x1},
+		},
+		{
+			// MEI type is missing.
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0xab, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
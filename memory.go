@@ -0,0 +1,611 @@
+package modbus
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Table is one of the four data tables of a Modbus device.
+type Table int
+
+const (
+	// Coils are single bits which can be read and written.
+	Coils Table = iota
+
+	// DiscreteInputs are single bits which can only be read.
+	DiscreteInputs
+
+	// HoldingRegisters are registers which can be read and written.
+	HoldingRegisters
+
+	// InputRegisters are registers which can only be read.
+	InputRegisters
+)
+
+func (t Table) String() string {
+	switch t {
+	case Coils:
+		return "coils"
+	case DiscreteInputs:
+		return "discrete inputs"
+	case HoldingRegisters:
+		return "holding registers"
+	case InputRegisters:
+		return "input registers"
+	}
+
+	return fmt.Sprintf("table %d", int(t))
+}
+
+// MarshalText marshals the table as its name, like "holding registers".
+func (t Table) MarshalText() ([]byte, error) {
+	if t < Coils || t > InputRegisters {
+		return nil, fmt.Errorf("invalid table %d", int(t))
+	}
+
+	return []byte(t.String()), nil
+}
+
+// UnmarshalText unmarshals the name of a table, ignoring case.
+func (t *Table) UnmarshalText(b []byte) error {
+	for _, table := range []Table{Coils, DiscreteInputs, HoldingRegisters, InputRegisters} {
+		if strings.EqualFold(strings.TrimSpace(string(b)), table.String()) {
+			*t = table
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown table %q", b)
+}
+
+// Access defines whether clients may read and write a holding register.
+type Access int
+
+const (
+	// ReadWrite registers can be read and written by clients.
+	ReadWrite Access = iota
+
+	// ReadOnly registers can't be written by clients.
+	ReadOnly
+
+	// WriteOnly registers can't be read by clients.
+	WriteOnly
+)
+
+func (a Access) String() string {
+	switch a {
+	case ReadWrite:
+		return "read-write"
+	case ReadOnly:
+		return "read-only"
+	case WriteOnly:
+		return "write-only"
+	}
+
+	return fmt.Sprintf("access %d", int(a))
+}
+
+// MarshalText marshals the access as "read-write", "read-only" or
+// "write-only".
+func (a Access) MarshalText() ([]byte, error) {
+	if a < ReadWrite || a > WriteOnly {
+		return nil, fmt.Errorf("invalid access %d", int(a))
+	}
+
+	return []byte(a.String()), nil
+}
+
+// UnmarshalText unmarshals "read-write", "read-only" or "write-only", ignoring
+// case. An empty string is ReadWrite.
+func (a *Access) UnmarshalText(b []byte) error {
+	s := strings.TrimSpace(string(b))
+	if s == "" {
+		*a = ReadWrite
+		return nil
+	}
+
+	for _, access := range []Access{ReadWrite, ReadOnly, WriteOnly} {
+		if strings.EqualFold(s, access.String()) {
+			*a = access
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown access %q", b)
+}
+
+// MemoryHandler can be used to respond on Modbus request with function codes
+// 1, 2, 3, 4, 5, 6, 15 and 16 using coils, discrete inputs, holding registers
+// and input registers kept in memory, for example to simulate a device. Every
+// table has its own set of addresses. Discrete inputs and input registers
+// can't be written by clients, the application sets them instead.
+//
+// The tables can be accessed with the methods of the handler while it serves
+// requests. Requests touching an address which doesn't exist are answered with
+// an IllegalAddressError, the methods return an error wrapping
+// IllegalAddressError for those addresses.
+type MemoryHandler struct {
+	mu sync.RWMutex
+
+	// tables contains the values of every Table, coils and discrete
+	// inputs are 0 or 1.
+	tables [4]memoryTable
+
+	// access contains the Access of holding registers which aren't
+	// ReadWrite.
+	access map[int]Access
+
+	onWrite  func(WriteEvent)
+	validate func(table Table, unitID, start int, values []Value) error
+
+	read           [4]*ReadHandler
+	writeCoils     *WriteHandler
+	writeRegisters *WriteHandler
+}
+
+// WriteEvent describes a write of a single address of a MemoryHandler.
+type WriteEvent struct {
+	Table  Table
+	UnitID int
+	Addr   int
+	Old    Value
+	New    Value
+
+	// Local is true for writes by the application using the methods of
+	// the handler, UnitID is 0 for those. It's false for writes by
+	// clients.
+	Local bool
+}
+
+// memoryBlock is a range of consecutive addresses starting at start.
+type memoryBlock struct {
+	start  int
+	values []Value
+}
+
+func (b memoryBlock) end() int {
+	return b.start + len(b.values)
+}
+
+// memoryTable is a sorted list of blocks which neither overlap nor adjoin.
+type memoryTable []memoryBlock
+
+// find returns the values of the quantity addresses starting at start, or
+// false when not all of them exist.
+func (t memoryTable) find(start, quantity int) ([]Value, bool) {
+	i := sort.Search(len(t), func(i int) bool { return t[i].end() > start })
+	if i == len(t) || t[i].start > start || start+quantity > t[i].end() {
+		return nil, false
+	}
+
+	return t[i].values[start-t[i].start : start-t[i].start+quantity], true
+}
+
+// add returns a table containing the addresses of t and the n addresses
+// starting at start. Blocks which overlap or adjoin those addresses are merged.
+func (t memoryTable) add(start, n int) memoryTable {
+	if n <= 0 {
+		return t
+	}
+
+	end := start + n
+	var rest, merged memoryTable
+	for _, b := range t {
+		if b.end() < start || b.start > end {
+			rest = append(rest, b)
+			continue
+		}
+
+		merged = append(merged, b)
+		if b.start < start {
+			start = b.start
+		}
+		if b.end() > end {
+			end = b.end()
+		}
+	}
+
+	block := memoryBlock{start: start, values: make([]Value, end-start)}
+	for _, b := range merged {
+		copy(block.values[b.start-start:], b.values)
+	}
+
+	i := sort.Search(len(rest), func(i int) bool { return rest[i].start > start })
+	return append(rest[:i], append(memoryTable{block}, rest[i:]...)...)
+}
+
+// NewMemoryHandler creates a new MemoryHandler with tables of the given sizes,
+// starting at address 0. All coils and discrete inputs are off and all
+// registers are 0. Use NewMemoryHandler(0, 0, 0, 0) and AddCoils,
+// AddDiscreteInputs, AddHoldingRegisters and AddInputRegisters to create a
+// handler with gaps between the addresses.
+func NewMemoryHandler(coils, discreteInputs, holdingRegisters, inputRegisters int) *MemoryHandler {
+	h := &MemoryHandler{
+		tables: [4]memoryTable{
+			Coils:            memoryTable(nil).add(0, coils),
+			DiscreteInputs:   memoryTable(nil).add(0, discreteInputs),
+			HoldingRegisters: memoryTable(nil).add(0, holdingRegisters),
+			InputRegisters:   memoryTable(nil).add(0, inputRegisters),
+		},
+	}
+
+	for t := range h.read {
+		table := Table(t)
+		h.read[t] = NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+			return h.readTable(table, start, quantity)
+		})
+	}
+
+	h.writeCoils = NewWriteHandler(func(unitID, start int, values []Value) error {
+		return h.writeTable(Coils, unitID, start, values)
+	}, Unsigned)
+	h.writeRegisters = NewWriteHandler(func(unitID, start int, values []Value) error {
+		return h.writeTable(HoldingRegisters, unitID, start, values)
+	}, Unsigned)
+
+	return h
+}
+
+// readTable returns quantity values of table starting at start.
+func (h *MemoryHandler) readTable(table Table, start, quantity int) ([]Value, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	values, ok := h.tables[table].find(start, quantity)
+	if !ok || !h.allowed(table, start, quantity, WriteOnly) {
+		return nil, IllegalAddressError
+	}
+
+	return append([]Value(nil), values...), nil
+}
+
+// writeTable writes values written by a client to table starting at start.
+func (h *MemoryHandler) writeTable(table Table, unitID, start int, values []Value) error {
+	h.mu.Lock()
+	current, ok := h.tables[table].find(start, len(values))
+	if !ok || !h.allowed(table, start, len(values), ReadOnly) {
+		h.mu.Unlock()
+		return IllegalAddressError
+	}
+
+	if h.validate != nil {
+		if err := h.validate(table, unitID, start, values); err != nil {
+			h.mu.Unlock()
+			return err
+		}
+	}
+
+	events := make([]WriteEvent, len(values))
+	for i, v := range values {
+		events[i] = WriteEvent{Table: table, UnitID: unitID, Addr: start + i, Old: current[i], New: v}
+		current[i] = v
+	}
+	onWrite := h.onWrite
+	h.mu.Unlock()
+
+	if onWrite != nil {
+		for _, e := range events {
+			onWrite(e)
+		}
+	}
+
+	return nil
+}
+
+// allowed returns false when one of the quantity addresses of table starting
+// at start has Access denied. The caller must hold the lock.
+func (h *MemoryHandler) allowed(table Table, start, quantity int, denied Access) bool {
+	if table != HoldingRegisters {
+		return true
+	}
+
+	for addr := start; addr < start+quantity; addr++ {
+		if h.access[addr] == denied {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Protect sets the Access of count holding registers starting at start.
+// Requests of clients touching a register which they may not read or write
+// are rejected as a whole with an IllegalAddressError, without writing any
+// register. The methods of the handler can always read and write them.
+func (h *MemoryHandler) Protect(start, count int, access Access) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.access == nil {
+		h.access = make(map[int]Access)
+	}
+
+	for addr := start; addr < start+count; addr++ {
+		if access == ReadWrite {
+			delete(h.access, addr)
+		} else {
+			h.access[addr] = access
+		}
+	}
+}
+
+// get returns the value at addr in table.
+func (h *MemoryHandler) get(table Table, addr int) (Value, error) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	values, ok := h.tables[table].find(addr, 1)
+	if !ok {
+		return Value{}, fmt.Errorf("address %d of %s: %w", addr, table, IllegalAddressError)
+	}
+
+	return values[0], nil
+}
+
+// set sets the value at addr in table.
+func (h *MemoryHandler) set(table Table, addr int, v Value) error {
+	h.mu.Lock()
+	values, ok := h.tables[table].find(addr, 1)
+	if !ok {
+		h.mu.Unlock()
+		return fmt.Errorf("address %d of %s: %w", addr, table, IllegalAddressError)
+	}
+
+	e := WriteEvent{Table: table, Addr: addr, Old: values[0], New: v, Local: true}
+	values[0] = v
+	onWrite := h.onWrite
+	h.mu.Unlock()
+
+	if onWrite != nil {
+		onWrite(e)
+	}
+
+	return nil
+}
+
+// OnWrite sets a function which is called for every address written, by
+// clients as well as by the application, also when the value doesn't change.
+// Restore doesn't call it.
+//
+// The function is called after the write has been applied, without holding
+// the lock of the handler, so it may call the methods of the handler. It's
+// called synchronously: a write by a client isn't answered before the
+// function returned, so a slow function blocks the client. Send the events to
+// a buffered channel to process them asynchronously. The order in which
+// concurrent writes are reported isn't defined.
+func (h *MemoryHandler) OnWrite(f func(e WriteEvent)) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.onWrite = f
+}
+
+// add adds n addresses starting at start to table.
+func (h *MemoryHandler) add(table Table, start, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.tables[table] = h.tables[table].add(start, n)
+}
+
+// AddCoils adds n coils starting at address start, which are off. Coils which
+// already exist keep their state.
+func (h *MemoryHandler) AddCoils(start, n int) {
+	h.add(Coils, start, n)
+}
+
+// AddDiscreteInputs adds n discrete inputs starting at address start, which
+// are off. Discrete inputs which already exist keep their state.
+func (h *MemoryHandler) AddDiscreteInputs(start, n int) {
+	h.add(DiscreteInputs, start, n)
+}
+
+// AddHoldingRegisters adds n holding registers starting at address start,
+// which are 0. Holding registers which already exist keep their value.
+func (h *MemoryHandler) AddHoldingRegisters(start, n int) {
+	h.add(HoldingRegisters, start, n)
+}
+
+// AddInputRegisters adds n input registers starting at address start, which
+// are 0. Input registers which already exist keep their value.
+func (h *MemoryHandler) AddInputRegisters(start, n int) {
+	h.add(InputRegisters, start, n)
+}
+
+// ValidateWrite sets a function which is called with all values of a write
+// request of a client before any of them is written. When it returns an error
+// the request is rejected and no value is written, the error is handled like
+// an error of a WriteHandlerFunc. The values are written while the lock of the
+// handler is still held, so other requests never see a partial write. As the
+// function is called with the lock held, it must not call the methods of the
+// handler.
+func (h *MemoryHandler) ValidateWrite(f func(table Table, unitID, start int, values []Value) error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.validate = f
+}
+
+// GetCoil returns the state of the coil at addr.
+func (h *MemoryHandler) GetCoil(addr int) (bool, error) {
+	v, err := h.get(Coils, addr)
+	return v.Bool(), err
+}
+
+// SetCoil sets the state of the coil at addr.
+func (h *MemoryHandler) SetCoil(addr int, on bool) error {
+	return h.set(Coils, addr, NewBoolValue(on))
+}
+
+// GetDiscreteInput returns the state of the discrete input at addr.
+func (h *MemoryHandler) GetDiscreteInput(addr int) (bool, error) {
+	v, err := h.get(DiscreteInputs, addr)
+	return v.Bool(), err
+}
+
+// SetDiscreteInput sets the state of the discrete input at addr.
+func (h *MemoryHandler) SetDiscreteInput(addr int, on bool) error {
+	return h.set(DiscreteInputs, addr, NewBoolValue(on))
+}
+
+// GetRegister returns the value of the holding register at addr.
+func (h *MemoryHandler) GetRegister(addr int) (Value, error) {
+	return h.get(HoldingRegisters, addr)
+}
+
+// SetRegister sets the value of the holding register at addr.
+func (h *MemoryHandler) SetRegister(addr int, v Value) error {
+	return h.set(HoldingRegisters, addr, v)
+}
+
+// GetInputRegister returns the value of the input register at addr.
+func (h *MemoryHandler) GetInputRegister(addr int) (Value, error) {
+	return h.get(InputRegisters, addr)
+}
+
+// SetInputRegister sets the value of the input register at addr.
+func (h *MemoryHandler) SetInputRegister(addr int, v Value) error {
+	return h.set(InputRegisters, addr, v)
+}
+
+// memorySnapshot is the JSON representation of the tables of a MemoryHandler.
+// Every table maps addresses to values.
+type memorySnapshot struct {
+	Coils            map[int]bool  `json:"coils"`
+	DiscreteInputs   map[int]bool  `json:"discrete_inputs"`
+	HoldingRegisters map[int]Value `json:"holding_registers"`
+	InputRegisters   map[int]Value `json:"input_registers"`
+}
+
+// Snapshot writes the values of all tables to w as JSON, for example to save
+// the state of a simulated device:
+//
+//	{
+//		"coils": {"0": true, "1": false},
+//		"discrete_inputs": {"0": false},
+//		"holding_registers": {"0": 498, "1": 0},
+//		"input_registers": {}
+//	}
+//
+// The snapshot is consistent, it's taken while no request is executed.
+func (h *MemoryHandler) Snapshot(w io.Writer) error {
+	bits := func(t memoryTable) map[int]bool {
+		m := make(map[int]bool)
+		for _, b := range t {
+			for i, v := range b.values {
+				m[b.start+i] = v.Bool()
+			}
+		}
+		return m
+	}
+
+	registers := func(t memoryTable) map[int]Value {
+		m := make(map[int]Value)
+		for _, b := range t {
+			for i, v := range b.values {
+				m[b.start+i] = v
+			}
+		}
+		return m
+	}
+
+	h.mu.RLock()
+	snapshot := memorySnapshot{
+		Coils:            bits(h.tables[Coils]),
+		DiscreteInputs:   bits(h.tables[DiscreteInputs]),
+		HoldingRegisters: registers(h.tables[HoldingRegisters]),
+		InputRegisters:   registers(h.tables[InputRegisters]),
+	}
+	h.mu.RUnlock()
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "\t")
+	if err := enc.Encode(snapshot); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+
+	return nil
+}
+
+// Restore reads a snapshot written by Snapshot from r and replaces the values
+// of all tables with it. Addresses missing from the snapshot are set to 0. It
+// returns an error when the snapshot contains an address which doesn't exist,
+// in which case no value is changed.
+func (h *MemoryHandler) Restore(r io.Reader) error {
+	var snapshot memorySnapshot
+
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&snapshot); err != nil {
+		return fmt.Errorf("failed to read snapshot: %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var tables [4]memoryTable
+	for t := range tables {
+		for _, b := range h.tables[t] {
+			tables[t] = append(tables[t], memoryBlock{start: b.start, values: make([]Value, len(b.values))})
+		}
+	}
+
+	set := func(table Table, addr int, v Value) error {
+		values, ok := tables[table].find(addr, 1)
+		if !ok {
+			return fmt.Errorf("snapshot contains address %d of %s, which doesn't exist", addr, table)
+		}
+
+		values[0] = v
+		return nil
+	}
+
+	for table, bits := range map[Table]map[int]bool{Coils: snapshot.Coils, DiscreteInputs: snapshot.DiscreteInputs} {
+		for addr, on := range bits {
+			if err := set(table, addr, NewBoolValue(on)); err != nil {
+				return err
+			}
+		}
+	}
+
+	for table, registers := range map[Table]map[int]Value{HoldingRegisters: snapshot.HoldingRegisters, InputRegisters: snapshot.InputRegisters} {
+		for addr, v := range registers {
+			if err := set(table, addr, v); err != nil {
+				return err
+			}
+		}
+	}
+
+	h.tables = tables
+	return nil
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h *MemoryHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h *MemoryHandler) ServeModbusE(w io.Writer, req Request) error {
+	switch req.FunctionCode {
+	case ReadCoils:
+		return serveModbusE(h.read[Coils], w, req)
+	case ReadDiscreteInputs:
+		return serveModbusE(h.read[DiscreteInputs], w, req)
+	case ReadHoldingRegisters:
+		return serveModbusE(h.read[HoldingRegisters], w, req)
+	case ReadInputRegisters:
+		return serveModbusE(h.read[InputRegisters], w, req)
+	case WriteSingleCoil, WriteMultipleCoils:
+		return serveModbusE(h.writeCoils, w, req)
+	case WriteSingleRegister, WriteMultipleRegisters:
+		return serveModbusE(h.writeRegisters, w, req)
+	default:
+		return respond(w, NewErrorResponse(req, IllegalFunctionError))
+	}
+}
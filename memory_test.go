@@ -0,0 +1,333 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryHandler(t *testing.T) {
+	h := NewMemoryHandler(10, 0, 4, 0)
+	assert.Nil(t, h.SetCoil(1, true))
+	assert.Nil(t, h.SetRegister(3, Value{0x1234}))
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x0, 0x0, 0xa}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x1, 0x2, 0x2, 0x0}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x2, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x7, 0x0, 0x3, 0x4, 0x0, 0x0, 0x12, 0x34}},
+		{Request{FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x9, 0xff, 0x0}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x5, 0x0, 0x9, 0xff, 0x0}},
+		{Request{FunctionCode: WriteMultipleCoils, Data: []byte{0x0, 0x0, 0x0, 0x2, 0x1, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0xf, 0x0, 0x0, 0x0, 0x2}},
+		{Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x0, 0x0, 0x2, 0x4, 0x0, 0xa, 0xff, 0xff}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x0, 0x0, 0x2}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x4}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x0, 0x3, 0x8, 0x0, 0xa, 0xff, 0xff, 0x0, 0x0, 0x12, 0x34}},
+		// Addresses beyond the coils and registers.
+		{Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x9, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x81, 0x2}},
+		{Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x4, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2}},
+		{Request{FunctionCode: ReadExceptionStatus}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x87, 0x1}},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+
+	for addr, expected := range []bool{true, false, false, false, false, false, false, false, false, true} {
+		on, err := h.GetCoil(addr)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, on)
+	}
+
+	v, err := h.GetRegister(1)
+	assert.Nil(t, err)
+	assert.Equal(t, Value{0xffff}, v)
+
+	_, err = h.GetCoil(10)
+	assert.True(t, errors.Is(err, IllegalAddressError))
+	assert.True(t, errors.Is(h.SetCoil(-1, true), IllegalAddressError))
+	_, err = h.GetRegister(4)
+	assert.True(t, errors.Is(err, IllegalAddressError))
+	assert.True(t, errors.Is(h.SetRegister(4, Value{1}), IllegalAddressError))
+}
+
+func TestMemoryHandlerTables(t *testing.T) {
+	h := NewMemoryHandler(1, 2, 3, 4)
+	assert.Nil(t, h.SetDiscreteInput(1, true))
+	assert.Nil(t, h.SetInputRegister(3, Value{0xa}))
+	assert.Nil(t, h.SetRegister(2, Value{0xb}))
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x0, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x1, 0x1, 0x0}},
+		{Request{FunctionCode: ReadDiscreteInputs, Data: []byte{0x0, 0x0, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x2, 0x1, 0x2}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x2, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3, 0x2, 0x0, 0xb}},
+		{Request{FunctionCode: ReadInputRegisters, Data: []byte{0x0, 0x3, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x4, 0x2, 0x0, 0xa}},
+		// Every table has its own size.
+		{Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x0, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x81, 0x2}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x3, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x2}},
+		// Writes to addresses which only exist in the read-only tables.
+		{Request{FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x1, 0xff, 0x0}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x85, 0x2}},
+		{Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x3, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2}},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+
+	on, err := h.GetDiscreteInput(1)
+	assert.Nil(t, err)
+	assert.True(t, on)
+
+	v, err := h.GetInputRegister(3)
+	assert.Nil(t, err)
+	assert.Equal(t, Value{0xa}, v)
+
+	assert.True(t, errors.Is(h.SetDiscreteInput(2, true), IllegalAddressError))
+	assert.True(t, errors.Is(h.SetInputRegister(4, Value{1}), IllegalAddressError))
+}
+
+func TestMemoryHandlerSnapshot(t *testing.T) {
+	h := NewMemoryHandler(2, 1, 2, 1)
+	assert.Nil(t, h.SetCoil(1, true))
+	assert.Nil(t, h.SetRegister(0, Value{498}))
+	assert.Nil(t, h.SetRegister(1, Value{-1}))
+	assert.Nil(t, h.SetInputRegister(0, Value{0xffff}))
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, h.Snapshot(buf))
+	assert.Equal(t, `{
+	"coils": {
+		"0": false,
+		"1": true
+	},
+	"discrete_inputs": {
+		"0": false
+	},
+	"holding_registers": {
+		"0": 498,
+		"1": -1
+	},
+	"input_registers": {
+		"0": 65535
+	}
+}
+`, buf.String())
+
+	restored := NewMemoryHandler(2, 1, 2, 1)
+	assert.Nil(t, restored.SetDiscreteInput(0, true))
+	assert.Nil(t, restored.Restore(bytes.NewReader(buf.Bytes())))
+	assert.Equal(t, h.tables, restored.tables)
+
+	// Addresses missing from the snapshot are reset.
+	assert.Nil(t, restored.Restore(bytes.NewBufferString(`{"holding_registers": {"1": 3}}`)))
+	assert.Equal(t, NewMemoryHandler(2, 1, 2, 1).tables[Coils], restored.tables[Coils])
+	assert.Equal(t, memoryTable{{start: 0, values: []Value{{0}, {3}}}}, restored.tables[HoldingRegisters])
+
+	// A snapshot which doesn't fit in the tables isn't restored.
+	err := restored.Restore(bytes.NewBufferString(`{"coils": {"0": true}, "holding_registers": {"2": 1}}`))
+	assert.EqualError(t, err, "snapshot contains address 2 of holding registers, which doesn't exist")
+	v, err := restored.GetRegister(1)
+	assert.Nil(t, err)
+	assert.Equal(t, Value{3}, v)
+
+	invalid := []string{
+		`{"holding_registers": {"0": 65536}}`,
+		`{"coils": {"0": 1}}`,
+		`{"registers": {}}`,
+		`{"input_registers": {"-1": 0}}`,
+		`{`,
+	}
+
+	for _, s := range invalid {
+		assert.NotNil(t, restored.Restore(bytes.NewBufferString(s)))
+	}
+}
+
+func TestMemoryHandlerSparse(t *testing.T) {
+	h := NewMemoryHandler(0, 0, 0, 0)
+	h.AddHoldingRegisters(0, 10)
+	h.AddHoldingRegisters(9000, 50)
+	h.AddCoils(5, 2)
+	assert.Nil(t, h.SetRegister(9, Value{1}))
+	assert.Nil(t, h.SetRegister(9049, Value{2}))
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x9, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3, 0x2, 0x0, 0x1}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x23, 0x59, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3, 0x2, 0x0, 0x2}},
+		{Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x5, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x1, 0x1, 0x0}},
+		// Spans touching the gaps.
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x9, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x2}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x23, 0x27, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x2}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x23, 0x59, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x2}},
+		{Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0xa, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2}},
+		{Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x4, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x81, 0x2}},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+
+	_, err := h.GetRegister(8999)
+	assert.True(t, errors.Is(err, IllegalAddressError))
+	assert.True(t, errors.Is(h.SetCoil(7, true), IllegalAddressError))
+
+	// Ranges which overlap or adjoin existing ones are merged, existing
+	// registers keep their value.
+	h.AddHoldingRegisters(8, 5)
+	h.AddHoldingRegisters(13, 2)
+	h.AddHoldingRegisters(20, 0)
+	assert.Equal(t, memoryTable{
+		{start: 0, values: []Value{{0}, {0}, {0}, {0}, {0}, {0}, {0}, {0}, {0}, {1}, {0}, {0}, {0}, {0}, {0}}},
+		{start: 9000, values: h.tables[HoldingRegisters][1].values},
+	}, h.tables[HoldingRegisters])
+
+	h.AddHoldingRegisters(15, 8985)
+	assert.Len(t, h.tables[HoldingRegisters], 1)
+	v, err := h.GetRegister(9049)
+	assert.Nil(t, err)
+	assert.Equal(t, Value{2}, v)
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, h.Snapshot(buf))
+	assert.Contains(t, buf.String(), `"9049": 2`)
+	assert.NotNil(t, h.Restore(bytes.NewBufferString(`{"holding_registers": {"9050": 1}}`)))
+	assert.Nil(t, h.Restore(bytes.NewBufferString(`{"coils": {"6": true}}`)))
+}
+
+func TestMemoryHandlerProtect(t *testing.T) {
+	h := NewMemoryHandler(0, 0, 10, 0)
+	h.Protect(2, 3, ReadOnly)
+	h.Protect(8, 2, WriteOnly)
+	h.Protect(4, 1, ReadWrite)
+
+	// The application can write protected registers.
+	assert.Nil(t, h.SetRegister(3, Value{7}))
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x2, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x7, 0x0, 0x3, 0x4, 0x0, 0x0, 0x0, 0x7}},
+		{Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x3, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2}},
+		// A write straddling the start of the read-only range.
+		{Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x0, 0x1, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x90, 0x2}},
+		// The last register of the range has been made writable again.
+		{Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x4, 0x0, 0x2, 0x4, 0x0, 0x1, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x4, 0x0, 0x2}},
+		{Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x7, 0x0, 0x3, 0x6, 0x0, 0x2, 0x0, 0x2, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x7, 0x0, 0x3}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x7, 0x0, 0x2}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x2}},
+		{Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x7, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3, 0x2, 0x0, 0x2}},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+
+	// The rejected write hasn't changed register 1.
+	for addr, expected := range []Value{{0}, {0}, {0}, {7}, {1}, {1}, {0}, {2}, {2}, {2}} {
+		v, err := h.GetRegister(addr)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, v)
+	}
+}
+
+func TestMemoryHandlerValidateWrite(t *testing.T) {
+	h := NewMemoryHandler(1, 0, 3, 0)
+	h.ValidateWrite(func(table Table, unitID, start int, values []Value) error {
+		assert.Equal(t, HoldingRegisters, table)
+		assert.Equal(t, 1, unitID)
+
+		for _, v := range values {
+			if v.Get() > 100 {
+				return IllegalDataValueError
+			}
+		}
+		return nil
+	})
+
+	buf := new(bytes.Buffer)
+	h.ServeModbus(buf, Request{MBAP: MBAP{UnitID: 1}, FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x0, 0x0, 0x3, 0x6, 0x0, 0x1, 0x0, 0x2, 0x1, 0x0}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x90, 0x3}, buf.Bytes())
+
+	// None of the values has been written.
+	for addr := 0; addr < 3; addr++ {
+		v, err := h.GetRegister(addr)
+		assert.Nil(t, err)
+		assert.Equal(t, Value{0}, v)
+	}
+
+	buf.Reset()
+	h.ServeModbus(buf, Request{MBAP: MBAP{UnitID: 1}, FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x0, 0x0, 0x3, 0x6, 0x0, 0x1, 0x0, 0x2, 0x0, 0x3}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x1, 0x10, 0x0, 0x0, 0x0, 0x3}, buf.Bytes())
+
+	v, err := h.GetRegister(2)
+	assert.Nil(t, err)
+	assert.Equal(t, Value{3}, v)
+}
+
+func TestMemoryHandlerOnWrite(t *testing.T) {
+	h := NewMemoryHandler(2, 1, 3, 1)
+
+	var events []WriteEvent
+	h.OnWrite(func(e WriteEvent) {
+		// The handler isn't locked while the function is called.
+		_, err := h.GetRegister(e.Addr)
+		assert.Nil(t, err)
+
+		events = append(events, e)
+	})
+
+	assert.Nil(t, h.SetRegister(0, Value{7}))
+	assert.Nil(t, h.SetDiscreteInput(0, true))
+	assert.NotNil(t, h.SetCoil(2, true))
+
+	h.ServeModbus(new(bytes.Buffer), Request{MBAP: MBAP{UnitID: 3}, FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x0, 0x0, 0x2, 0x4, 0x0, 0x8, 0x0, 0x9}})
+	h.ServeModbus(new(bytes.Buffer), Request{MBAP: MBAP{UnitID: 3}, FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x1, 0xff, 0x0}})
+
+	// Failed writes aren't reported.
+	h.ServeModbus(new(bytes.Buffer), Request{MBAP: MBAP{UnitID: 3}, FunctionCode: WriteSingleCoil, Data: []byte{0x0, 0x2, 0xff, 0x0}})
+	assert.Nil(t, h.Restore(bytes.NewBufferString(`{}`)))
+
+	assert.Equal(t, []WriteEvent{
+		{Table: HoldingRegisters, Addr: 0, Old: Value{0}, New: Value{7}, Local: true},
+		{Table: DiscreteInputs, Addr: 0, Old: Value{0}, New: Value{1}, Local: true},
+		{Table: HoldingRegisters, UnitID: 3, Addr: 0, Old: Value{7}, New: Value{8}},
+		{Table: HoldingRegisters, UnitID: 3, Addr: 1, Old: Value{0}, New: Value{9}},
+		{Table: Coils, UnitID: 3, Addr: 1, Old: Value{0}, New: Value{1}},
+	}, events)
+}
+
+func TestMemoryHandlerConcurrency(t *testing.T) {
+	h := NewMemoryHandler(0, 0, 1, 0)
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			h.SetRegister(0, Value{i})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			h.ServeModbus(new(bytes.Buffer), Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x0, 0x0, 0x1}})
+			h.ServeModbus(new(bytes.Buffer), Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}})
+		}
+	}()
+	wg.Wait()
+}
@@ -2,9 +2,14 @@ package modbus
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"net"
+	"strconv"
 )
 
 const (
@@ -26,11 +31,41 @@ const (
 	// WriteSingleRegister is Modbus function code 6.
 	WriteSingleRegister
 
+	// ReadExceptionStatus is Modbus function code 7.
+	ReadExceptionStatus
+
+	// Diagnostics is Modbus function code 8.
+	Diagnostics
+
+	// GetCommEventLog is Modbus function code 12.
+	GetCommEventLog uint8 = 12
+
 	// WriteMultipleCoils is Modbus function code 15.
-	WriteMultipleCoils = 15 + 1
+	WriteMultipleCoils uint8 = 15
 
 	// WriteMultipleRegisters is Modbus function code 16.
-	WriteMultipleRegisters
+	WriteMultipleRegisters uint8 = 16
+
+	// ReportServerID is Modbus function code 17.
+	ReportServerID uint8 = 17
+
+	// ReadFileRecord is Modbus function code 20.
+	ReadFileRecord uint8 = 20
+
+	// WriteFileRecord is Modbus function code 21.
+	WriteFileRecord uint8 = 21
+
+	// MaskWriteRegister is Modbus function code 22.
+	MaskWriteRegister uint8 = 22
+
+	// ReadWriteMultipleRegisters is Modbus function code 23.
+	ReadWriteMultipleRegisters uint8 = 23
+
+	// ReadFIFOQueue is Modbus function code 24.
+	ReadFIFOQueue uint8 = 24
+
+	// EncapsulatedInterfaceTransport is Modbus function code 43.
+	EncapsulatedInterfaceTransport uint8 = 43
 )
 
 // Error represesents a Modbus protocol error.
@@ -40,53 +75,85 @@ type Error struct {
 	msg  string
 }
 
+// NewError creates an Error with a custom exception code, for example a
+// vendor-specific one. It panics when code is 0, which isn't a valid exception
+// code.
+func NewError(code uint8, msg string) Error {
+	if code == 0 {
+		panic("goldfish: invalid exception code 0")
+	}
+
+	return Error{Code: code, msg: msg}
+}
+
 func (e Error) Error() string {
 	return fmt.Sprintf("Modbus exception code: %d: %v", e.Code, e.msg)
 }
 
+// Is reports whether target is an Error with the same exception code, so
+// errors.Is(err, IllegalAddressError) works for wrapped errors too.
+func (e Error) Is(target error) bool {
+	t, ok := target.(Error)
+	return ok && t.Code == e.Code
+}
+
+// The exception codes defined by the Modbus specification.
+const (
+	ExceptionIllegalFunction                    uint8 = 1
+	ExceptionIllegalAddress                     uint8 = 2
+	ExceptionIllegalDataValue                   uint8 = 3
+	ExceptionSlaveDeviceFailure                 uint8 = 4
+	ExceptionAcknowledge                        uint8 = 5
+	ExceptionSlaveDeviceBusy                    uint8 = 6
+	ExceptionNegativeAcknowledge                uint8 = 7
+	ExceptionMemoryParity                       uint8 = 8
+	ExceptionGatewayPathUnavailable             uint8 = 10
+	ExceptionGatewayTargetDeviceFailedToRespond uint8 = 11
+)
+
 var (
 	// IllegalFunctionError with exception code 1, is returned when the
 	// function received is not an allowable action fwith the slave.
-	IllegalFunctionError = Error{Code: 1, msg: "illegal function"}
+	IllegalFunctionError = Error{Code: ExceptionIllegalFunction, msg: "illegal function"}
 
 	// IllegalAddressError with exception code 2, is returned when the
 	// address received is not an allowable address fwith the slave.
-	IllegalAddressError = Error{Code: 2, msg: "illegal address"}
+	IllegalAddressError = Error{Code: ExceptionIllegalAddress, msg: "illegal address"}
 
 	// IllegalDataValueError with exception code 3, is returned if the
 	// request contains an value that is not allowable fwith the slave.
-	IllegalDataValueError = Error{Code: 3, msg: "illegal data value"}
+	IllegalDataValueError = Error{Code: ExceptionIllegalDataValue, msg: "illegal data value"}
 
 	// SlaveDeviceFailureError with exception code 4, is returned when
 	// the server isn't able to handle the request.
-	SlaveDeviceFailureError = Error{Code: 4, msg: "slave device failure"}
+	SlaveDeviceFailureError = Error{Code: ExceptionSlaveDeviceFailure, msg: "slave device failure"}
 
 	// AcknowledgeError with exception code 5, is returned when the
 	// server has received the request successfully, but needs a long time
 	// to process the request.
-	AcknowledgeError = Error{Code: 5, msg: "acknowledge"}
+	AcknowledgeError = Error{Code: ExceptionAcknowledge, msg: "acknowledge"}
 
 	// SlaveDeviceBusyError with exception 6, is returned when master is
 	// busy processing a long-running command.
-	SlaveDeviceBusyError = Error{Code: 6, msg: "slave device busy"}
+	SlaveDeviceBusyError = Error{Code: ExceptionSlaveDeviceBusy, msg: "slave device busy"}
 
 	// NegativeAcknowledgeError with exception code 7, is returned for an
 	// unsuccessful programming request using function code 13 or 14.
-	NegativeAcknowledgeError = Error{Code: 7, msg: "negative acknowledge"}
+	NegativeAcknowledgeError = Error{Code: ExceptionNegativeAcknowledge, msg: "negative acknowledge"}
 
 	// MemoryParityError with exception code 8 is returned to indicate that
 	// the extended file area failed to pass a consistency check. May only
 	// returned for requests with function code 20 or 21.
-	MemoryParityError = Error{Code: 8, msg: "memory parity error"}
+	MemoryParityError = Error{Code: ExceptionMemoryParity, msg: "memory parity error"}
 
 	// GatewayPathUnavailableError with exception code 10 indicates that
 	// the gateway was unable to allocate an internal communication path
 	// from the input port to the output port for processing the request.
-	GatewayPathUnavailableError = Error{Code: 10, msg: "gateway path unavailable"}
+	GatewayPathUnavailableError = Error{Code: ExceptionGatewayPathUnavailable, msg: "gateway path unavailable"}
 
 	// GatewayTargetDeviceFailedToRespondError with exception code 11
 	// indicates that the device is not present on the network.
-	GatewayTargetDeviceFailedToRespondError = Error{Code: 11, msg: "gateway target device failed to respond"}
+	GatewayTargetDeviceFailedToRespondError = Error{Code: ExceptionGatewayTargetDeviceFailedToRespond, msg: "gateway target device failed to respond"}
 )
 
 // Value is a value an integer ranging from range of -32768 through 65535.
@@ -106,6 +173,16 @@ func NewValue(v int) (Value, error) {
 	return value, nil
 }
 
+// NewBoolValue creates a Value for a coil or discrete input. The Value is 1
+// when b is true, otherwise it's 0.
+func NewBoolValue(b bool) Value {
+	if b {
+		return Value{1}
+	}
+
+	return Value{0}
+}
+
 // Set sets the value. It returns an error when given value is outside range of
 // -32768 through 65535.
 func (v *Value) Set(value int) error {
@@ -122,6 +199,71 @@ func (v *Value) Get() int {
 	return v.v
 }
 
+// Uint16 returns the value as unsigned integer. It returns an error when the
+// value is negative.
+func (v *Value) Uint16() (uint16, error) {
+	if v.v < 0 {
+		return 0, fmt.Errorf("%d doesn't fit in uint16", v.v)
+	}
+
+	return uint16(v.v), nil
+}
+
+// Int16 returns the value as signed integer. It returns an error when the
+// value is larger than 32767, the value isn't reinterpreted as two's
+// complement.
+func (v *Value) Int16() (int16, error) {
+	if v.v > math.MaxInt16 {
+		return 0, fmt.Errorf("%d doesn't fit in int16", v.v)
+	}
+
+	return int16(v.v), nil
+}
+
+// SetUint16 sets the value to an unsigned integer.
+func (v *Value) SetUint16(value uint16) {
+	v.v = int(value)
+}
+
+// SetInt16 sets the value to a signed integer.
+func (v *Value) SetInt16(value int16) {
+	v.v = int(value)
+}
+
+// Bool returns the value as state of a coil or discrete input. Every non-zero
+// value is true.
+func (v *Value) Bool() bool {
+	return v.v != 0
+}
+
+// String returns the value in decimal and hexadecimal notation, like
+// "498 (0x01F2)". Negative values are shown in hexadecimal as two's
+// complement.
+func (v Value) String() string {
+	return fmt.Sprintf("%d (0x%04X)", v.v, uint16(v.v))
+}
+
+// MarshalJSON marshals the value as a plain number.
+func (v Value) MarshalJSON() ([]byte, error) {
+	return []byte(strconv.Itoa(v.v)), nil
+}
+
+// UnmarshalJSON unmarshals a plain number. It returns an error when the number
+// is outside range of -32768 through 65535.
+func (v *Value) UnmarshalJSON(b []byte) error {
+	var value int
+	if err := json.Unmarshal(b, &value); err != nil {
+		return fmt.Errorf("failed to unmarshal value: %v", err)
+	}
+
+	return v.Set(value)
+}
+
+// MarshalText marshals the value as a decimal number.
+func (v Value) MarshalText() ([]byte, error) {
+	return []byte(strconv.Itoa(v.v)), nil
+}
+
 // MarshalBinary marshals a Value into byte slice with length of 2
 // bytes.
 func (v *Value) MarshalBinary() ([]byte, error) {
@@ -214,10 +356,140 @@ type Request struct {
 
 	FunctionCode uint8
 	Data         []byte
+
+	ctx context.Context
+
+	// remoteAddr is the address of the client which sent the request.
+	remoteAddr net.Addr
+
+	// errorMapper translates errors returned by handlers to exceptions.
+	errorMapper func(error) Error
+
+	// denied is the error of the authorizer of the server when it didn't
+	// allow the client to execute the request.
+	denied error
+}
+
+// Context returns the context of the request. For requests received by a
+// server it's canceled when the connection is closed.
+func (r Request) Context() context.Context {
+	if r.ctx != nil {
+		return r.ctx
+	}
+
+	return context.Background()
+}
+
+// RemoteAddr returns the address of the client which sent the request. It
+// returns nil for requests received over a serial line.
+func (r Request) RemoteAddr() net.Addr {
+	return r.remoteAddr
+}
+
+// WithContext returns a copy of r with its context changed to ctx.
+func (r Request) WithContext(ctx context.Context) Request {
+	r.ctx = ctx
+	return r
+}
+
+// NewReadRequest creates a request with function code 1, 2, 3 or 4 reading
+// quantity coils or registers starting at start.
+func NewReadRequest(unitID, functionCode uint8, start, quantity uint16) Request {
+	data := make([]byte, 4)
+	binary.BigEndian.PutUint16(data[0:2], start)
+	binary.BigEndian.PutUint16(data[2:4], quantity)
+
+	return Request{
+		MBAP:         MBAP{UnitID: unitID},
+		FunctionCode: functionCode,
+		Data:         data,
+	}
+}
+
+// NewWriteRequest creates a request with function code 5, 6, 15 or 16 writing
+// values starting at start. Coils are on for non-zero values. It returns an
+// error when the function code isn't a write function code or when the
+// number of values isn't valid for the function code.
+func NewWriteRequest(unitID, functionCode uint8, start uint16, values []Value) (Request, error) {
+	req := Request{
+		MBAP:         MBAP{UnitID: unitID},
+		FunctionCode: functionCode,
+		Data:         make([]byte, 2, 5+len(values)*2),
+	}
+	binary.BigEndian.PutUint16(req.Data[0:2], start)
+
+	limit := 1
+	switch functionCode {
+	case WriteMultipleCoils:
+		limit = maxWriteBits
+	case WriteMultipleRegisters:
+		limit = maxWriteRegisters
+	case WriteSingleCoil, WriteSingleRegister:
+	default:
+		return Request{}, fmt.Errorf("function code %d isn't a write function code", functionCode)
+	}
+
+	if len(values) < 1 || len(values) > limit {
+		return Request{}, fmt.Errorf("invalid number of values %d for function code %d", len(values), functionCode)
+	}
+
+	if int(start)+len(values) > addressSpace {
+		return Request{}, fmt.Errorf("values exceed address space")
+	}
+
+	var data []byte
+	switch functionCode {
+	case WriteSingleCoil:
+		data = []byte{0x0, 0x0}
+		if values[0].Bool() {
+			data = []byte{0xff, 0x0}
+		}
+	case WriteSingleRegister:
+		b, err := values[0].MarshalBinary()
+		if err != nil {
+			return Request{}, err
+		}
+		data = b
+	case WriteMultipleCoils:
+		coils := reduce(values)
+		data = append([]byte{byte(len(values) >> 8), byte(len(values)), byte(len(coils))}, coils...)
+	case WriteMultipleRegisters:
+		b, err := MarshalValues(values)
+		if err != nil {
+			return Request{}, err
+		}
+		data = append([]byte{byte(len(values) >> 8), byte(len(values)), byte(len(b))}, b...)
+	}
+
+	req.Data = append(req.Data, data...)
+	return req, nil
+}
+
+// MarshalBinary marshals a Request to its binary form. The length field of
+// the MBAP header is set to the length of the request, the transaction ID is
+// taken from the MBAP header as is.
+func (r *Request) MarshalBinary() ([]byte, error) {
+	if 8+len(r.Data) > maxADULength {
+		return nil, fmt.Errorf("failed to marshal request to its binary form: data of %d bytes is too long", len(r.Data))
+	}
+
+	r.Length = uint16(len(r.Data) + 2)
+
+	mbap, err := r.MBAP.MarshalBinary()
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal request to its binary form: %v", err)
+	}
+
+	return append(append(mbap, r.FunctionCode), r.Data...), nil
 }
 
 // UnmarshalBinary unmarshals binary representation of Request.
 func (r *Request) UnmarshalBinary(b []byte) error {
+	// A request consists of a MBAP header of 7 bytes and a function code.
+	if len(b) < 8 {
+		return fmt.Errorf("failed to unmarshal byte slice to request: byte slice has invalid length of %d", len(b))
+	}
+
 	if err := r.MBAP.UnmarshalBinary(b[0:7]); err != nil {
 		return err
 	}
@@ -228,6 +500,205 @@ func (r *Request) UnmarshalBinary(b []byte) error {
 	return nil
 }
 
+// validLength returns false if the length of the data of the request doesn't
+// match the length required by its function code. Requests of which the
+// length depends on a byte count are always valid, their handlers answer a
+// mismatching byte count with an IllegalDataValueError. So do requests with a
+// function code of which the length isn't known.
+func (r Request) validLength() bool {
+	switch r.FunctionCode {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters, WriteSingleCoil, WriteSingleRegister:
+		return len(r.Data) == 4
+	case ReadExceptionStatus, GetCommEventLog, ReportServerID:
+		return len(r.Data) == 0
+	case MaskWriteRegister:
+		return len(r.Data) == 6
+	case ReadFIFOQueue:
+		return len(r.Data) == 2
+	default:
+		return true
+	}
+}
+
+// Start returns the starting address of a request with function code 1, 2,
+// 3, 4, 5, 6, 15, 16, 22 or 23. For read/write multiple registers requests
+// it's the starting address of the read. It returns an IllegalDataValueError
+// when the data is too short.
+func (r Request) Start() (int, error) {
+	switch r.FunctionCode {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters,
+		WriteSingleCoil, WriteSingleRegister, WriteMultipleCoils, WriteMultipleRegisters,
+		MaskWriteRegister, ReadWriteMultipleRegisters:
+	default:
+		return 0, fmt.Errorf("function code %d has no starting address", r.FunctionCode)
+	}
+
+	if len(r.Data) < 2 {
+		return 0, IllegalDataValueError
+	}
+
+	return int(binary.BigEndian.Uint16(r.Data[:2])), nil
+}
+
+// Quantity returns the quantity of a request with function code 1, 2, 3, 4,
+// 5, 6, 15, 16 or 23. Requests with function code 5 and 6 always have a
+// quantity of 1. For read/write multiple registers requests it's the
+// quantity to read. It returns an IllegalDataValueError when the data is too
+// short.
+func (r Request) Quantity() (int, error) {
+	switch r.FunctionCode {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters,
+		WriteMultipleCoils, WriteMultipleRegisters, ReadWriteMultipleRegisters:
+	case WriteSingleCoil, WriteSingleRegister:
+		if len(r.Data) < 4 {
+			return 0, IllegalDataValueError
+		}
+		return 1, nil
+	default:
+		return 0, fmt.Errorf("function code %d has no quantity", r.FunctionCode)
+	}
+
+	if len(r.Data) < 4 {
+		return 0, IllegalDataValueError
+	}
+
+	return int(binary.BigEndian.Uint16(r.Data[2:4])), nil
+}
+
+// WriteValues returns the values written by a request with function code 5,
+// 6, 15, 16 or 23. Coils are returned as values of 0 or 1. It returns an
+// IllegalDataValueError when the data is malformed or the quantity is out of
+// range and an IllegalAddressError when the values don't fit in the address
+// space.
+func (r Request) WriteValues(s Signedness) ([]Value, error) {
+	return r.writeValues(s, false)
+}
+
+// writeValues is like WriteValues, but when lenient is true it accepts any
+// value of a write single coil request, non-zero values turn the coil on.
+func (r Request) writeValues(s Signedness, lenient bool) ([]Value, error) {
+	switch r.FunctionCode {
+	case WriteSingleCoil:
+		if len(r.Data) != 4 {
+			return nil, IllegalDataValueError
+		}
+
+		switch binary.BigEndian.Uint16(r.Data[2:4]) {
+		case 0x0000:
+			return []Value{Value{0}}, nil
+		case 0xff00:
+			return []Value{Value{1}}, nil
+		}
+
+		if !lenient {
+			return nil, IllegalDataValueError
+		}
+		return []Value{Value{1}}, nil
+	case WriteSingleRegister:
+		if len(r.Data) != 4 {
+			return nil, IllegalDataValueError
+		}
+
+		var v Value
+		if err := v.UnmarshalBinary(r.Data[2:4], s); err != nil {
+			return nil, fmt.Errorf("failed to decode value: %v", err)
+		}
+		return []Value{v}, nil
+	case WriteMultipleCoils:
+		// ================ ===============
+		// Field            Length (bytes)
+		// ================ ===============
+		// Starting Address 2
+		// Quantity         2
+		// Byte count       1
+		// Values           n
+		// ================ ===============
+		//
+		// Every byte contains 8 coils, the first coil is stored in the
+		// least significant bit of the first byte.
+		quantity, data, err := r.writeData(0, maxWriteBits, coilBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]Value, quantity)
+		for i := range values {
+			values[i] = Value{int(data[i/8]>>uint(i%8)) & 1}
+		}
+		return values, nil
+	case WriteMultipleRegisters:
+		// ================ ===============
+		// Field            Length (bytes)
+		// ================ ===============
+		// Starting Address 2
+		// Quantity         2
+		// Byte count       1
+		// Values           n
+		// ================ ===============
+		_, data, err := r.writeData(0, maxWriteRegisters, registerBytes)
+		if err != nil {
+			return nil, err
+		}
+		return UnmarshalValues(data, s)
+	case ReadWriteMultipleRegisters:
+		// ====================== ===============
+		// Field                  Length (bytes)
+		// ====================== ===============
+		// Read Starting Address  2
+		// Quantity to Read       2
+		// Write Starting Address 2
+		// Quantity to Write      2
+		// Write Byte count       1
+		// Write Values           n
+		// ====================== ===============
+		_, data, err := r.writeData(4, maxReadWriteRegisters, registerBytes)
+		if err != nil {
+			return nil, err
+		}
+		return UnmarshalValues(data, s)
+	}
+
+	return nil, fmt.Errorf("function code %d doesn't write values", r.FunctionCode)
+}
+
+// writeData returns the quantity and the values of a write request of which
+// the starting address of the write is located at offset. The address is
+// followed by the quantity, the byte count and the values. byteCount returns
+// the number of bytes required for a quantity.
+func (r Request) writeData(offset, limit int, byteCount func(quantity int) int) (int, []byte, error) {
+	if len(r.Data) < offset+5 {
+		return 0, nil, IllegalDataValueError
+	}
+
+	start := int(binary.BigEndian.Uint16(r.Data[offset : offset+2]))
+	quantity := int(binary.BigEndian.Uint16(r.Data[offset+2 : offset+4]))
+	if quantity < 1 || quantity > limit {
+		return 0, nil, IllegalDataValueError
+	}
+
+	n := byteCount(quantity)
+	data := r.Data[offset+5:]
+	if int(r.Data[offset+4]) != n || len(data) != n {
+		return 0, nil, IllegalDataValueError
+	}
+
+	if start+quantity > addressSpace {
+		return 0, nil, IllegalAddressError
+	}
+
+	return quantity, data, nil
+}
+
+// coilBytes returns the number of bytes required for quantity coils.
+func coilBytes(quantity int) int {
+	return (quantity + 7) / 8
+}
+
+// registerBytes returns the number of bytes required for quantity registers.
+func registerBytes(quantity int) int {
+	return quantity * 2
+}
+
 // Response is a Modbus response.
 type Response struct {
 	MBAP
@@ -235,6 +706,7 @@ type Response struct {
 	Data         []byte
 
 	exception bool
+	raw       bool
 }
 
 // NewResponse creates a Response for a Request.
@@ -245,16 +717,76 @@ func NewResponse(r Request, data []byte) *Response {
 		Data:         data,
 	}
 
-	resp.MBAP.Length = uint16(len(data) + 3)
-	switch r.FunctionCode {
-	case WriteSingleCoil, WriteSingleRegister, WriteMultipleRegisters:
-		resp.MBAP.Length = uint16(len(data) + 2)
+	// The length covers the unit ID, the function code, the optional byte
+	// count and the data.
+	resp.MBAP.Length = uint16(len(data) + 2)
+	if hasByteCount(r.FunctionCode) {
+		resp.MBAP.Length++
 	}
 
 	return resp
 }
 
-// NewErrorResponse creates a error response.
+// NewFIFOQueueResponse creates a response for a read FIFO queue request. It
+// returns IllegalDataValueError when the queue contains more than 31 values.
+func NewFIFOQueueResponse(r Request, values []Value) (*Response, error) {
+	if len(values) > 31 {
+		return nil, IllegalDataValueError
+	}
+
+	// The data of the response follows this format:
+	//
+	// ================ ===============
+	// Field            Length (bytes)
+	// ================ ===============
+	// Byte count       2
+	// FIFO count       2
+	// Values           n
+	// ================ ===============
+	data := make([]byte, 4, 4+len(values)*2)
+	binary.BigEndian.PutUint16(data[0:2], uint16(2+len(values)*2))
+	binary.BigEndian.PutUint16(data[2:4], uint16(len(values)))
+
+	for _, v := range values {
+		b, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+
+		data = append(data, b...)
+	}
+
+	return NewResponse(r, data), nil
+}
+
+// hasByteCount returns true if the data of a response with given function code
+// is prefixed with a byte count.
+func hasByteCount(functionCode uint8) bool {
+	switch functionCode {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters, GetCommEventLog, ReportServerID, ReadFileRecord, ReadWriteMultipleRegisters:
+		return true
+	}
+
+	return false
+}
+
+// NewRawResponse creates a Response for a Request. Unlike NewResponse, the
+// data is never prefixed with a byte count, it's marshaled verbatim. This is
+// useful for user-defined function codes.
+func NewRawResponse(r Request, data []byte) *Response {
+	resp := &Response{
+		MBAP:         r.MBAP,
+		FunctionCode: r.FunctionCode,
+		Data:         data,
+		raw:          true,
+	}
+
+	resp.MBAP.Length = uint16(len(data) + 2)
+	return resp
+}
+
+// NewErrorResponse creates a error response. If err isn't an Error and doesn't
+// wrap one, the response contains a SlaveDeviceFailureError.
 func NewErrorResponse(r Request, err error) *Response {
 	resp := &Response{
 		MBAP:         r.MBAP,
@@ -262,15 +794,81 @@ func NewErrorResponse(r Request, err error) *Response {
 		exception:    true,
 	}
 
-	resp.Data = []byte{5}
-	if err, ok := err.(Error); ok {
-		resp.Data = []byte{err.Code}
+	resp.Data = []byte{SlaveDeviceFailureError.Code}
+	var e Error
+	if errors.As(err, &e) {
+		resp.Data = []byte{e.Code}
 	}
 
 	resp.MBAP.Length = 3
 	return resp
 }
 
+// UnmarshalBinary unmarshals the binary representation of a Response. A
+// function code of 0x80 or higher marks an exception response. For function
+// codes of which the data of the response is prefixed with a byte count, the
+// byte count is verified and stripped from Data, like NewResponse expects it.
+func (r *Response) UnmarshalBinary(b []byte) error {
+	// A response consists of a MBAP header of 7 bytes and a function code.
+	if len(b) < 8 {
+		return fmt.Errorf("failed to unmarshal byte slice to response: byte slice has invalid length of %d", len(b))
+	}
+
+	if err := r.MBAP.UnmarshalBinary(b[0:7]); err != nil {
+		return err
+	}
+
+	// The length covers the unit ID and the PDU.
+	if int(r.Length) != len(b)-6 {
+		return fmt.Errorf("failed to unmarshal byte slice to response: length field of %d doesn't match length of %d", r.Length, len(b)-6)
+	}
+
+	r.FunctionCode = b[7]
+	r.exception = r.FunctionCode >= 0x80
+	r.raw = false
+	data := b[8:]
+
+	switch {
+	case r.exception:
+		if len(data) != 1 {
+			return fmt.Errorf("failed to unmarshal byte slice to response: exception response has %d bytes of data", len(data))
+		}
+	case hasByteCount(r.FunctionCode):
+		if len(data) < 1 || int(data[0]) != len(data)-1 {
+			return fmt.Errorf("failed to unmarshal byte slice to response: byte count doesn't match length of data")
+		}
+		data = data[1:]
+	}
+
+	r.Data = data
+	return nil
+}
+
+// Exception returns the exception code of an exception response. It returns
+// false for other responses.
+func (r *Response) Exception() (uint8, bool) {
+	if !r.exception || len(r.Data) != 1 {
+		return 0, false
+	}
+
+	return r.Data[0], true
+}
+
+// ExceptionCode returns the exception code of b, a response in its binary
+// form as written by a handler. It returns false when b isn't an exception
+// response. Middleware can use it to inspect the responses of the handlers it
+// wraps without parsing them.
+func ExceptionCode(b []byte) (uint8, bool) {
+	// A response consists of a MBAP header of 7 bytes, the function code
+	// and the data. The function code of an exception response has its
+	// highest bit set and is followed by the exception code.
+	if len(b) < 9 || b[7]&0x80 == 0 {
+		return 0, false
+	}
+
+	return b[8], true
+}
+
 // MarshalBinary marshals a Response to it binary form.
 func (r *Response) MarshalBinary() ([]byte, error) {
 	mbap, err := r.MBAP.MarshalBinary()
@@ -283,11 +881,8 @@ func (r *Response) MarshalBinary() ([]byte, error) {
 		r.FunctionCode,
 	}
 
-	switch r.FunctionCode {
-	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters:
-		if !r.exception {
-			data = append(data, uint8(len(r.Data)))
-		}
+	if !r.exception && !r.raw && hasByteCount(r.FunctionCode) {
+		data = append(data, uint8(len(r.Data)))
 	}
 
 	data = append(data, r.Data)
@@ -1,7 +1,10 @@
 package modbus
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -46,6 +49,100 @@ func TestValueSet(t *testing.T) {
 	}
 }
 
+func TestValueTypedGetters(t *testing.T) {
+	tests := []struct {
+		value  int
+		uint16 uint16
+		uerr   bool
+		int16  int16
+		ierr   bool
+	}{
+		{0, 0, false, 0, false},
+		{32767, 32767, false, 32767, false},
+		{32768, 32768, false, 0, true},
+		{65535, 65535, false, 0, true},
+		{-1, 0, true, -1, false},
+		{-32768, 0, true, -32768, false},
+	}
+
+	for _, test := range tests {
+		v, err := NewValue(test.value)
+		assert.Nil(t, err)
+
+		u, err := v.Uint16()
+		assert.Equal(t, test.uint16, u)
+		assert.Equal(t, test.uerr, err != nil)
+
+		i, err := v.Int16()
+		assert.Equal(t, test.int16, i)
+		assert.Equal(t, test.ierr, err != nil)
+	}
+}
+
+func TestValueTypedSetters(t *testing.T) {
+	var v Value
+
+	v.SetUint16(65535)
+	assert.Equal(t, 65535, v.Get())
+
+	v.SetInt16(-32768)
+	assert.Equal(t, -32768, v.Get())
+}
+
+func TestValueString(t *testing.T) {
+	assert.Equal(t, "498 (0x01F2)", Value{498}.String())
+	assert.Equal(t, "-1 (0xFFFF)", Value{-1}.String())
+	assert.Equal(t, "[0 (0x0000) 65535 (0xFFFF)]", fmt.Sprint([]Value{Value{0}, Value{65535}}))
+}
+
+func TestValueJSON(t *testing.T) {
+	values := []Value{Value{-32768}, Value{-1}, Value{0}, Value{498}, Value{65535}}
+
+	b, err := json.Marshal(values)
+	assert.Nil(t, err)
+	assert.Equal(t, "[-32768,-1,0,498,65535]", string(b))
+
+	var unmarshaled []Value
+	assert.Nil(t, json.Unmarshal(b, &unmarshaled))
+	assert.Equal(t, values, unmarshaled)
+
+	// Values are marshaled as numbers when embedded in structs too.
+	b, err = json.Marshal(struct{ V Value }{Value{-3}})
+	assert.Nil(t, err)
+	assert.Equal(t, `{"V":-3}`, string(b))
+
+	var v Value
+	assert.NotNil(t, json.Unmarshal([]byte("65536"), &v))
+	assert.NotNil(t, json.Unmarshal([]byte("-32769"), &v))
+	assert.NotNil(t, json.Unmarshal([]byte(`"1"`), &v))
+
+	text, err := Value{-12}.MarshalText()
+	assert.Nil(t, err)
+	assert.Equal(t, "-12", string(text))
+}
+
+func TestBoolValue(t *testing.T) {
+	on, off := NewBoolValue(true), NewBoolValue(false)
+	assert.Equal(t, 1, on.Get())
+	assert.Equal(t, 0, off.Get())
+
+	tests := []struct {
+		value    int
+		expected bool
+	}{
+		{0, false},
+		{1, true},
+		{-1, true},
+		{0xff00, true},
+	}
+
+	for _, test := range tests {
+		v, err := NewValue(test.value)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, v.Bool())
+	}
+}
+
 func TestMBAP(t *testing.T) {
 	tests := []struct {
 		mbap MBAP
@@ -95,6 +192,156 @@ func TestRequest(t *testing.T) {
 		assert.Nil(t, r.UnmarshalBinary(test.data))
 		assert.Equal(t, test.request, r)
 	}
+
+	// A request without function code is invalid.
+	var r Request
+	assert.NotNil(t, r.UnmarshalBinary([]byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x1, 0x3}))
+}
+
+func TestRequestMarshalBinary(t *testing.T) {
+	write := func(fc uint8, start uint16, values []Value) Request {
+		req, err := NewWriteRequest(1, fc, start, values)
+		assert.Nil(t, err)
+		return req
+	}
+
+	tests := []struct {
+		request Request
+		data    []byte
+	}{
+		{NewReadRequest(1, ReadCoils, 19, 19), []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x1, 0x1, 0x0, 0x13, 0x0, 0x13}},
+		{NewReadRequest(1, ReadInputRegisters, 8, 1), []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x1, 0x4, 0x0, 0x8, 0x0, 0x1}},
+		{write(WriteSingleCoil, 172, []Value{Value{1}}), []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x1, 0x5, 0x0, 0xac, 0xff, 0x0}},
+		{write(WriteSingleRegister, 1, []Value{Value{-2}}), []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x1, 0xff, 0xfe}},
+		{write(WriteMultipleCoils, 19, []Value{Value{1}, Value{0}, Value{1}, Value{1}, Value{0}, Value{0}, Value{1}, Value{1}, Value{1}, Value{0}}), []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x9, 0x1, 0xf, 0x0, 0x13, 0x0, 0xa, 0x2, 0xcd, 0x1}},
+		{write(WriteMultipleRegisters, 1, []Value{Value{10}, Value{258}}), []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xb, 0x1, 0x10, 0x0, 0x1, 0x0, 0x2, 0x4, 0x0, 0xa, 0x1, 0x2}},
+	}
+
+	for i, test := range tests {
+		test.request.TransactionID = uint16(i)
+		test.data[1] = uint8(i)
+
+		data, err := test.request.MarshalBinary()
+		assert.Nil(t, err)
+		assert.Equal(t, test.data, data)
+
+		var r Request
+		assert.Nil(t, r.UnmarshalBinary(data))
+		assert.Equal(t, test.request, r)
+		assert.True(t, r.validLength())
+	}
+
+	invalid := []struct {
+		functionCode uint8
+		start        uint16
+		values       []Value
+	}{
+		{ReadHoldingRegisters, 0, []Value{Value{1}}},
+		{WriteSingleRegister, 0, []Value{Value{1}, Value{2}}},
+		{WriteMultipleRegisters, 0, nil},
+		{WriteMultipleRegisters, 0, make([]Value, 124)},
+		{WriteMultipleCoils, 0xffff, make([]Value, 2)},
+	}
+
+	for _, test := range invalid {
+		_, err := NewWriteRequest(1, test.functionCode, test.start, test.values)
+		assert.NotNil(t, err)
+	}
+
+	r := Request{FunctionCode: 0x41, Data: make([]byte, 253)}
+	_, err := r.MarshalBinary()
+	assert.NotNil(t, err)
+}
+
+func TestRequestFields(t *testing.T) {
+	tests := []struct {
+		functionCode uint8
+		data         []byte
+		start        int
+		quantity     int
+		values       []Value
+	}{
+		{ReadCoils, []byte{0x0, 0x13, 0x0, 0x13}, 19, 19, nil},
+		{ReadHoldingRegisters, []byte{0x0, 0x6b, 0x0, 0x3}, 107, 3, nil},
+		{WriteSingleCoil, []byte{0x0, 0xac, 0xff, 0x0}, 172, 1, []Value{Value{1}}},
+		{WriteSingleRegister, []byte{0x0, 0x1, 0xff, 0xfe}, 1, 1, []Value{Value{-2}}},
+		{WriteMultipleCoils, []byte{0x0, 0x13, 0x0, 0xa, 0x2, 0xcd, 0x1}, 19, 10, []Value{Value{1}, Value{0}, Value{1}, Value{1}, Value{0}, Value{0}, Value{1}, Value{1}, Value{1}, Value{0}}},
+		{WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x0, 0xa, 0x1, 0x2}, 1, 2, []Value{Value{10}, Value{258}}},
+		{ReadWriteMultipleRegisters, []byte{0x0, 0x3, 0x0, 0x6, 0x0, 0xe, 0x0, 0x1, 0x2, 0x0, 0xff}, 3, 6, []Value{Value{255}}},
+	}
+
+	for _, test := range tests {
+		r := Request{FunctionCode: test.functionCode, Data: test.data}
+
+		start, err := r.Start()
+		assert.Nil(t, err)
+		assert.Equal(t, test.start, start)
+
+		quantity, err := r.Quantity()
+		assert.Nil(t, err)
+		assert.Equal(t, test.quantity, quantity)
+
+		values, err := r.WriteValues(Signed)
+		if test.values == nil {
+			assert.NotNil(t, err)
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, test.values, values)
+	}
+}
+
+func TestRequestFieldsInvalid(t *testing.T) {
+	// The fields don't exist for these function codes.
+	r := Request{FunctionCode: ReadExceptionStatus}
+	_, err := r.Start()
+	assert.NotNil(t, err)
+	_, err = r.Quantity()
+	assert.NotNil(t, err)
+	_, err = r.WriteValues(Unsigned)
+	assert.NotNil(t, err)
+
+	r = Request{FunctionCode: MaskWriteRegister, Data: []byte{0x0, 0x4, 0x0, 0xf2, 0x0, 0x25}}
+	start, err := r.Start()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, start)
+	_, err = r.Quantity()
+	assert.NotNil(t, err)
+
+	tests := []struct {
+		functionCode uint8
+		data         []byte
+		err          error
+	}{
+		// Data is too short.
+		{ReadCoils, []byte{0x0}, IllegalDataValueError},
+		{WriteSingleRegister, []byte{0x0, 0x1, 0x0}, IllegalDataValueError},
+		{WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x2}, IllegalDataValueError},
+		// Coil value must be 0x0000 or 0xff00.
+		{WriteSingleCoil, []byte{0x0, 0x1, 0x0, 0x1}, IllegalDataValueError},
+		// Byte count doesn't match the quantity.
+		{WriteMultipleCoils, []byte{0x0, 0x1, 0x0, 0x9, 0x1, 0xff}, IllegalDataValueError},
+		{WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x2, 0x2, 0x0, 0x1}, IllegalDataValueError},
+		// Data is longer than the byte count.
+		{WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x1, 0x2, 0x0, 0x1, 0x0}, IllegalDataValueError},
+		// Quantity is out of range.
+		{WriteMultipleRegisters, []byte{0x0, 0x1, 0x0, 0x0, 0x0}, IllegalDataValueError},
+		{ReadWriteMultipleRegisters, append([]byte{0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x7a, 0xf4}, make([]byte, 244)...), IllegalDataValueError},
+		// Values exceed the address space.
+		{WriteMultipleRegisters, []byte{0xff, 0xff, 0x0, 0x2, 0x4, 0x0, 0x1, 0x0, 0x2}, IllegalAddressError},
+		{ReadWriteMultipleRegisters, []byte{0x0, 0x0, 0x0, 0x1, 0xff, 0xff, 0x0, 0x2, 0x4, 0x0, 0x1, 0x0, 0x2}, IllegalAddressError},
+	}
+
+	for _, test := range tests {
+		r := Request{FunctionCode: test.functionCode, Data: test.data}
+		var err error
+		if test.functionCode == ReadCoils {
+			_, err = r.Quantity()
+		} else {
+			_, err = r.WriteValues(Unsigned)
+		}
+		assert.Equal(t, test.err, err)
+	}
 }
 
 func TestResponse(t *testing.T) {
@@ -115,13 +362,104 @@ func TestResponse(t *testing.T) {
 	}{
 		{NewErrorResponse(request, IllegalFunctionError), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x03, 0x3, 0x84, 0x1}},
 		{NewErrorResponse(request, AcknowledgeError), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x03, 0x3, 0x84, 0x5}},
+		{NewErrorResponse(request, errors.New("failed")), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x03, 0x3, 0x84, 0x4}},
+		{NewErrorResponse(request, NewError(0x20, "vendor specific")), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x03, 0x3, 0x84, 0x20}},
+		{NewErrorResponse(request, fmt.Errorf("pump 3: %w", IllegalAddressError)), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x03, 0x3, 0x84, 0x2}},
+		{NewErrorResponse(request, fmt.Errorf("station 1: %w", fmt.Errorf("pump 3: %w", SlaveDeviceBusyError))), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x03, 0x3, 0x84, 0x6}},
 		{NewResponse(request, []byte{0x24, 0x41}), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x05, 0x3, 0x4, 0x2, 0x24, 0x41}},
 		{NewResponse(request, []byte{0x1, 0x9, 0x12, 0x3}), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x07, 0x3, 0x4, 0x4, 0x1, 0x9, 0x12, 0x3}},
+		{NewResponse(Request{MBAP: request.MBAP, FunctionCode: ReadExceptionStatus}, []byte{0x6d}), []byte{0x0, 0x1, 0x0, 0x1, 0x0, 0x03, 0x3, 0x7, 0x6d}},
 	}
 
 	for _, test := range tests {
 		data, err := test.response.MarshalBinary()
 		assert.Nil(t, err)
 		assert.Equal(t, test.data, data)
+
+		var r Response
+		assert.Nil(t, r.UnmarshalBinary(data))
+		assert.Equal(t, test.response, &r)
+	}
+}
+
+func TestResponseUnmarshalBinary(t *testing.T) {
+	var r Response
+	assert.Nil(t, r.UnmarshalBinary([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x1, 0x83, 0x2}))
+	assert.Equal(t, uint8(0x83), r.FunctionCode)
+	code, ok := r.Exception()
+	assert.True(t, ok)
+	assert.Equal(t, ExceptionIllegalAddress, code)
+
+	// The response of a write echoes the request.
+	assert.Nil(t, r.UnmarshalBinary([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x1, 0x0, 0x3}))
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x3}, r.Data)
+	_, ok = r.Exception()
+	assert.False(t, ok)
+
+	invalid := [][]byte{
+		// Function code is missing.
+		{0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x1},
+		// Length field doesn't match.
+		{0x0, 0x1, 0x0, 0x0, 0x0, 0x4, 0x1, 0x3, 0x2, 0x0, 0xa},
+		// Byte count doesn't match.
+		{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x4, 0x0, 0xa},
+		{0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x1, 0x3},
+		// Exception response without exception code.
+		{0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x1, 0x83},
+	}
+
+	for _, b := range invalid {
+		assert.NotNil(t, r.UnmarshalBinary(b))
 	}
 }
+
+func TestExceptionCode(t *testing.T) {
+	tests := []struct {
+		b    []byte
+		code uint8
+		ok   bool
+	}{
+		{[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x1, 0x83, 0x2}, ExceptionIllegalAddress, true},
+		{[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, 0, false},
+		{[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x1, 0x83}, 0, false},
+		{nil, 0, false},
+	}
+
+	for _, test := range tests {
+		code, ok := ExceptionCode(test.b)
+		assert.Equal(t, test.code, code)
+		assert.Equal(t, test.ok, ok)
+	}
+}
+
+func TestNewError(t *testing.T) {
+	err := NewError(0x2f, "vendor specific")
+	assert.Equal(t, uint8(0x2f), err.Code)
+	assert.Equal(t, "Modbus exception code: 47: vendor specific", err.Error())
+
+	assert.Equal(t, ExceptionIllegalAddress, IllegalAddressError.Code)
+	assert.Panics(t, func() { NewError(0, "invalid") })
+}
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("station 1: %w", fmt.Errorf("pump 3: %w", IllegalAddressError))
+
+	assert.True(t, errors.Is(err, IllegalAddressError))
+	assert.True(t, errors.Is(err, NewError(ExceptionIllegalAddress, "other message")))
+	assert.False(t, errors.Is(err, IllegalDataValueError))
+
+	var e Error
+	assert.True(t, errors.As(err, &e))
+	assert.Equal(t, ExceptionIllegalAddress, e.Code)
+}
+
+func TestRequestContext(t *testing.T) {
+	var r Request
+	assert.Equal(t, context.Background(), r.Context())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	assert.Equal(t, ctx, r.WithContext(ctx).Context())
+	assert.Equal(t, context.Background(), r.Context())
+}
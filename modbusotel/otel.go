@@ -0,0 +1,124 @@
+// Package modbusotel traces requests of a goldfish server with OpenTelemetry.
+package modbusotel
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+
+	modbus "github.com/advancedclimatesystems/goldfish"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the name of the tracer, which is the import path of this
+// package.
+const tracerName = "github.com/advancedclimatesystems/goldfish/modbusotel"
+
+// Handler is a modbus.Handler creating a span for every request it handles.
+type Handler struct {
+	handler modbus.Handler
+	tracer  trace.Tracer
+}
+
+// NewHandler creates a Handler tracing the requests handled by h using a
+// tracer of tp. The context of the request passed to h contains the span, so
+// context-aware handlers can create child spans.
+func NewHandler(h modbus.Handler, tp trace.TracerProvider) *Handler {
+	return &Handler{
+		handler: h,
+		tracer:  tp.Tracer(tracerName),
+	}
+}
+
+// Middleware returns middleware wrapping handlers in a Handler, so all
+// requests of a server are traced:
+//
+//	s.Use(modbusotel.Middleware(tp))
+func Middleware(tp trace.TracerProvider) modbus.Middleware {
+	return func(h modbus.Handler) modbus.Handler {
+		return NewHandler(h, tp)
+	}
+}
+
+// ServeModbus handles a Modbus request within a span.
+func (h Handler) ServeModbus(w io.Writer, req modbus.Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h Handler) ServeModbusE(w io.Writer, req modbus.Request) error {
+	ctx, span := h.tracer.Start(req.Context(), fmt.Sprintf("modbus function %d", req.FunctionCode),
+		trace.WithSpanKind(trace.SpanKindServer),
+		trace.WithAttributes(attributes(req)...),
+	)
+	defer span.End()
+
+	rw := &exceptionWriter{w: w}
+	err := serveModbusE(h.handler, rw, req.WithContext(ctx))
+
+	if rw.exception != 0 {
+		span.SetAttributes(attribute.Int("modbus.exception_code", int(rw.exception)))
+		span.SetStatus(codes.Error, fmt.Sprintf("exception response with code %d", rw.exception))
+	}
+
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	return err
+}
+
+// serveModbusE lets h handle req. It returns the error of h when h implements
+// modbus.HandlerE.
+func serveModbusE(h modbus.Handler, w io.Writer, req modbus.Request) error {
+	if he, ok := h.(modbus.HandlerE); ok {
+		return he.ServeModbusE(w, req)
+	}
+
+	h.ServeModbus(w, req)
+	return nil
+}
+
+// attributes returns the span attributes of req. The address and quantity
+// are only included for function codes which have them.
+func attributes(req modbus.Request) []attribute.KeyValue {
+	attrs := []attribute.KeyValue{
+		attribute.Int("modbus.transaction_id", int(req.TransactionID)),
+		attribute.Int("modbus.unit_id", int(req.UnitID)),
+		attribute.Int("modbus.function_code", int(req.FunctionCode)),
+	}
+
+	switch req.FunctionCode {
+	case modbus.ReadCoils, modbus.ReadDiscreteInputs, modbus.ReadHoldingRegisters, modbus.ReadInputRegisters,
+		modbus.WriteMultipleCoils, modbus.WriteMultipleRegisters, modbus.ReadWriteMultipleRegisters:
+		if len(req.Data) >= 4 {
+			attrs = append(attrs,
+				attribute.Int("modbus.address", int(binary.BigEndian.Uint16(req.Data[0:2]))),
+				attribute.Int("modbus.quantity", int(binary.BigEndian.Uint16(req.Data[2:4]))),
+			)
+		}
+	case modbus.WriteSingleCoil, modbus.WriteSingleRegister, modbus.MaskWriteRegister, modbus.ReadFIFOQueue:
+		if len(req.Data) >= 2 {
+			attrs = append(attrs, attribute.Int("modbus.address", int(binary.BigEndian.Uint16(req.Data[0:2]))))
+		}
+	}
+
+	return attrs
+}
+
+// exceptionWriter remembers the exception code of the response written to w.
+type exceptionWriter struct {
+	w         io.Writer
+	exception uint8
+}
+
+func (e *exceptionWriter) Write(b []byte) (int, error) {
+	if code, ok := modbus.ExceptionCode(b); ok {
+		e.exception = code
+	}
+
+	return e.w.Write(b)
+}
@@ -0,0 +1,114 @@
+package modbusotel
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+
+	modbus "github.com/advancedclimatesystems/goldfish"
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// handlerFunc is a modbus.Handler calling itself.
+type handlerFunc func(w io.Writer, req modbus.Request)
+
+func (f handlerFunc) ServeModbus(w io.Writer, req modbus.Request) {
+	f(w, req)
+}
+
+func TestHandler(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	var spanInContext bool
+	h := NewHandler(handlerFunc(func(w io.Writer, req modbus.Request) {
+		spanInContext = trace.SpanFromContext(req.Context()) != nil
+
+		resp := modbus.NewErrorResponse(req, modbus.IllegalAddressError)
+		data, err := resp.MarshalBinary()
+		assert.Nil(t, err)
+		_, err = w.Write(data)
+		assert.Nil(t, err)
+	}), tp)
+
+	req := modbus.Request{
+		MBAP: modbus.MBAP{
+			TransactionID: 1,
+			Length:        6,
+			UnitID:        2,
+		},
+		FunctionCode: modbus.ReadHoldingRegisters,
+		Data:         []byte{0x0, 0x10, 0x0, 0x3},
+	}
+
+	w := new(bytes.Buffer)
+	h.ServeModbus(w, req)
+
+	assert.True(t, spanInContext)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x2, 0x83, 0x2}, w.Bytes())
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, "modbus function 3", spans[0].Name())
+	assert.Equal(t, trace.SpanKindServer, spans[0].SpanKind())
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+	assert.Equal(t, []attribute.KeyValue{
+		attribute.Int("modbus.transaction_id", 1),
+		attribute.Int("modbus.unit_id", 2),
+		attribute.Int("modbus.function_code", 3),
+		attribute.Int("modbus.address", 16),
+		attribute.Int("modbus.quantity", 3),
+		attribute.Int("modbus.exception_code", 2),
+	}, spans[0].Attributes())
+}
+
+// handlerE is a modbus.HandlerE failing to write the response.
+type handlerE struct {
+	handlerFunc
+	err error
+}
+
+func (h handlerE) ServeModbusE(w io.Writer, req modbus.Request) error {
+	h.handlerFunc(w, req)
+	return h.err
+}
+
+func TestHandlerWriteFailure(t *testing.T) {
+	recorder := tracetest.NewSpanRecorder()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))
+
+	writeErr := errors.New("write failed")
+	h := Middleware(tp)(handlerE{handlerFunc(func(w io.Writer, req modbus.Request) {}), writeErr})
+
+	// The error is passed on, so the server closes the connection.
+	he, ok := h.(modbus.HandlerE)
+	if assert.True(t, ok) {
+		assert.Equal(t, writeErr, he.ServeModbusE(new(bytes.Buffer), modbus.Request{FunctionCode: modbus.ReadCoils}))
+	}
+
+	spans := recorder.Ended()
+	assert.Len(t, spans, 1)
+	assert.Equal(t, codes.Error, spans[0].Status().Code)
+}
+
+func TestAttributes(t *testing.T) {
+	tests := []struct {
+		req      modbus.Request
+		expected int
+	}{
+		{modbus.Request{FunctionCode: modbus.WriteSingleRegister, Data: []byte{0x0, 0x1, 0x0, 0x2}}, 4},
+		{modbus.Request{FunctionCode: modbus.ReadExceptionStatus}, 3},
+		// Too short to contain an address and quantity.
+		{modbus.Request{FunctionCode: modbus.ReadCoils, Data: []byte{0x0}}, 3},
+	}
+
+	for _, test := range tests {
+		assert.Len(t, attributes(test.req), test.expected)
+	}
+}
@@ -0,0 +1,24 @@
+package modbusprom_test
+
+import (
+	"log"
+	"net/http"
+
+	modbus "github.com/advancedclimatesystems/goldfish"
+	"github.com/advancedclimatesystems/goldfish/modbusprom"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+func ExampleNew() {
+	s, err := modbus.NewServer(":502")
+	if err != nil {
+		log.Fatal(err)
+	}
+	s.Instrument(modbusprom.New(prometheus.DefaultRegisterer))
+
+	http.Handle("/metrics", promhttp.Handler())
+	go http.ListenAndServe(":9100", nil)
+
+	s.Listen()
+}
@@ -0,0 +1,79 @@
+// Package modbusprom exports metrics of a goldfish server to Prometheus.
+package modbusprom
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Collector collects metrics of a server. It implements
+// modbus.Instrumentation, so it's wired up like this:
+//
+//	s.Instrument(modbusprom.New(prometheus.DefaultRegisterer))
+type Collector struct {
+	requests    *prometheus.CounterVec
+	exceptions  *prometheus.CounterVec
+	duration    *prometheus.HistogramVec
+	connections prometheus.Gauge
+}
+
+// New creates a Collector and registers its metrics with r. It panics when
+// the metrics can't be registered, for example because they're registered
+// already.
+func New(r prometheus.Registerer) *Collector {
+	c := &Collector{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "modbus",
+			Name:      "requests_total",
+			Help:      "Number of requests handled, by function code.",
+		}, []string{"function_code"}),
+		exceptions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "modbus",
+			Name:      "exceptions_total",
+			Help:      "Number of exception responses, by function code and exception code.",
+		}, []string{"function_code", "exception_code"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "modbus",
+			Name:      "request_duration_seconds",
+			Help:      "Duration of handling requests, by function code.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"function_code"}),
+		connections: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: "modbus",
+			Name:      "open_connections",
+			Help:      "Number of open connections.",
+		}),
+	}
+
+	r.MustRegister(c.requests, c.exceptions, c.duration, c.connections)
+
+	return c
+}
+
+// ConnectionOpened increments the number of open connections.
+func (c *Collector) ConnectionOpened(addr net.Addr) {
+	c.connections.Inc()
+}
+
+// ConnectionClosed decrements the number of open connections.
+func (c *Collector) ConnectionClosed(addr net.Addr) {
+	c.connections.Dec()
+}
+
+// RequestStarted does nothing, requests are counted when they complete.
+func (c *Collector) RequestStarted(functionCode, unitID uint8) {}
+
+// RequestCompleted counts the request and observes its duration.
+func (c *Collector) RequestCompleted(functionCode uint8, dur time.Duration, exception uint8) {
+	fc := strconv.Itoa(int(functionCode))
+
+	c.requests.WithLabelValues(fc).Inc()
+	c.duration.WithLabelValues(fc).Observe(dur.Seconds())
+
+	if exception != 0 {
+		c.exceptions.WithLabelValues(fc, strconv.Itoa(int(exception))).Inc()
+	}
+}
@@ -0,0 +1,95 @@
+package modbusprom
+
+import (
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	modbus "github.com/advancedclimatesystems/goldfish"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+)
+
+// pipeListener is a net.Listener returning connections created with
+// net.Pipe.
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l pipeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, errors.New("listener is closed")
+	}
+
+	return c, nil
+}
+
+func (l pipeListener) Close() error {
+	close(l.conns)
+	return nil
+}
+
+func (l pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "pipe"} }
+
+func TestCollector(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	c := New(registry)
+
+	var s modbus.Server
+	s.Instrument(c)
+	s.Handle(modbus.ReadHoldingRegisters, modbus.NewReadHandler(func(unitID, start, quantity int) ([]modbus.Value, error) {
+		if start > 0 {
+			return nil, modbus.IllegalAddressError
+		}
+		v, err := modbus.NewValue(0xa)
+		return []modbus.Value{v}, err
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+	defer s.Close()
+
+	client, server := net.Pipe()
+	l.conns <- server
+
+	requests := []struct {
+		req    []byte
+		length int
+	}{
+		{[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}, 11},
+		{[]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}, 11},
+		{[]byte{0x0, 0x3, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x1, 0x0, 0x1}, 9},
+	}
+
+	for _, r := range requests {
+		_, err := client.Write(r.req)
+		assert.Nil(t, err)
+		_, err = io.ReadFull(client, make([]byte, r.length))
+		assert.Nil(t, err)
+	}
+
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.connections))
+
+	// The connection is reported as closed after the last request has
+	// completed.
+	assert.Nil(t, client.Close())
+	for i := 0; testutil.ToFloat64(c.connections) != 0; i++ {
+		if i == 100 {
+			t.Fatal("connection hasn't been reported as closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	assert.Equal(t, 3.0, testutil.ToFloat64(c.requests.WithLabelValues("3")))
+	assert.Equal(t, 1.0, testutil.ToFloat64(c.exceptions.WithLabelValues("3", "2")))
+	assert.Equal(t, 1, testutil.CollectAndCount(c.duration))
+
+	// All metrics have been registered.
+	n, err := testutil.GatherAndCount(registry)
+	assert.Nil(t, err)
+	assert.Equal(t, 4, n)
+}
@@ -0,0 +1,125 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// WithPipelining lets the server execute up to n requests of a single
+// connection concurrently. It speeds up clients which send several requests
+// before reading the responses. Responses are written in the order the
+// requests complete, which might differ from the order they were received;
+// clients match them using the transaction ID. By default requests are
+// executed one at a time.
+func WithPipelining(n int) Option {
+	return func(s *Server) {
+		s.pipelining = n
+	}
+}
+
+// pipeline executes the requests of a single connection concurrently. The
+// responses are buffered and written one at a time, so they don't
+// interleave.
+type pipeline struct {
+	s    *Server
+	conn io.ReadWriteCloser
+	sem  chan struct{}
+	wg   sync.WaitGroup
+
+	// mu serializes writes to conn, err is the first write error.
+	mu  sync.Mutex
+	err error
+}
+
+func newPipeline(s *Server, conn io.ReadWriteCloser) *pipeline {
+	return &pipeline{
+		s:    s,
+		conn: conn,
+		sem:  make(chan struct{}, s.pipelining),
+	}
+}
+
+// execute executes req in its own goroutine. It blocks while the maximum
+// number of requests are being executed.
+func (p *pipeline) execute(ctx context.Context, req Request) {
+	p.sem <- struct{}{}
+	p.wg.Add(1)
+	p.s.setConnActive(p.conn, true)
+
+	go func() {
+		defer func() {
+			p.s.setConnActive(p.conn, false)
+			p.wg.Done()
+			<-p.sem
+		}()
+
+		reqCtx, cancel := p.s.requestContext(ctx)
+		defer cancel()
+		req.ctx = reqCtx
+
+		buf := new(bytes.Buffer)
+		w := &errWriter{w: buf, l: p.s.logger()}
+		if err := p.s.instrumentedExecute(w, &req); err != nil {
+			p.fail(fmt.Errorf("something went horribly wrong and server has to close connection: %v", err))
+			return
+		}
+
+		// Dropped requests aren't answered.
+		if buf.Len() > 0 {
+			p.write(buf.Bytes())
+		}
+	}()
+}
+
+// write writes a response to the connection. A failing write closes the
+// connection.
+func (p *pipeline) write(b []byte) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err != nil {
+		return
+	}
+
+	if err := p.s.extendWriteDeadline(p.conn); err != nil {
+		p.closeWithError(fmt.Errorf("failed to set write deadline: %v", err))
+		return
+	}
+
+	n, err := p.conn.Write(b)
+	p.s.stats.written(n)
+	if err != nil {
+		p.closeWithError(fmt.Errorf("failed to write response: %v", err))
+	}
+}
+
+// fail closes the connection with err.
+func (p *pipeline) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.err == nil {
+		p.closeWithError(err)
+	}
+}
+
+// closeWithError remembers err and closes the connection, so reading the
+// next request fails too. The caller must hold the mutex.
+func (p *pipeline) closeWithError(err error) {
+	p.err = err
+	_ = p.conn.Close()
+}
+
+// wait waits until all requests have been executed. It returns the error
+// which caused the connection to be closed, if any.
+func (p *pipeline) wait() error {
+	p.wg.Wait()
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.err
+}
@@ -0,0 +1,174 @@
+package modbus
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+)
+
+// RangeMux dispatches reads and writes of a unit to handler funcs based on
+// the address, for example when different address ranges are backed by
+// different subsystems. Requests spanning several ranges are split into a
+// call per range. Its methods Read and Write can be used as ReadHandlerFunc
+// and WriteHandlerFunc:
+//
+//	mux := modbus.NewRangeMux()
+//	mux.HandleRange(0, 1000, tags.Read, tags.Write)
+//	mux.HandleRange(1000, 1000, db.Read, nil)
+//	s.Handle(modbus.ReadHoldingRegisters, modbus.NewReadHandler(mux.Read))
+//	s.Handle(modbus.WriteMultipleRegisters, modbus.NewWriteHandler(mux.Write, modbus.Unsigned))
+//
+// Ranges can be registered while the mux is serving requests.
+type RangeMux struct {
+	mu sync.RWMutex
+
+	// ranges is sorted by start address.
+	ranges         []addrRange
+	rejectSpanning bool
+}
+
+type addrRange struct {
+	start int
+	count int
+	read  ReadHandlerFunc
+	write WriteHandlerFunc
+}
+
+func (r addrRange) end() int {
+	return r.start + r.count
+}
+
+// segment is the part of a request which falls in a single range.
+type segment struct {
+	r     addrRange
+	start int
+	count int
+}
+
+// NewRangeMux creates a new RangeMux. Requests touching addresses without
+// handler funcs are answered with an IllegalAddressError.
+func NewRangeMux() *RangeMux {
+	return &RangeMux{}
+}
+
+// HandleRange registers the handler funcs for count addresses starting at
+// start. The funcs receive the unit ID and the addresses of the request, not
+// addresses relative to start. When read or write is nil, reads or writes of
+// the range are answered with an IllegalAddressError. It returns an error when
+// the range overlaps a registered range.
+func (m *RangeMux) HandleRange(start, count int, read ReadHandlerFunc, write WriteHandlerFunc) error {
+	if start < 0 || count < 1 || start+count > addressSpace {
+		return fmt.Errorf("range of %d addresses starting at %d is invalid", count, start)
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	r := addrRange{start: start, count: count, read: read, write: write}
+	i := sort.Search(len(m.ranges), func(i int) bool { return m.ranges[i].start >= start })
+
+	if (i > 0 && m.ranges[i-1].end() > start) || (i < len(m.ranges) && m.ranges[i].start < r.end()) {
+		return fmt.Errorf("range of %d addresses starting at %d overlaps another range", count, start)
+	}
+
+	m.ranges = append(m.ranges[:i], append([]addrRange{r}, m.ranges[i:]...)...)
+	return nil
+}
+
+// SetRejectSpanning makes the mux answer requests spanning several ranges
+// with an IllegalAddressError instead of splitting them.
+func (m *RangeMux) SetRejectSpanning(reject bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.rejectSpanning = reject
+}
+
+// segments splits quantity addresses starting at start into segments per
+// range. It returns an IllegalAddressError when an address has no range or
+// when the addresses span several ranges and those are rejected.
+func (m *RangeMux) segments(start, quantity int) ([]segment, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var segments []segment
+
+	for addr := start; addr < start+quantity; {
+		i := sort.Search(len(m.ranges), func(i int) bool { return m.ranges[i].end() > addr })
+		if i == len(m.ranges) || m.ranges[i].start > addr {
+			return nil, IllegalAddressError
+		}
+
+		r := m.ranges[i]
+		count := start + quantity - addr
+		if r.end()-addr < count {
+			count = r.end() - addr
+		}
+
+		segments = append(segments, segment{r: r, start: addr, count: count})
+		addr += count
+	}
+
+	if m.rejectSpanning && len(segments) > 1 {
+		return nil, IllegalAddressError
+	}
+
+	return segments, nil
+}
+
+// Read reads quantity values starting at start using the read funcs of the
+// ranges containing those addresses and returns the values in order.
+func (m *RangeMux) Read(unitID, start, quantity int) ([]Value, error) {
+	segments, err := m.segments(start, quantity)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, s := range segments {
+		if s.r.read == nil {
+			return nil, IllegalAddressError
+		}
+	}
+
+	values := make([]Value, 0, quantity)
+	for _, s := range segments {
+		v, err := s.r.read(unitID, s.start, s.count)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(v) != s.count {
+			return nil, fmt.Errorf("read func of addresses %d through %d returned %d values instead of %d", s.r.start, s.r.end()-1, len(v), s.count)
+		}
+
+		values = append(values, v...)
+	}
+
+	return values, nil
+}
+
+// Write writes values starting at start using the write funcs of the ranges
+// containing those addresses. The ranges are written in order of address and
+// writing stops at the first error, so ranges before the failing one have been
+// written. Use NewTransactionalWriteHandler to write all ranges or none.
+func (m *RangeMux) Write(unitID, start int, values []Value) error {
+	segments, err := m.segments(start, len(values))
+	if err != nil {
+		return err
+	}
+
+	for _, s := range segments {
+		if s.r.write == nil {
+			return IllegalAddressError
+		}
+	}
+
+	for _, s := range segments {
+		offset := s.start - start
+		if err := s.r.write(unitID, s.start, values[offset:offset+s.count]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
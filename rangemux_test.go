@@ -0,0 +1,117 @@
+package modbus
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRangeMux(t *testing.T) {
+	type call struct {
+		start    int
+		quantity int
+	}
+
+	var calls []call
+	read := func(base int) ReadHandlerFunc {
+		return func(unitID, start, quantity int) ([]Value, error) {
+			calls = append(calls, call{start, quantity})
+
+			values := make([]Value, quantity)
+			for i := range values {
+				values[i] = Value{base + start + i}
+			}
+			return values, nil
+		}
+	}
+
+	written := make(map[int]Value)
+	write := func(unitID, start int, values []Value) error {
+		calls = append(calls, call{start, len(values)})
+		for i, v := range values {
+			written[start+i] = v
+		}
+		return nil
+	}
+
+	mux := NewRangeMux()
+	assert.Nil(t, mux.HandleRange(1000, 1000, read(10000), write))
+	assert.Nil(t, mux.HandleRange(0, 1000, read(0), write))
+	assert.Nil(t, mux.HandleRange(4000, 61536, read(20000), nil))
+
+	assert.NotNil(t, mux.HandleRange(1999, 2, read(0), nil))
+	assert.NotNil(t, mux.HandleRange(3000, 1001, read(0), nil))
+	assert.NotNil(t, mux.HandleRange(0, 0, read(0), nil))
+	assert.NotNil(t, mux.HandleRange(65535, 2, read(0), nil))
+
+	values, err := mux.Read(1, 10, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []Value{{10}, {11}}, values)
+	assert.Equal(t, []call{{10, 2}}, calls)
+
+	// A read spanning two ranges is split.
+	calls = nil
+	values, err = mux.Read(1, 998, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []Value{{998}, {999}, {11000}, {11001}}, values)
+	assert.Equal(t, []call{{998, 2}, {1000, 2}}, calls)
+
+	// Addresses 2000 through 3999 aren't mapped.
+	calls = nil
+	_, err = mux.Read(1, 1999, 2)
+	assert.Equal(t, IllegalAddressError, err)
+	_, err = mux.Read(1, 3999, 2)
+	assert.Equal(t, IllegalAddressError, err)
+	assert.Nil(t, calls)
+
+	assert.Nil(t, mux.Write(1, 999, []Value{{1}, {2}, {3}}))
+	assert.Equal(t, []call{{999, 1}, {1000, 2}}, calls)
+	assert.Equal(t, map[int]Value{999: {1}, 1000: {2}, 1001: {3}}, written)
+
+	// The computed range can't be written.
+	assert.Equal(t, IllegalAddressError, mux.Write(1, 4000, []Value{{1}}))
+
+	mux.SetRejectSpanning(true)
+	calls = nil
+	_, err = mux.Read(1, 998, 4)
+	assert.Equal(t, IllegalAddressError, err)
+	assert.Equal(t, IllegalAddressError, mux.Write(1, 999, []Value{{1}, {2}}))
+	assert.Nil(t, calls)
+
+	values, err = mux.Read(1, 1998, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []Value{{11998}, {11999}}, values)
+
+	buf := new(bytes.Buffer)
+	NewReadHandler(mux.Read).ServeModbus(buf, Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x7, 0xcf, 0x0, 0x2}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x2}, buf.Bytes())
+}
+
+func TestRangeMuxConcurrency(t *testing.T) {
+	read := func(unitID, start, quantity int) ([]Value, error) {
+		return make([]Value, quantity), nil
+	}
+
+	mux := NewRangeMux()
+	assert.Nil(t, mux.HandleRange(0, 10, read, nil))
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 1; i < 100; i++ {
+			assert.Nil(t, mux.HandleRange(i*10, 10, read, nil))
+			mux.SetRejectSpanning(i%2 == 0)
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			_, err := mux.Read(1, 0, 10)
+			assert.Nil(t, err)
+		}
+	}()
+	wg.Wait()
+}
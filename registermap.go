@@ -0,0 +1,457 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Format is the file format of a register map.
+type Format int
+
+const (
+	// CSV register maps have a header naming the columns, followed by a
+	// line per entry:
+	//
+	//	address,count,table,value,name,access
+	//	0,1,holding registers,498,setpoint,read-write
+	//	9000,50,holding registers,0,serial number,read-only
+	//
+	// The address and table columns are required. The other columns may
+	// be left out or empty: count defaults to 1, value to 0 and access to
+	// read-write.
+	CSV Format = iota
+
+	// JSON register maps are an array of objects with the same fields as
+	// the columns of a CSV register map:
+	//
+	//	[
+	//		{"address": 0, "table": "holding registers", "value": 498, "name": "setpoint"},
+	//		{"address": 9000, "count": 50, "table": "holding registers", "access": "read-only"}
+	//	]
+	JSON
+)
+
+// registerMapEntry is an entry of a register map, describing count addresses
+// of a table starting at address. All addresses get value as initial value.
+type registerMapEntry struct {
+	Address int    `json:"address"`
+	Count   int    `json:"count,omitempty"`
+	Table   Table  `json:"table"`
+	Value   Value  `json:"value"`
+	Name    string `json:"name,omitempty"`
+	Access  Access `json:"access,omitempty"`
+
+	// line is the line of the register map the entry starts on.
+	line int
+}
+
+func (e registerMapEntry) validate() error {
+	if e.Address < 0 || e.Count < 1 || e.Address+e.Count > addressSpace {
+		return fmt.Errorf("addresses %d through %d are out of range", e.Address, e.Address+e.Count-1)
+	}
+
+	bit := e.Table == Coils || e.Table == DiscreteInputs
+	if bit && e.Value.Get() != 0 && e.Value.Get() != 1 {
+		return fmt.Errorf("value of %s must be 0 or 1, not %d", e.Table, e.Value.Get())
+	}
+
+	if e.Access != ReadWrite && e.Table != HoldingRegisters {
+		return fmt.Errorf("access of %s can't be %s", e.Table, e.Access)
+	}
+
+	return nil
+}
+
+// RegisterMap is a MemoryHandler configured by a register map, which names
+// the addresses of the device.
+type RegisterMap struct {
+	*MemoryHandler
+
+	format  Format
+	entries []registerMapEntry
+}
+
+// LoadRegisterMap reads a register map in the given format from r and creates
+// a RegisterMap with the addresses, initial values and access of its entries.
+// It returns an error mentioning the line of the entry when an entry is
+// invalid or when it defines an address which is already defined by another
+// entry.
+func LoadRegisterMap(r io.Reader, format Format) (*RegisterMap, error) {
+	entries, err := readRegisterMap(r, format)
+	if err != nil {
+		return nil, err
+	}
+
+	h, err := newRegisterMapHandler(entries)
+	if err != nil {
+		return nil, err
+	}
+
+	return &RegisterMap{
+		MemoryHandler: h,
+		format:        format,
+		entries:       entries,
+	}, nil
+}
+
+// readRegisterMap reads the entries of a register map in the given format.
+func readRegisterMap(r io.Reader, format Format) ([]registerMapEntry, error) {
+	switch format {
+	case CSV:
+		return readCSVRegisterMap(r)
+	case JSON:
+		return readJSONRegisterMap(r)
+	}
+
+	return nil, fmt.Errorf("unknown register map format %d", format)
+}
+
+// newRegisterMapHandler creates a MemoryHandler with the addresses of
+// entries. It sets the count of entries without a count to 1.
+func newRegisterMapHandler(entries []registerMapEntry) (*MemoryHandler, error) {
+	h := NewMemoryHandler(0, 0, 0, 0)
+
+	var defined [4]map[int]int
+	for i := range entries {
+		if entries[i].Count == 0 {
+			entries[i].Count = 1
+		}
+
+		e := entries[i]
+
+		if err := e.validate(); err != nil {
+			return nil, fmt.Errorf("line %d: %v", e.line, err)
+		}
+
+		if defined[e.Table] == nil {
+			defined[e.Table] = make(map[int]int)
+		}
+
+		for addr := e.Address; addr < e.Address+e.Count; addr++ {
+			if line, ok := defined[e.Table][addr]; ok {
+				return nil, fmt.Errorf("line %d: address %d of %s is already defined on line %d", e.line, addr, e.Table, line)
+			}
+			defined[e.Table][addr] = e.line
+		}
+
+		h.add(e.Table, e.Address, e.Count)
+		for addr := e.Address; addr < e.Address+e.Count; addr++ {
+			if err := h.set(e.Table, addr, e.Value); err != nil {
+				return nil, err
+			}
+		}
+
+		if e.Access != ReadWrite {
+			h.Protect(e.Address, e.Count, e.Access)
+		}
+	}
+
+	return h, nil
+}
+
+// Reload reads a register map in the format of m from r and replaces the
+// addresses, access and names of m with those of the register map. Addresses
+// which exist in both register maps keep their current value, new addresses
+// get the initial value of the register map. It returns an error when the
+// register map is invalid, in which case m isn't changed. OnWrite functions
+// aren't called.
+//
+// The register map is replaced while no request is executed, so every request
+// uses either the old or the new register map. The handler can keep serving
+// requests, clients stay connected.
+func (m *RegisterMap) Reload(r io.Reader) error {
+	entries, err := readRegisterMap(r, m.format)
+	if err != nil {
+		return err
+	}
+
+	h, err := newRegisterMapHandler(entries)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for t, table := range h.tables {
+		for _, b := range table {
+			for i := range b.values {
+				if current, ok := m.tables[t].find(b.start+i, 1); ok {
+					b.values[i] = current[0]
+				}
+			}
+		}
+	}
+
+	m.tables = h.tables
+	m.access = h.access
+	m.entries = entries
+	return nil
+}
+
+// WatchFile reloads the register map from the file at path, see Reload,
+// whenever the modification time or the size of the file changed. It checks
+// the file every interval until ctx is done and then returns the error of
+// ctx. It calls reloaded, when not nil, with the result of every reload.
+func (m *RegisterMap) WatchFile(ctx context.Context, path string, interval time.Duration, reloaded func(err error)) error {
+	// stat returns the modification time and size of the file, or a
+	// size of -1 when the file doesn't exist, for example because it's
+	// being replaced.
+	stat := func() (time.Time, int64) {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return time.Time{}, -1
+		}
+		return fi.ModTime(), fi.Size()
+	}
+
+	modTime, size := stat()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		t, s := stat()
+		if (t.Equal(modTime) && s == size) || s < 0 {
+			continue
+		}
+		modTime, size = t, s
+
+		err := m.reloadFile(path)
+		if reloaded != nil {
+			reloaded(err)
+		}
+	}
+}
+
+// reloadFile reloads the register map from the file at path. The file is read
+// completely before reloading, so a read error leaves the register map as is.
+func (m *RegisterMap) reloadFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read register map: %v", err)
+	}
+
+	return m.Reload(bytes.NewReader(b))
+}
+
+// readCSVRegisterMap reads the entries of a CSV register map.
+func readCSVRegisterMap(r io.Reader) ([]registerMapEntry, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read header of register map: %v", err)
+	}
+
+	columns := make(map[string]int)
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch name {
+		case "address", "count", "table", "value", "name", "access":
+		default:
+			return nil, fmt.Errorf("line 1: unknown column %q", name)
+		}
+
+		if _, ok := columns[name]; ok {
+			return nil, fmt.Errorf("line 1: duplicate column %q", name)
+		}
+		columns[name] = i
+	}
+
+	for _, name := range []string{"address", "table"} {
+		if _, ok := columns[name]; !ok {
+			return nil, fmt.Errorf("line 1: missing column %q", name)
+		}
+	}
+
+	var entries []registerMapEntry
+	for line := 2; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to read register map: %v", err)
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+
+		number := func(name string) (int, error) {
+			s := field(name)
+			if s == "" && name != "address" {
+				return 0, nil
+			}
+
+			n, err := strconv.Atoi(s)
+			if err != nil {
+				return 0, fmt.Errorf("line %d: invalid %s %q", line, name, s)
+			}
+			return n, nil
+		}
+
+		e := registerMapEntry{Name: field("name"), line: line}
+		if e.Address, err = number("address"); err != nil {
+			return nil, err
+		}
+		if e.Count, err = number("count"); err != nil {
+			return nil, err
+		}
+
+		v, err := number("value")
+		if err != nil {
+			return nil, err
+		}
+		if err := e.Value.Set(v); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if err := e.Table.UnmarshalText([]byte(field("table"))); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if err := e.Access.UnmarshalText([]byte(field("access"))); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		entries = append(entries, e)
+	}
+}
+
+// readJSONRegisterMap reads the entries of a JSON register map.
+func readJSONRegisterMap(r io.Reader) ([]registerMapEntry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read register map: %v", err)
+	}
+
+	br := bytes.NewReader(data)
+	dec := json.NewDecoder(br)
+	dec.DisallowUnknownFields()
+
+	// offset returns the offset in data of the next value decoded by dec.
+	offset := func() int {
+		buffered, _ := ioutil.ReadAll(dec.Buffered())
+		o := len(data) - br.Len() - len(buffered)
+		for o < len(data) && strings.ContainsRune(" \t\r\n,", rune(data[o])) {
+			o++
+		}
+		return o
+	}
+
+	if t, err := dec.Token(); err != nil || t != json.Delim('[') {
+		return nil, fmt.Errorf("line %d: register map isn't a JSON array", lineAt(data, offset()))
+	}
+
+	var entries []registerMapEntry
+	for dec.More() {
+		line := lineAt(data, offset())
+
+		// The address and table are required, so their absence must be
+		// distinguishable from their zero values.
+		var e struct {
+			registerMapEntry
+			Address *int   `json:"address"`
+			Table   *Table `json:"table"`
+		}
+		if err := dec.Decode(&e); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+
+		if e.Address == nil || e.Table == nil {
+			return nil, fmt.Errorf("line %d: entry must have an address and a table", line)
+		}
+
+		e.registerMapEntry.Address = *e.Address
+		e.registerMapEntry.Table = *e.Table
+		e.line = line
+		entries = append(entries, e.registerMapEntry)
+	}
+
+	if _, err := dec.Token(); err != nil {
+		return nil, fmt.Errorf("line %d: %v", lineAt(data, offset()), err)
+	}
+
+	return entries, nil
+}
+
+// lineAt returns the line number of offset in data.
+func lineAt(data []byte, offset int) int {
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// Export writes the register map to w in the format it was loaded from, with
+// the current values. Every address is written as a separate entry, in the
+// order of the entries of the loaded register map.
+func (m *RegisterMap) Export(w io.Writer) error {
+	var entries []registerMapEntry
+
+	m.mu.RLock()
+	for _, e := range m.entries {
+		values, _ := m.tables[e.Table].find(e.Address, e.Count)
+		for i, v := range values {
+			entries = append(entries, registerMapEntry{
+				Address: e.Address + i,
+				Table:   e.Table,
+				Value:   v,
+				Name:    e.Name,
+				Access:  e.Access,
+			})
+		}
+	}
+	m.mu.RUnlock()
+
+	var err error
+	switch m.format {
+	case CSV:
+		err = writeCSVRegisterMap(w, entries)
+	default:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "\t")
+		err = enc.Encode(entries)
+	}
+
+	if err != nil {
+		return fmt.Errorf("failed to write register map: %v", err)
+	}
+
+	return nil
+}
+
+// writeCSVRegisterMap writes entries as CSV register map.
+func writeCSVRegisterMap(w io.Writer, entries []registerMapEntry) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"address", "table", "value", "name", "access"}); err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		record := []string{strconv.Itoa(e.Address), e.Table.String(), strconv.Itoa(e.Value.Get()), e.Name, e.Access.String()}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
@@ -0,0 +1,255 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLoadRegisterMap(t *testing.T) {
+	maps := []struct {
+		data   string
+		format Format
+	}{
+		{`address,count,table,value,name,access
+0,,holding registers,498,setpoint,
+9000,2,Holding Registers,7,serial number,read-only
+3,,coils,1,pump,
+3,,input registers,-1,,
+`, CSV},
+		{`[
+	{"address": 0, "table": "holding registers", "value": 498, "name": "setpoint"},
+	{"address": 9000, "count": 2, "table": "Holding Registers", "value": 7, "name": "serial number", "access": "read-only"},
+	{"address": 3, "table": "coils", "value": 1, "name": "pump"},
+	{"address": 3, "table": "input registers", "value": -1}
+]`, JSON},
+	}
+
+	for _, test := range maps {
+		m, err := LoadRegisterMap(bytes.NewBufferString(test.data), test.format)
+		if !assert.Nil(t, err) {
+			continue
+		}
+
+		v, err := m.GetRegister(0)
+		assert.Nil(t, err)
+		assert.Equal(t, Value{498}, v)
+
+		v, err = m.GetRegister(9001)
+		assert.Nil(t, err)
+		assert.Equal(t, Value{7}, v)
+
+		on, err := m.GetCoil(3)
+		assert.Nil(t, err)
+		assert.True(t, on)
+
+		v, err = m.GetInputRegister(3)
+		assert.Nil(t, err)
+		assert.Equal(t, Value{-1}, v)
+
+		_, err = m.GetRegister(1)
+		assert.NotNil(t, err)
+
+		// The serial number is read-only.
+		buf := new(bytes.Buffer)
+		m.ServeModbus(buf, Request{FunctionCode: WriteSingleRegister, Data: []byte{0x23, 0x29, 0x0, 0x1}})
+		assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2}, buf.Bytes())
+	}
+}
+
+func TestLoadRegisterMapInvalid(t *testing.T) {
+	tests := []struct {
+		data     string
+		format   Format
+		expected string
+	}{
+		{"address,table\n0,holding registers\n1,holding registers\n0,holding registers\n", CSV, "line 4: address 0 of holding registers is already defined on line 2"},
+		{"address,count,table\n0,10,coils\n5,10,coils\n", CSV, "line 3: address 5 of coils is already defined on line 2"},
+		{"address,table,value\n0,coils,2\n", CSV, "line 2: value of coils must be 0 or 1, not 2"},
+		{"address,table,access\n0,coils,read-only\n", CSV, "line 2: access of coils can't be read-only"},
+		{"address,table\n0,registers\n", CSV, `line 2: unknown table "registers"`},
+		{"address,table\nx,coils\n", CSV, `line 2: invalid address "x"`},
+		{"address,table,count\n65535,coils,2\n", CSV, "line 2: addresses 65535 through 65536 are out of range"},
+		{"address,value\n0,1\n", CSV, `line 1: missing column "table"`},
+		{"address,table,unit\n0,coils,1\n", CSV, `line 1: unknown column "unit"`},
+		{"[\n\t{\"address\": 1, \"count\": 3, \"table\": \"coils\"},\n\n\t{\"address\": 3, \"table\": \"coils\"}\n]", JSON, "line 4: address 3 of coils is already defined on line 2"},
+		{"[\n\t{\"address\": 1, \"table\": \"coils\"},\n\t{\"table\": \"coils\"}\n]", JSON, "line 3: entry must have an address and a table"},
+		{"[\n\t{\"address\": 1, \"table\": \"coils\", \"unit\": 1}\n]", JSON, `line 2: json: unknown field "unit"`},
+		{"{}", JSON, "line 1: register map isn't a JSON array"},
+	}
+
+	for _, test := range tests {
+		_, err := LoadRegisterMap(bytes.NewBufferString(test.data), test.format)
+		assert.EqualError(t, err, test.expected)
+	}
+}
+
+func TestRegisterMapExport(t *testing.T) {
+	m, err := LoadRegisterMap(bytes.NewBufferString("address,count,table,value,name,access\n9000,2,holding registers,7,serial number,read-only\n3,1,coils,0,pump,\n"), CSV)
+	assert.Nil(t, err)
+	assert.Nil(t, m.SetCoil(3, true))
+	assert.Nil(t, m.SetRegister(9001, Value{8}))
+
+	buf := new(bytes.Buffer)
+	assert.Nil(t, m.Export(buf))
+	assert.Equal(t, `address,table,value,name,access
+9000,holding registers,7,serial number,read-only
+9001,holding registers,8,serial number,read-only
+3,coils,1,pump,read-write
+`, buf.String())
+
+	// An exported register map can be loaded again.
+	exported, err := LoadRegisterMap(bytes.NewReader(buf.Bytes()), CSV)
+	assert.Nil(t, err)
+	assert.Equal(t, m.tables, exported.tables)
+	assert.Equal(t, m.access, exported.access)
+
+	m, err = LoadRegisterMap(bytes.NewBufferString(`[{"address": 2, "count": 2, "table": "input registers", "name": "temperature"}]`), JSON)
+	assert.Nil(t, err)
+	assert.Nil(t, m.SetInputRegister(3, Value{215}))
+
+	buf.Reset()
+	assert.Nil(t, m.Export(buf))
+	assert.Equal(t, `[
+	{
+		"address": 2,
+		"table": "input registers",
+		"value": 0,
+		"name": "temperature"
+	},
+	{
+		"address": 3,
+		"table": "input registers",
+		"value": 215,
+		"name": "temperature"
+	}
+]
+`, buf.String())
+}
+
+func TestRegisterMapReload(t *testing.T) {
+	m, err := LoadRegisterMap(bytes.NewBufferString("address,count,table,value,access\n0,3,holding registers,1,\n0,1,coils,1,\n"), CSV)
+	assert.Nil(t, err)
+	assert.Nil(t, m.SetRegister(1, Value{5}))
+
+	// An invalid register map doesn't change anything.
+	assert.NotNil(t, m.Reload(bytes.NewBufferString("address,table\n0,coils\n0,coils\n")))
+	v, err := m.GetRegister(2)
+	assert.Nil(t, err)
+	assert.Equal(t, Value{1}, v)
+
+	assert.Nil(t, m.Reload(bytes.NewBufferString("address,count,table,value,access\n1,3,holding registers,2,read-only\n")))
+
+	_, err = m.GetRegister(0)
+	assert.NotNil(t, err)
+	_, err = m.GetCoil(0)
+	assert.NotNil(t, err)
+
+	// Existing registers keep their value, new ones get the initial value.
+	for addr, expected := range map[int]Value{1: {5}, 2: {1}, 3: {2}} {
+		v, err := m.GetRegister(addr)
+		assert.Nil(t, err)
+		assert.Equal(t, expected, v)
+	}
+
+	buf := new(bytes.Buffer)
+	m.ServeModbus(buf, Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x1, 0x0, 0x1}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2}, buf.Bytes())
+}
+
+// TestRegisterMapReloadConcurrency verifies that requests use either the old
+// or the new register map while it's reloaded. Clients write the same value to
+// all registers, so every read returns equal values.
+func TestRegisterMapReloadConcurrency(t *testing.T) {
+	maps := []string{
+		"address,count,table\n0,10,holding registers\n",
+		"address,count,table,access\n0,10,holding registers,read-only\n10,10,holding registers,\n",
+	}
+
+	m, err := LoadRegisterMap(bytes.NewBufferString(maps[0]), CSV)
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			assert.Nil(t, m.Reload(bytes.NewBufferString(maps[i%2])))
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			data := []byte{0x0, 0x0, 0x0, 0xa, 0x14}
+			for j := 0; j < 10; j++ {
+				data = append(data, 0x0, byte(i))
+			}
+			m.ServeModbus(new(bytes.Buffer), Request{FunctionCode: WriteMultipleRegisters, Data: data})
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			buf := new(bytes.Buffer)
+			m.ServeModbus(buf, Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0xa}})
+			values := buf.Bytes()[9:]
+			for j := 2; j < len(values); j += 2 {
+				assert.Equal(t, values[:2], values[j:j+2])
+			}
+		}
+	}()
+	wg.Wait()
+}
+
+func TestRegisterMapWatchFile(t *testing.T) {
+	f, err := ioutil.TempFile("", "registermap")
+	assert.Nil(t, err)
+	defer os.Remove(f.Name())
+
+	_, err = f.WriteString("address,table\n0,holding registers\n")
+	assert.Nil(t, err)
+	assert.Nil(t, f.Close())
+
+	m, err := LoadRegisterMap(bytes.NewBufferString("address,table\n0,holding registers\n"), CSV)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	reloaded := make(chan error, 100)
+	done := make(chan error)
+	go func() {
+		done <- m.WatchFile(ctx, f.Name(), 10*time.Millisecond, func(err error) {
+			reloaded <- err
+		})
+	}()
+
+	// The file is changed until it's reloaded, as changes made before
+	// WatchFile looked at the file aren't noticed.
+	timeout := time.After(5 * time.Second)
+	for count := 2; ; count++ {
+		data := fmt.Sprintf("address,count,table\n0,%d,holding registers\n", count)
+		assert.Nil(t, ioutil.WriteFile(f.Name(), []byte(data), 0644))
+
+		select {
+		case err = <-reloaded:
+		case <-time.After(50 * time.Millisecond):
+			continue
+		case <-timeout:
+			t.Fatal("register map hasn't been reloaded")
+		}
+		break
+	}
+	assert.Nil(t, err)
+
+	_, err = m.GetRegister(1)
+	assert.Nil(t, err)
+
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+}
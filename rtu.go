@@ -0,0 +1,230 @@
+package modbus
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// errUnknownFrameLength is returned when the length of a RTU frame can't be
+// determined because the function code is unknown.
+var errUnknownFrameLength = errors.New("unable to determine length of RTU frame")
+
+// NewRTUServer creates a new server responding on Modbus RTU requests. The
+// requests are read from rw, which is typically a serial port, and the
+// responses are written to it.
+func NewRTUServer(rw io.ReadWriter) *Server {
+	return &Server{
+		rtu:      rw,
+		handlers: make(map[uint8]Handler),
+	}
+}
+
+// serveRTU reads RTU frames from rw and writes the responses to rw. It returns
+// when rw doesn't contain any more data. The context is passed to every
+// request.
+func (s *Server) serveRTU(ctx context.Context, rw io.ReadWriter) error {
+	s.start()
+
+	r := bufio.NewReader(rw)
+	for {
+		if err := s.extendReadDeadline(rw); err != nil {
+			return fmt.Errorf("failed to set read deadline: %v", err)
+		}
+
+		frame, err := peekRTUFrame(r)
+		if err != nil && err != errUnknownFrameLength {
+			if err == io.EOF {
+				return nil
+			}
+
+			return fmt.Errorf("failed to read RTU frame: %v", err)
+		}
+
+		// A frame of unknown length or with an invalid CRC means the
+		// start of the frame is not where it was expected, for example
+		// because a frame got corrupted on the line. The first byte is
+		// dropped and the search for a valid frame continues at the next
+		// byte until the stream is in sync again.
+		var req Request
+		if err == nil {
+			req, err = rtuRequest(frame)
+		}
+		if err != nil {
+			n, err := r.Discard(1)
+			s.stats.read(n)
+			if err != nil {
+				return fmt.Errorf("failed to discard RTU frame: %v", err)
+			}
+			continue
+		}
+
+		n, err := r.Discard(len(frame))
+		s.stats.read(n)
+		if err != nil {
+			return fmt.Errorf("failed to read RTU frame: %v", err)
+		}
+
+		reqCtx, cancel := s.requestContext(ctx)
+		req.ctx = reqCtx
+
+		buf := new(bytes.Buffer)
+		err = s.instrumentedExecute(&errWriter{w: buf, l: s.logger()}, &req)
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		// Requests sent to the broadcast address are never answered,
+		// neither are requests which have been dropped.
+		if req.UnitID == 0 || buf.Len() == 0 {
+			continue
+		}
+
+		adu, err := rtuResponse(buf.Bytes())
+		if err != nil {
+			s.logger().Error("failed to create RTU response", append(requestFields(req), errField(err))...)
+			continue
+		}
+
+		if err := s.extendWriteDeadline(rw); err != nil {
+			return fmt.Errorf("failed to set write deadline: %v", err)
+		}
+
+		n, err = rw.Write(adu)
+		s.stats.written(n)
+		if err != nil {
+			return fmt.Errorf("failed to write RTU response: %v", err)
+		}
+	}
+}
+
+// peekRTUFrame returns the next RTU frame without consuming it. A RTU frame
+// has no length field, so the length is derived from the function code and
+// the data of the request. The returned frame is a copy and stays valid after
+// the frame has been consumed.
+func peekRTUFrame(r *bufio.Reader) ([]byte, error) {
+	b, err := r.Peek(2)
+	if err != nil {
+		return nil, err
+	}
+
+	length, err := rtuDataLength(r, b[1])
+	if err != nil {
+		return nil, err
+	}
+
+	// The frame consists of the address, the function code, the data and
+	// the CRC.
+	b, err = r.Peek(2 + length + 2)
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte{}, b...), nil
+}
+
+// rtuDataLength returns the length of the data of a request with given
+// function code.
+//
+// The length of a Diagnostics request can't be derived from the frame, as the
+// data of the sub-function ReturnQueryData can be of any length. Diagnostics
+// requests are assumed to carry 2 bytes of data after the sub-function, which
+// holds for all sub-functions defined by the Modbus specification. Longer
+// ReturnQueryData requests fail the CRC check and are dropped.
+func rtuDataLength(r *bufio.Reader, functionCode uint8) (int, error) {
+	// peekByte returns the byte at position n of the frame.
+	peekByte := func(n int) (int, error) {
+		b, err := r.Peek(n + 1)
+		if err != nil {
+			return 0, err
+		}
+
+		return int(b[n]), nil
+	}
+
+	switch functionCode {
+	case ReadExceptionStatus, GetCommEventLog, ReportServerID:
+		return 0, nil
+	case ReadFIFOQueue:
+		return 2, nil
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters, WriteSingleCoil, WriteSingleRegister, Diagnostics:
+		return 4, nil
+	case MaskWriteRegister:
+		return 6, nil
+	case WriteMultipleCoils, WriteMultipleRegisters:
+		n, err := peekByte(6)
+		return 5 + n, err
+	case ReadFileRecord, WriteFileRecord:
+		n, err := peekByte(2)
+		return 1 + n, err
+	case ReadWriteMultipleRegisters:
+		n, err := peekByte(10)
+		return 9 + n, err
+	case EncapsulatedInterfaceTransport:
+		meiType, err := peekByte(2)
+		if err != nil {
+			return 0, err
+		}
+
+		if uint8(meiType) == ReadDeviceIdentification {
+			return 3, nil
+		}
+	}
+
+	return 0, errUnknownFrameLength
+}
+
+// rtuRequest creates a Request from a RTU frame. It returns an error when the
+// CRC of the frame is invalid.
+func rtuRequest(frame []byte) (Request, error) {
+	n := len(frame) - 2
+	if crc16(frame[:n]) != uint16(frame[n])|uint16(frame[n+1])<<8 {
+		return Request{}, errors.New("RTU frame has invalid CRC")
+	}
+
+	return Request{
+		MBAP: MBAP{
+			Length: uint16(n - 1),
+			UnitID: frame[0],
+		},
+		FunctionCode: frame[1],
+		Data:         frame[2:n],
+	}, nil
+}
+
+// rtuResponse converts a marshaled Response into a RTU frame by replacing the
+// MBAP header by the address and appending the CRC.
+func rtuResponse(b []byte) ([]byte, error) {
+	// The first 6 bytes of the MBAP header are dropped, the last byte of
+	// the header is the address.
+	if len(b) < 8 {
+		return nil, fmt.Errorf("response has invalid length of %d", len(b))
+	}
+
+	adu := append([]byte{}, b[6:]...)
+	crc := crc16(adu)
+
+	return append(adu, byte(crc), byte(crc>>8)), nil
+}
+
+// crc16 calculates the Modbus CRC-16 of b. The CRC is appended to a frame
+// low byte first.
+func crc16(b []byte) uint16 {
+	crc := uint16(0xffff)
+	for _, v := range b {
+		crc ^= uint16(v)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0xa001
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+
+	return crc
+}
@@ -0,0 +1,116 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// serialPort is a fake serial port reading from r and writing to w.
+type serialPort struct {
+	io.Reader
+	io.Writer
+}
+
+func (p serialPort) Close() error { return nil }
+
+func TestCRC16(t *testing.T) {
+	tests := []struct {
+		data     []byte
+		expected uint16
+	}{
+		{[]byte{0x1, 0x3, 0x0, 0x0, 0x0, 0xa}, 0xcdc5},
+		{[]byte{0x1, 0x3, 0x0, 0x0, 0x0, 0x2}, 0xbc4},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.expected, crc16(test.data))
+	}
+}
+
+func TestServeRTU(t *testing.T) {
+	var written []Value
+	frames := [][]byte{
+		// Read 2 holding registers of unit 1.
+		{0x1, 0x3, 0x0, 0x0, 0x0, 0x2, 0xc4, 0xb},
+		// Same request, but with an invalid CRC.
+		{0x1, 0x3, 0x0, 0x0, 0x0, 0x2, 0xc4, 0xc},
+		// Write single register of unit 1.
+		{0x1, 0x6, 0x0, 0x1, 0x0, 0xff, 0x98, 0x4a},
+		// Broadcast write single register.
+		{0x0, 0x6, 0x0, 0x1, 0x0, 0x3, 0x99, 0xda},
+		// Unknown function code.
+		{0x1, 0x41, 0x0, 0x10, 0x50},
+	}
+
+	r := new(bytes.Buffer)
+	w := new(bytes.Buffer)
+	for _, f := range frames {
+		r.Write(f)
+	}
+
+	s := NewRTUServer(serialPort{r, w})
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		assert.Equal(t, 1, unitID)
+		return []Value{Value{0xa}, Value{0x102}}, nil
+	}))
+	s.Handle(WriteSingleRegister, NewWriteHandler(func(unitID, start int, values []Value) error {
+		written = append(written, values...)
+		return nil
+	}, Unsigned))
+
+	s.Listen()
+
+	assert.Equal(t, []byte{
+		0x1, 0x3, 0x4, 0x0, 0xa, 0x1, 0x2, 0x5a, 0x60,
+		0x1, 0x6, 0x0, 0x1, 0x0, 0xff, 0x98, 0x4a,
+	}, w.Bytes())
+	assert.Equal(t, []Value{Value{0xff}, Value{0x3}}, written)
+}
+
+func TestRTUResync(t *testing.T) {
+	frames := [][]byte{
+		// Stray byte on the line.
+		{0xff},
+		// Read 2 holding registers of unit 1 with a corrupted quantity.
+		{0x1, 0x3, 0x0, 0x0, 0x0, 0x7, 0xc4, 0xb},
+		// Unknown function code.
+		{0x1, 0x41},
+		// Read 2 holding registers of unit 1.
+		{0x1, 0x3, 0x0, 0x0, 0x0, 0x2, 0xc4, 0xb},
+	}
+
+	r := new(bytes.Buffer)
+	w := new(bytes.Buffer)
+	for _, f := range frames {
+		r.Write(f)
+	}
+
+	s := NewRTUServer(serialPort{r, w})
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		assert.Equal(t, 2, quantity)
+		return []Value{Value{0xa}, Value{0x102}}, nil
+	}))
+
+	s.Listen()
+	assert.Equal(t, []byte{0x1, 0x3, 0x4, 0x0, 0xa, 0x1, 0x2, 0x5a, 0x60}, w.Bytes())
+}
+
+func TestRTUOverTCP(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0", WithFraming(RTUOverTCP))
+	assert.Nil(t, err)
+	assert.Equal(t, RTUOverTCP, s.framing)
+
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}, Value{0x102}}, nil
+	}))
+
+	r := bytes.NewBuffer([]byte{0x1, 0x3, 0x0, 0x0, 0x0, 0x2, 0xc4, 0xb})
+	w := new(bytes.Buffer)
+
+	assert.Nil(t, s.handleConn(context.Background(), serialPort{r, w}))
+	assert.Equal(t, []byte{0x1, 0x3, 0x4, 0x0, 0xa, 0x1, 0x2, 0x5a, 0x60}, w.Bytes())
+}
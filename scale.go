@@ -0,0 +1,179 @@
+package modbus
+
+import (
+	"fmt"
+	"math"
+)
+
+// Rounding defines how a Scale rounds a scaled value to an integer.
+type Rounding int
+
+const (
+	// RoundNearest rounds to the nearest integer, halves are rounded away
+	// from zero.
+	RoundNearest Rounding = iota
+
+	// RoundDown rounds towards negative infinity.
+	RoundDown
+
+	// RoundUp rounds towards positive infinity.
+	RoundUp
+
+	// RoundTowardZero drops the fraction.
+	RoundTowardZero
+)
+
+func (r Rounding) round(f float64) float64 {
+	switch r {
+	case RoundDown:
+		return math.Floor(f)
+	case RoundUp:
+		return math.Ceil(f)
+	case RoundTowardZero:
+		return math.Trunc(f)
+	default:
+		return math.Round(f)
+	}
+}
+
+// Scale converts between values in engineering units and the integers sent
+// over the wire:
+//
+//	value = register * Gain + Offset
+//
+// A temperature sent as tenths of a degree has a Gain of 0.1. A Gain of 0 is
+// treated as 1, so the zero Scale passes unsigned integers unchanged.
+type Scale struct {
+	Gain   float64
+	Offset float64
+
+	// Signedness defines whether registers contain int16s or uint16s.
+	Signedness Signedness
+
+	// Rounding defines how values are rounded to integers.
+	Rounding Rounding
+
+	// Clamp makes values which don't fit in a register saturate to the
+	// smallest or largest integer the register can contain. By default
+	// those values are an error.
+	Clamp bool
+}
+
+func (s Scale) gain() float64 {
+	if s.Gain == 0 {
+		return 1
+	}
+
+	return s.Gain
+}
+
+func (s Scale) limits() (min, max float64) {
+	if s.Signedness == Signed {
+		return math.MinInt16, math.MaxInt16
+	}
+
+	return 0, math.MaxUint16
+}
+
+// ToValue converts f to the Value of a register.
+func (s Scale) ToValue(f float64) (Value, error) {
+	if math.IsNaN(f) {
+		return Value{}, fmt.Errorf("can't scale %v", f)
+	}
+
+	r := s.Rounding.round((f - s.Offset) / s.gain())
+
+	min, max := s.limits()
+	if r < min || r > max {
+		if !s.Clamp {
+			return Value{}, fmt.Errorf("%v scaled to %v doesn't fit in a register", f, r)
+		}
+
+		r = math.Max(min, math.Min(max, r))
+	}
+
+	return Value{int(r)}, nil
+}
+
+// FromValue converts the Value of a register to a value in engineering units.
+// The Value is reinterpreted according to the Signedness of s, so both
+// Value{-1} and Value{65535} are -1 when s is Signed.
+func (s Scale) FromValue(v Value) float64 {
+	i := v.Get()
+	if s.Signedness == Signed {
+		i = int(int16(i))
+	} else {
+		i = int(uint16(i))
+	}
+
+	return float64(i)*s.gain() + s.Offset
+}
+
+// AddrRange is a range of Count addresses starting at Start.
+type AddrRange struct {
+	Start int
+	Count int
+}
+
+func (r AddrRange) contains(addr int) bool {
+	return addr >= r.Start && addr < r.Start+r.Count
+}
+
+// scaleOf returns the Scale of the range containing addr, or the zero Scale
+// when no range contains it.
+func scaleOf(scales map[AddrRange]Scale, addr int) Scale {
+	for r, s := range scales {
+		if r.contains(addr) {
+			return s
+		}
+	}
+
+	return Scale{}
+}
+
+// ScaledReadHandlerFunc is an adapter to allow the use of ordinary functions
+// returning values in engineering units as handlers for Modbus read
+// functions.
+type ScaledReadHandlerFunc func(unitID, start, quantity int) ([]float64, error)
+
+// ScaledWriteHandlerFunc is an adapter to allow the use of ordinary functions
+// receiving values in engineering units as handlers for Modbus write
+// functions.
+type ScaledWriteHandlerFunc func(unitID, start int, values []float64) error
+
+// NewScaledHandler creates a ReadHandler which converts the values returned by
+// h to registers using the Scale of the range containing their address. The
+// ranges must not overlap. Addresses outside every range use the zero Scale.
+// A value which can't be converted results in a SlaveDeviceFailureError.
+func NewScaledHandler(h ScaledReadHandlerFunc, scales map[AddrRange]Scale) *ReadHandler {
+	return NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		floats, err := h(unitID, start, quantity)
+		if err != nil {
+			return nil, err
+		}
+
+		values := make([]Value, len(floats))
+		for i, f := range floats {
+			values[i], err = scaleOf(scales, start+i).ToValue(f)
+			if err != nil {
+				return nil, fmt.Errorf("failed to scale value of address %d: %v", start+i, err)
+			}
+		}
+
+		return values, nil
+	})
+}
+
+// NewScaledWriteHandler creates a WriteHandler which converts the written
+// registers to values in engineering units using the Scale of the range
+// containing their address before passing them to h, see NewScaledHandler.
+func NewScaledWriteHandler(h ScaledWriteHandlerFunc, scales map[AddrRange]Scale) *WriteHandler {
+	return NewWriteHandler(func(unitID, start int, values []Value) error {
+		floats := make([]float64, len(values))
+		for i, v := range values {
+			floats[i] = scaleOf(scales, start+i).FromValue(v)
+		}
+
+		return h(unitID, start, floats)
+	}, Unsigned)
+}
@@ -0,0 +1,92 @@
+package modbus
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScale(t *testing.T) {
+	tests := []struct {
+		s        Scale
+		f        float64
+		expected Value
+	}{
+		{Scale{}, 498, Value{498}},
+		{Scale{Gain: 0.1, Signedness: Signed}, 21.46, Value{215}},
+		{Scale{Gain: 0.1, Signedness: Signed}, -21.46, Value{-215}},
+		{Scale{Gain: 0.1, Signedness: Signed, Rounding: RoundDown}, -21.41, Value{-215}},
+		{Scale{Gain: 0.1, Signedness: Signed, Rounding: RoundUp}, 21.41, Value{215}},
+		{Scale{Gain: 0.1, Signedness: Signed, Rounding: RoundTowardZero}, -21.49, Value{-214}},
+		{Scale{Gain: 0.5, Offset: -40}, -40, Value{0}},
+		{Scale{Gain: 0.5, Offset: -40}, 10, Value{100}},
+		{Scale{Clamp: true}, -3, Value{0}},
+		{Scale{Clamp: true}, 70000, Value{65535}},
+		{Scale{Signedness: Signed, Clamp: true}, 40000, Value{32767}},
+		{Scale{Signedness: Signed, Clamp: true}, -40000, Value{-32768}},
+	}
+
+	for _, test := range tests {
+		v, err := test.s.ToValue(test.f)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, v)
+	}
+
+	invalid := []struct {
+		s Scale
+		f float64
+	}{
+		{Scale{}, -1},
+		{Scale{}, 65536},
+		{Scale{Signedness: Signed}, 32768},
+		{Scale{Gain: 0.1, Signedness: Signed}, -3276.9},
+		{Scale{Clamp: true}, math.NaN()},
+	}
+
+	for _, test := range invalid {
+		_, err := test.s.ToValue(test.f)
+		assert.NotNil(t, err)
+	}
+
+	signed := Scale{Gain: 0.1, Signedness: Signed}
+	assert.InDelta(t, -21.5, signed.FromValue(Value{-215}), 1e-9)
+	assert.InDelta(t, -21.5, signed.FromValue(Value{65321}), 1e-9)
+	assert.Equal(t, 65321.0, Scale{}.FromValue(Value{-215}))
+	assert.Equal(t, 10.0, Scale{Gain: 0.5, Offset: -40}.FromValue(Value{100}))
+}
+
+func TestScaledHandlers(t *testing.T) {
+	scales := map[AddrRange]Scale{
+		{Start: 0, Count: 2}: {Gain: 0.1, Signedness: Signed},
+		{Start: 5, Count: 1}: {Gain: 0.5, Offset: -40},
+	}
+
+	temperatures := []float64{-2.5, 21.04, 3, 4, 5, 10}
+	r := NewScaledHandler(func(unitID, start, quantity int) ([]float64, error) {
+		return temperatures[start : start+quantity], nil
+	}, scales)
+
+	buf := new(bytes.Buffer)
+	r.ServeModbus(buf, Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x6}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xf, 0x0, 0x3, 0xc, 0xff, 0xe7, 0x0, 0xd2, 0x0, 0x3, 0x0, 0x4, 0x0, 0x5, 0x0, 0x64}, buf.Bytes())
+
+	// -1 doesn't fit in the unsigned register at address 2.
+	temperatures[2] = -1
+	buf.Reset()
+	r.ServeModbus(buf, Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x2, 0x0, 0x1}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x4}, buf.Bytes())
+
+	var written []float64
+	w := NewScaledWriteHandler(func(unitID, start int, values []float64) error {
+		written = values
+		return nil
+	}, scales)
+
+	buf.Reset()
+	w.ServeModbus(buf, Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0xff, 0xe7, 0xff, 0xe7}})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x1, 0x0, 0x2}, buf.Bytes())
+	assert.InDelta(t, -2.5, written[0], 1e-9)
+	assert.Equal(t, 65511.0, written[1])
+}
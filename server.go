@@ -2,83 +2,753 @@ package modbus
 
 import (
 	"bufio"
+	"context"
+	"crypto/tls"
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"net"
+	"runtime/debug"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// Framing controls how Modbus messages are framed on a TCP connection.
+type Framing int
+
+const (
+	// TCP frames messages with a MBAP header, as described by the Modbus
+	// TCP/IP specification.
+	TCP Framing = iota
+
+	// RTUOverTCP frames messages like Modbus RTU does: a slave address
+	// followed by the PDU and a CRC. It's used by many serial-to-Ethernet
+	// converters.
+	RTUOverTCP
+)
+
+// Option configures a Server.
+type Option func(*Server)
+
+// WithFraming sets the framing of messages, by default messages are framed
+// using TCP.
+func WithFraming(f Framing) Option {
+	return func(s *Server) {
+		s.framing = f
+	}
+}
+
+// WithPanicRecovery controls whether panics in handlers are recovered. A
+// recovered panic is logged and answered with a SlaveDeviceFailureError. When
+// disabled, a panicking handler crashes the program. Recovery is enabled by
+// default.
+func WithPanicRecovery(enabled bool) Option {
+	return func(s *Server) {
+		s.noPanicRecovery = !enabled
+	}
+}
+
+// minMBAPLength and maxMBAPLength are the limits of the length field of the
+// MBAP header.
+const (
+	minMBAPLength = 2
+	maxMBAPLength = maxADULength - 6
+)
+
+// modbusProtocolID is the protocol ID of Modbus in the MBAP header.
+const modbusProtocolID = 0
+
+// InvalidProtocolStrategy controls how frames with a protocol ID other than
+// Modbus are treated.
+type InvalidProtocolStrategy int
+
+const (
+	// DropInvalidProtocol drops the frame and logs it.
+	DropInvalidProtocol InvalidProtocolStrategy = iota
+
+	// CloseOnInvalidProtocol closes the connection.
+	CloseOnInvalidProtocol
+)
+
+// LengthMismatchStrategy controls how frames are treated of which the length
+// in the MBAP header doesn't match the length of the request. Such a frame
+// either lacks data or contains data of the next frame.
+type LengthMismatchStrategy int
+
+const (
+	// DropLengthMismatch drops the frame and logs it.
+	DropLengthMismatch LengthMismatchStrategy = iota
+
+	// CloseOnLengthMismatch closes the connection.
+	CloseOnLengthMismatch
+)
+
+// UnknownUnitStrategy controls how requests for units which aren't served are
+// treated.
+type UnknownUnitStrategy int
+
+const (
+	// RejectUnknownUnits responds on requests for unknown units with a
+	// GatewayTargetDeviceFailedToRespondError.
+	RejectUnknownUnits UnknownUnitStrategy = iota
+
+	// DropUnknownUnits doesn't respond on requests for unknown units, like
+	// a missing device on a serial bus.
+	DropUnknownUnits
+)
+
+// WithBroadcast controls whether requests for unit ID 0 are treated as
+// broadcasts. Write requests sent as broadcast are executed without a response,
+// other broadcast requests are ignored. When disabled, requests for unit ID 0
+// are answered like other requests. It's enabled by default.
+func WithBroadcast(enabled bool) Option {
+	return func(s *Server) {
+		s.noBroadcast = !enabled
+	}
+}
+
+// ConnLimitStrategy controls what happens with new connections once the
+// maximum number of connections has been reached.
+type ConnLimitStrategy int
+
+const (
+	// BlockConnections stops accepting connections until another
+	// connection is closed. New connections queue up in the backlog of the
+	// listener.
+	BlockConnections ConnLimitStrategy = iota
+
+	// RejectConnections accepts new connections and closes them
+	// immediately.
+	RejectConnections
+)
+
+// WithMaxConnections limits the number of concurrent connections to n. The
+// strategy controls how connections exceeding the limit are treated. By
+// default the number of connections is unlimited.
+func WithMaxConnections(n int, strategy ConnLimitStrategy) Option {
+	return func(s *Server) {
+		s.maxConns = n
+		s.connLimitStrategy = strategy
+	}
+}
+
+// ConnState represents the state of a connection accepted by the server.
+type ConnState int
+
+const (
+	// StateNew is the state of a connection which has just been accepted.
+	StateNew ConnState = iota
+
+	// StateActive is the state of a connection which is receiving or
+	// executing a request.
+	StateActive
+
+	// StateIdle is the state of a connection which has answered a request
+	// and is waiting for the next one.
+	StateIdle
+
+	// StateClosed is the state of a closed connection. It's a terminal
+	// state.
+	StateClosed
+)
+
+func (c ConnState) String() string {
+	switch c {
+	case StateNew:
+		return "new"
+	case StateActive:
+		return "active"
+	case StateIdle:
+		return "idle"
+	case StateClosed:
+		return "closed"
+	}
+
+	return fmt.Sprintf("ConnState(%d)", int(c))
+}
+
 // Server is a Modbus server listens on a port and responds on incoming Modbus
 // requests.
 type Server struct {
-	l        net.Listener
-	handlers map[uint8]Handler
-	timeout  time.Duration
+	// stats is accessed atomically, it's the first field to keep its
+	// 64 bit fields aligned.
+	stats serverStats
+
+	l              net.Listener
+	pc             net.PacketConn
+	rtu            io.ReadWriter
+	framing        Framing
+	handlers       map[uint8]Handler
+	idleTimeout    time.Duration
+	requestTimeout time.Duration
+	writeTimeout   time.Duration
+
+	// Logger logs errors and events of the server. When nil, ErrorLog is
+	// used.
+	Logger Logger
+
+	// ErrorLog is used to log errors when no Logger is set. When nil, the
+	// standard logger of package log is used.
 	ErrorLog *log.Logger
+
+	// BaseContext optionally returns the base context of all connections
+	// accepted by l. The context of a connection is canceled when the
+	// connection is closed; when the base context is canceled, the
+	// connection is closed. By default context.Background() is used.
+	BaseContext func(l net.Listener) context.Context
+
+	// ConnState is an optional callback which is called when a
+	// connection accepted by Serve changes state. It's never called
+	// concurrently for the same connection.
+	ConnState func(net.Conn, ConnState)
+
+	// Instrumentation optionally receives events about connections and
+	// requests, for example to collect metrics.
+	Instrumentation Instrumentation
+
+	authorizer  AuthorizerFunc
+	defaultRole string
+
+	maxConns          int
+	connLimitStrategy ConnLimitStrategy
+	connFilter        ConnFilterFunc
+
+	noPanicRecovery bool
+	noBroadcast     bool
+	pipelining      int
+
+	errorMapper    func(error) Error
+	defaultHandler Handler
+
+	invalidProtocolStrategy InvalidProtocolStrategy
+	lengthMismatchStrategy  LengthMismatchStrategy
+
+	units               map[uint8]bool
+	unknownUnitStrategy UnknownUnitStrategy
+
+	middleware   []Middleware
+	fcMiddleware map[uint8][]Middleware
+
+	mu        sync.Mutex
+	conns     map[net.Conn]*connState
+	started   bool
+	closed    bool
+	done      chan struct{}
+	closeOnce sync.Once
+	closeErr  error
 }
 
 // NewServer creates a new server on given address.
-func NewServer(address string) (*Server, error) {
+func NewServer(address string, opts ...Option) (*Server, error) {
 	l, err := net.Listen("tcp", address)
 	if err != nil {
 		return nil, fmt.Errorf("failed to start Modbus server: %v", err)
 	}
 
-	return &Server{
+	s := &Server{
 		l:        l,
-		timeout:  0,
 		handlers: make(map[uint8]Handler),
-	}, nil
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
+}
+
+// SetTimeout sets the idle timeout.
+//
+// Deprecated: use SetIdleTimeout instead.
+func (s *Server) SetTimeout(t time.Duration) error {
+	return s.SetIdleTimeout(t)
+}
+
+// SetIdleTimeout sets the idle timeout, which is the maximum duration a
+// connection may be idle between two requests. Idle connections are closed.
+// The deadline is extended every time a request is received, so a
+// connection polling faster than the timeout is never closed. It returns an
+// error when the server already started.
+func (s *Server) SetIdleTimeout(t time.Duration) error {
+	return s.configure(func() {
+		s.idleTimeout = t
+	})
+}
+
+// SetErrorMapper sets a function which translates errors returned by handler
+// funcs to exceptions, for example sql.ErrNoRows to IllegalAddressError.
+// It's only called for errors which aren't an Error and don't wrap one. Without
+// an error mapper those errors result in a SlaveDeviceFailureError. It returns
+// an error when the server already started.
+func (s *Server) SetErrorMapper(m func(error) Error) error {
+	return s.configure(func() {
+		s.errorMapper = m
+	})
+}
+
+// SetInvalidProtocolStrategy sets how frames with a protocol ID other than
+// Modbus are treated. By default they're dropped. It returns an error when the
+// server already started.
+func (s *Server) SetInvalidProtocolStrategy(strategy InvalidProtocolStrategy) error {
+	return s.configure(func() {
+		s.invalidProtocolStrategy = strategy
+	})
+}
+
+// SetLengthMismatchStrategy sets how frames are treated of which the length in
+// the MBAP header doesn't match the length of the request. By default they're
+// dropped. It returns an error when the server already started.
+func (s *Server) SetLengthMismatchStrategy(strategy LengthMismatchStrategy) error {
+	return s.configure(func() {
+		s.lengthMismatchStrategy = strategy
+	})
+}
+
+// ServeUnits restricts the server to requests for the given unit IDs.
+// Requests for other units are treated according to the strategy set with
+// SetUnknownUnitStrategy. By default requests for all units are served. It
+// returns an error when the server already started.
+func (s *Server) ServeUnits(unitIDs ...uint8) error {
+	return s.configure(func() {
+		s.units = make(map[uint8]bool)
+		for _, id := range unitIDs {
+			s.units[id] = true
+		}
+	})
+}
+
+// SetUnknownUnitStrategy sets how requests for units which aren't served are
+// treated. By default they're rejected. It returns an error when the server
+// already started.
+func (s *Server) SetUnknownUnitStrategy(strategy UnknownUnitStrategy) error {
+	return s.configure(func() {
+		s.unknownUnitStrategy = strategy
+	})
+}
+
+// SetRequestTimeout sets the request timeout, which is the maximum duration a
+// handler should take to execute a request. The context of the request
+// carries a deadline which expires after the timeout. Handlers aren't
+// interrupted, it's up to them to observe the context. It returns an error when
+// the server already started.
+func (s *Server) SetRequestTimeout(t time.Duration) error {
+	return s.configure(func() {
+		s.requestTimeout = t
+	})
+}
+
+// requestContext returns the context for a request received on a connection
+// with given context.
+func (s *Server) requestContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if s.requestTimeout == 0 {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, s.requestTimeout)
+}
+
+// SetWriteTimeout sets the write timeout, which is the maximum duration
+// writing a response may take. By default there is no write timeout. It
+// returns an error when the server already started.
+func (s *Server) SetWriteTimeout(t time.Duration) error {
+	return s.configure(func() {
+		s.writeTimeout = t
+	})
+}
+
+// readDeadliner is implemented by connections supporting read deadlines, like
+// net.Conn.
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// extendReadDeadline sets the read deadline of conn to now plus the idle
+// timeout. Nothing happens when no idle timeout is set or conn doesn't support
+// deadlines.
+func (s *Server) extendReadDeadline(conn interface{}) error {
+	rd, ok := conn.(readDeadliner)
+	if !ok || s.idleTimeout == 0 {
+		return nil
+	}
+
+	return rd.SetReadDeadline(time.Now().Add(s.idleTimeout))
+}
+
+// watchDisconnect calls cancel when the client closes conn while a request is
+// executed, so handlers can stop working on requests of which the response
+// won't be read. It reads ahead from r until the returned function is called,
+// which stops the read by setting a read deadline in the past. Data read ahead
+// stays buffered in r. Only connections implementing net.Conn are watched.
+func watchDisconnect(conn io.ReadWriteCloser, r *bufio.Reader, cancel context.CancelFunc) func() {
+	nc, ok := conn.(net.Conn)
+	if !ok {
+		return func() {}
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		_, err := r.Peek(1)
+		if ne, ok := err.(net.Error); err == nil || ok && ne.Timeout() {
+			return
+		}
+		cancel()
+	}()
+
+	// Setting a deadline only fails when the connection is closed, in
+	// which case the read returns anyway and the next read of the server
+	// fails.
+	return func() {
+		_ = nc.SetReadDeadline(time.Unix(1, 0))
+		<-done
+		_ = nc.SetReadDeadline(time.Time{})
+	}
 }
 
-// SetTimeout sets the timeout, which is the maximum duraion a request can take.
-func (s *Server) SetTimeout(t time.Duration) {
-	s.timeout = t
+// writeDeadliner is implemented by connections supporting write deadlines,
+// like net.Conn.
+type writeDeadliner interface {
+	SetWriteDeadline(t time.Time) error
 }
 
-// Listen start listening for requests.
+// extendWriteDeadline sets the write deadline of conn to now plus the write
+// timeout. Nothing happens when no write timeout is set or conn doesn't
+// support deadlines.
+func (s *Server) extendWriteDeadline(conn interface{}) error {
+	wd, ok := conn.(writeDeadliner)
+	if !ok || s.writeTimeout == 0 {
+		return nil
+	}
+
+	return wd.SetWriteDeadline(time.Now().Add(s.writeTimeout))
+}
+
+// errWriter is a writer which remembers the first error returned by w. It
+// expects every write to contain a single response.
+type errWriter struct {
+	w   io.Writer
+	l   Logger
+	n   int
+	err error
+
+	// exception is the exception code of the last response written, or
+	// 0 if it wasn't an exception response.
+	exception uint8
+}
+
+func (e *errWriter) Write(b []byte) (int, error) {
+	e.exception, _ = ExceptionCode(b)
+
+	n, err := e.w.Write(b)
+	e.n += n
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+
+	return n, err
+}
+
+// Len returns the number of bytes written.
+func (e *errWriter) Len() int {
+	return e.n
+}
+
+func (e *errWriter) logger() Logger {
+	return e.l
+}
+
+// Listen start listening for requests. It returns when the server is closed.
+// A server created with NewRTUServer also returns when its reader doesn't
+// contain any more data.
 func (s *Server) Listen() {
+	switch {
+	case s.rtu != nil:
+		if err := s.serveRTU(context.Background(), s.rtu); err != nil {
+			s.logger().Error("failed to serve RTU requests", errField(err))
+		}
+		return
+	case s.pc != nil:
+		s.serveUDP(s.pc)
+		return
+	}
+
+	if err := s.Serve(s.l); err != nil {
+		s.logger().Error("failed to serve requests", errField(err))
+	}
+}
+
+// Serve accepts incoming connections on the listener l and responds on their
+// requests. It returns nil after the server is closed, otherwise it returns
+// an error when l fails to accept connections.
+//
+// Serve can be used with any listener, like a Unix domain socket or a
+// pre-bound socket. A zero value Server is ready to use:
+//
+//	var s modbus.Server
+//	s.Handle(modbus.ReadCoils, h)
+//	err := s.Serve(l)
+//
+// The listener of a server created with NewServer is closed when Serve is
+// called with another listener, as the server only accepts connections on l.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return l.Close()
+	}
+	prev := s.l
+	s.l = l
+	s.started = true
+	s.mu.Unlock()
+
+	if prev != nil && prev != l {
+		if err := prev.Close(); err != nil {
+			s.logger().Error("failed to close previous listener", errField(err))
+		}
+	}
+
+	s.stats.start()
+
+	baseCtx := context.Background()
+	if s.BaseContext != nil {
+		baseCtx = s.BaseContext(l)
+	}
+
+	// slots contains a value for every connection being served, so it
+	// limits the number of concurrent connections.
+	var slots chan struct{}
+	if s.maxConns > 0 {
+		slots = make(chan struct{}, s.maxConns)
+	}
+
+	// release frees the slot taken before accepting a connection, when the
+	// connection isn't going to be served.
+	release := func() {
+		if slots != nil && s.connLimitStrategy == BlockConnections {
+			<-slots
+		}
+	}
+
+	var retry backoff
 	for {
-		conn, err := s.l.Accept()
+		if slots != nil && s.connLimitStrategy == BlockConnections {
+			select {
+			case slots <- struct{}{}:
+			case <-s.doneChan():
+				return nil
+			}
+		}
+
+		conn, err := l.Accept()
 
 		if err != nil {
-			s.logf("golfish: failed to accept incoming connection: %v", err)
+			if s.isClosed() {
+				return nil
+			}
+
+			if temporary(err) {
+				delay := retry.next()
+				s.logger().Error("failed to accept incoming connection", errField(err), Field{Key: "retry_in", Value: delay})
+				release()
+
+				select {
+				case <-time.After(delay):
+				case <-s.doneChan():
+					return nil
+				}
+				continue
+			}
+			return fmt.Errorf("failed to accept incoming connection: %v", err)
+		}
+		retry.reset()
+
+		if err := s.filterConn(conn.RemoteAddr()); err != nil {
+			s.logger().Info("rejected connection", remoteAddrField(conn.RemoteAddr()), errField(err))
+			if err := conn.Close(); err != nil {
+				s.logger().Error("failed to close connection", remoteAddrField(conn.RemoteAddr()), errField(err))
+			}
+			release()
 			continue
 		}
-		if d := s.timeout; d != 0 {
-			if err := conn.SetReadDeadline(time.Now().Add(d)); err != nil {
-				s.logf("goldfish: failed set timeout %v: %v", conn.RemoteAddr(), err)
+
+		if slots != nil && s.connLimitStrategy == RejectConnections {
+			select {
+			case slots <- struct{}{}:
+			default:
+				s.logger().Info("rejected connection: maximum number of connections reached", remoteAddrField(conn.RemoteAddr()), Field{Key: "max_connections", Value: s.maxConns})
 				if err := conn.Close(); err != nil {
-					s.logf("goldfish: failed to close connection with %v: %v", conn.RemoteAddr(), err)
+					s.logger().Error("failed to close connection", remoteAddrField(conn.RemoteAddr()), errField(err))
 				}
+				continue
 			}
 		}
 
+		ctx, cancel := context.WithCancel(baseCtx)
+		s.trackConn(conn, cancel)
 		go func() {
-			if err := s.handleConn(conn); err != nil {
-				s.logf("goldfish: unable to handle request from %v: %v", conn.RemoteAddr(), err)
-			}
-
-			if err := conn.Close(); err != nil {
-				s.logf("goldfish: failed to close connection with %v: %v", conn.RemoteAddr(), err)
+			// The slot is released when the connection has been
+			// served, regardless of how serving it ended.
+			if slots != nil {
+				defer func() { <-slots }()
 			}
+			s.serveConn(ctx, conn)
 		}()
 	}
 }
 
-func (s *Server) handleConn(conn io.ReadWriteCloser) error {
+// backoff is the delay before retrying after a temporary error. It starts at
+// 5ms and doubles after every consecutive error, up to 1s.
+type backoff struct {
+	delay time.Duration
+}
+
+// next returns the delay before the next retry.
+func (b *backoff) next() time.Duration {
+	if b.delay == 0 {
+		b.delay = 5 * time.Millisecond
+	} else {
+		b.delay *= 2
+	}
+
+	if b.delay > time.Second {
+		b.delay = time.Second
+	}
+
+	return b.delay
+}
+
+// reset starts over after a successful attempt.
+func (b *backoff) reset() {
+	b.delay = 0
+}
+
+// temporary returns true when err is caused by a temporary condition, like
+// running out of file descriptors, so the operation can be retried.
+func temporary(err error) bool {
+	var errno syscall.Errno
+	return errors.As(err, &errno) && errno.Temporary()
+}
+
+// serveConn handles all requests on conn and closes conn afterwards.
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	s.stats.connOpened()
+	defer s.stats.connClosed()
+
+	if s.Instrumentation != nil {
+		s.Instrumentation.ConnectionOpened(conn.RemoteAddr())
+		defer s.Instrumentation.ConnectionClosed(conn.RemoteAddr())
+	}
+
+	closeConn := func() {
+		if err := s.closeConn(conn); err != nil {
+			s.logger().Error("failed to close connection", remoteAddrField(conn.RemoteAddr()), errField(err))
+		}
+	}
+	defer closeConn()
+
+	// The connection is closed as soon as its context is canceled. After
+	// the connection has been closed this goroutine returns too, because
+	// closing a connection cancels its context.
+	go func() {
+		<-ctx.Done()
+		closeConn()
+	}()
+
+	// The TLS handshake is done explicitly, so a failing handshake can be
+	// told apart from a failing request.
+	if tc, ok := conn.(*tls.Conn); ok {
+		if err := tc.Handshake(); err != nil {
+			s.logger().Error("TLS handshake failed", remoteAddrField(conn.RemoteAddr()), errField(err))
+			return
+		}
+	}
+
+	if err := s.handleConn(ctx, conn); err != nil {
+		s.logger().Error("unable to handle requests", remoteAddrField(conn.RemoteAddr()), errField(err))
+	}
+}
+
+func (s *Server) handleConn(ctx context.Context, conn io.ReadWriteCloser) error {
+	if s.framing == RTUOverTCP {
+		return s.serveRTU(ctx, conn)
+	}
+
+	role, err := s.role(conn)
+	if err != nil {
+		return err
+	}
+
+	var remoteAddr net.Addr
+	if c, ok := conn.(interface{ RemoteAddr() net.Addr }); ok {
+		remoteAddr = c.RemoteAddr()
+	}
+
+	var p *pipeline
+	if s.pipelining > 1 {
+		p = newPipeline(s, conn)
+	}
+
+	// active is true while the connection is marked active for the request
+	// being received or executed.
+	active := false
+
 	r := bufio.NewReader(conn)
 	for {
-		buf, err := s.readMessage(r)
+		// The connection is idle while waiting for the next request.
+		if active {
+			s.setConnActive(conn, false)
+			active = false
+		}
+
+		if err := s.extendReadDeadline(conn); err != nil {
+			return fmt.Errorf("failed to set read deadline: %v", err)
+		}
+
+		// The connection is active as soon as the first byte of a
+		// request arrives, so it isn't closed by Shutdown while the
+		// request is being received and checked.
+		var buf []byte
+		_, err := r.Peek(1)
+		if err == nil {
+			s.setConnActive(conn, true)
+			active = true
+
+			buf, err = s.readMessage(r)
+		}
+		s.stats.read(len(buf))
 
 		if err != nil {
+			// Reading fails as well when a pipelined request closed
+			// the connection, its error is more relevant.
+			if p != nil {
+				if err := p.wait(); err != nil {
+					return err
+				}
+			}
+
+			// Idle connections are closed when the server shuts down
+			// or when the context of the connection is canceled.
+			if s.isClosed() || ctx.Err() != nil {
+				return nil
+			}
+
 			// An EOF error indicates the connection did not send new data. This
 			// means the connection can be closed, but its not an error in the program.
 			if err == io.EOF {
 				return nil
 			}
+
+			// The connection has been idle for too long. Closing
+			// it is expected and not an error either.
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				s.logger().Debug("closed idle connection", remoteAddrField(remoteAddr))
+				return nil
+			}
 			return fmt.Errorf("failed to read message from connection: %v", err)
 		}
 
@@ -87,9 +757,70 @@ func (s *Server) handleConn(conn io.ReadWriteCloser) error {
 			return fmt.Errorf("failed to parse request: %v", err)
 		}
 
-		if err := s.executeAndRespond(conn, &req); err != nil {
+		// Frames with another protocol ID than Modbus are likely sent
+		// by scanners or clients talking another protocol.
+		if req.ProtocolID != modbusProtocolID {
+			if s.invalidProtocolStrategy == CloseOnInvalidProtocol {
+				return fmt.Errorf("received frame with invalid protocol ID %d", req.ProtocolID)
+			}
+
+			s.logger().Info("dropped frame with invalid protocol ID", remoteAddrField(remoteAddr), Field{Key: "protocol_id", Value: req.ProtocolID})
+			continue
+		}
+
+		if !req.validLength() {
+			if s.lengthMismatchStrategy == CloseOnLengthMismatch {
+				return fmt.Errorf("received frame with length %d not matching function code %d", req.Length, req.FunctionCode)
+			}
+
+			s.logger().Info("dropped frame with mismatching length", append([]Field{remoteAddrField(remoteAddr)}, requestFields(req)...)...)
+			continue
+		}
+		req.ctx = ctx
+		req.remoteAddr = remoteAddr
+
+		// Rejected requests are answered with an exception like
+		// requests which are executed, so they're subject to the same
+		// write deadline and statistics.
+		req.denied = s.authorize(role, req)
+
+		if p != nil {
+			p.execute(ctx, req)
+			continue
+		}
+
+		if err := s.extendWriteDeadline(conn); err != nil {
+			return fmt.Errorf("failed to set write deadline: %v", err)
+		}
+
+		// Handlers write the response themselves, errWriter catches
+		// write failures like an expired write deadline.
+		w := &errWriter{w: conn, l: s.logger()}
+
+		reqCtx, cancel := s.requestContext(ctx)
+		req.ctx = reqCtx
+
+		stop := watchDisconnect(conn, r, cancel)
+		err = s.instrumentedExecute(w, &req)
+		stop()
+		cancel()
+		s.stats.written(w.n)
+
+		// Handlers report failed writes as well, those are handled
+		// below.
+		if err != nil && w.err == nil {
 			return fmt.Errorf("something went horribly wrong and server has to close connection: %v", err)
 		}
+
+		if w.err != nil {
+			return fmt.Errorf("failed to write response: %v", w.err)
+		}
+
+		// The request has been answered, so the connection can be
+		// closed when the server shuts down.
+		if s.isClosed() {
+			return nil
+		}
 	}
 }
 
@@ -98,10 +829,17 @@ func (s *Server) readMessage(r *bufio.Reader) ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	// The length covers the unit ID and the PDU, which consists of at
+	// least a function code. A PDU is at most 253 bytes.
 	length := binary.BigEndian.Uint16(b[4:6])
+	if length < minMBAPLength || length > maxMBAPLength {
+		return nil, fmt.Errorf("MBAP header has invalid length of %d", length)
+	}
 
+	// The header and the PDU can arrive in separate TCP segments, so
+	// reading continues until the whole frame has been read.
 	buf := make([]byte, 6+length)
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to read request: %v", err)
@@ -111,13 +849,79 @@ func (s *Server) readMessage(r *bufio.Reader) ([]byte, error) {
 }
 
 func (s *Server) executeAndRespond(conn io.Writer, req *Request) error {
-	h, ok := s.handlers[req.FunctionCode]
-	if ok {
-		h.ServeModbus(conn, *req)
+	req.errorMapper = s.errorMapper
+
+	if req.denied != nil {
+		// Broadcast requests are never answered, not even when
+		// they're rejected.
+		if req.UnitID == broadcastUnitID && !s.noBroadcast {
+			s.logger().Info("rejected broadcast request", append(requestFields(*req), errField(req.denied))...)
+			return nil
+		}
+
+		return writeErrorResponse(conn, req, req.denied)
+	}
+
+	if req.UnitID == broadcastUnitID && !s.noBroadcast {
+		s.executeBroadcast(req)
 		return nil
 	}
 
-	resp := NewErrorResponse(*req, IllegalFunctionError)
+	if s.units != nil && !s.units[req.UnitID] {
+		if s.unknownUnitStrategy == DropUnknownUnits {
+			return nil
+		}
+
+		return writeErrorResponse(conn, req, GatewayTargetDeviceFailedToRespondError)
+	}
+
+	h, ok := s.handlers[req.FunctionCode]
+	if !ok {
+		h = s.defaultHandler
+	}
+
+	if h != nil {
+		return s.serveModbus(s.wrap(req.FunctionCode, h), conn, *req)
+	}
+
+	return writeErrorResponse(conn, req, IllegalFunctionError)
+}
+
+// broadcastUnitID is the unit ID of requests sent to all devices.
+const broadcastUnitID = 0
+
+// isWriteFunctionCode returns true for function codes which only write data.
+func isWriteFunctionCode(functionCode uint8) bool {
+	switch functionCode {
+	case WriteSingleCoil, WriteSingleRegister, WriteMultipleCoils, WriteMultipleRegisters, WriteFileRecord, MaskWriteRegister:
+		return true
+	}
+
+	return false
+}
+
+// executeBroadcast executes a broadcast request. Only write requests are
+// executed and they're never answered, errors are logged instead.
+func (s *Server) executeBroadcast(req *Request) {
+	h, ok := s.handlers[req.FunctionCode]
+	if !ok || !isWriteFunctionCode(req.FunctionCode) {
+		return
+	}
+
+	w := &recordingWriter{w: ioutil.Discard}
+	if err := s.serveModbus(s.wrap(req.FunctionCode, h), w, *req); err != nil {
+		s.logger().Error("failed to execute broadcast request", append(requestFields(*req), errField(err))...)
+		return
+	}
+
+	if w.exception != 0 {
+		s.logger().Error("failed to execute broadcast request", append(requestFields(*req), Field{Key: "exception_code", Value: w.exception})...)
+	}
+}
+
+// writeErrorResponse writes an exception response on req to conn.
+func writeErrorResponse(conn io.Writer, req *Request, e error) error {
+	resp := NewErrorResponse(*req, e)
 	data, err := resp.MarshalBinary()
 	if err != nil {
 		return fmt.Errorf("failed to create response: %v", err)
@@ -130,15 +934,454 @@ func (s *Server) executeAndRespond(conn io.Writer, req *Request) error {
 	return nil
 }
 
-// Handle registers the handler for the given function code.
-func (s *Server) Handle(functionCode uint8, h Handler) {
-	s.handlers[functionCode] = h
+// lenWriter is implemented by writers which know how many bytes have been
+// written to them, like *bytes.Buffer.
+type lenWriter interface {
+	Len() int
+}
+
+// serveModbus lets h handle req. A panic in h is recovered, unless recovery
+// has been disabled. It returns the error of h when h implements HandlerE.
+func (s *Server) serveModbus(h Handler, w io.Writer, req Request) (err error) {
+	if s.noPanicRecovery {
+		return serveModbusE(h, w, req)
+	}
+
+	// written returns true when data has been written to w since the
+	// handler has been called. When unknown it assumes nothing has been
+	// written.
+	written := func() bool { return false }
+	if lw, ok := w.(lenWriter); ok {
+		n := lw.Len()
+		written = func() bool { return lw.Len() != n }
+	}
+
+	defer func() {
+		if v := recover(); v != nil {
+			s.logger().Error("panic while handling request", append(requestFields(req), Field{Key: "panic", Value: v}, Field{Key: "stack", Value: string(debug.Stack())})...)
+
+			// The handler might have panicked after responding,
+			// a second response would confuse the client.
+			if !written() {
+				err = respond(w, NewErrorResponse(req, SlaveDeviceFailureError))
+			}
+		}
+	}()
+
+	return serveModbusE(h, w, req)
 }
 
-func (s *Server) logf(format string, args ...interface{}) {
-	if s.ErrorLog != nil {
-		s.ErrorLog.Printf(format, args...)
+// Addr returns the address the server listens on. It returns nil when the
+// server doesn't listen on a network address.
+func (s *Server) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch {
+	case s.l != nil:
+		return s.l.Addr()
+	case s.pc != nil:
+		return s.pc.LocalAddr()
+	}
+
+	return nil
+}
+
+// Close stops the server by closing its listener, connections which are
+// already accepted are not closed. Calling Close more than once returns the
+// result of the first call.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		s.closed = true
+		if s.done == nil {
+			s.done = make(chan struct{})
+		}
+		close(s.done)
+
+		switch {
+		case s.l != nil:
+			s.closeErr = s.l.Close()
+		case s.pc != nil:
+			s.closeErr = s.pc.Close()
+		}
+	})
+
+	return s.closeErr
+}
+
+// shutdownPollInterval is the interval at which Shutdown checks if all
+// connections are idle.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// Shutdown gracefully stops the server. It closes the listener, then waits
+// until the requests currently being executed are answered and closes all
+// connections. When ctx expires before that, all connections are closed
+// immediately and the error of ctx is returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	err := s.Close()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	for {
+		if s.closeIdleConns() {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			s.closeAllConns()
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// connState is the state of a connection accepted by the server.
+type connState struct {
+	// active is the number of requests the connection is executing. It's
+	// guarded by the mutex of the server.
+	active int
+
+	// cancel cancels the context of the connection.
+	cancel context.CancelFunc
+
+	// mu serializes calls of the ConnState callback, closed is true once
+	// StateClosed has been reported.
+	mu     sync.Mutex
+	closed bool
+}
+
+// setConnState reports the new state of conn to the ConnState callback.
+// Nothing is reported after StateClosed.
+func (s *Server) setConnState(conn net.Conn, state *connState, cs ConnState) {
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	s.reportConnState(conn, state, cs)
+}
+
+// reportConnState is like setConnState, but expects the caller to hold the
+// mutex of state.
+func (s *Server) reportConnState(conn net.Conn, state *connState, cs ConnState) {
+	if state.closed {
+		return
+	}
+	state.closed = cs == StateClosed
+
+	if s.ConnState != nil {
+		s.ConnState(conn, cs)
+	}
+}
+
+// trackConn registers conn as an idle connection. The cancel function is
+// called when conn is closed.
+func (s *Server) trackConn(conn net.Conn, cancel context.CancelFunc) {
+	state := &connState{cancel: cancel}
+	s.setConnState(conn, state, StateNew)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.conns == nil {
+		s.conns = make(map[net.Conn]*connState)
+	}
+	s.conns[conn] = state
+}
+
+// setConnActive marks conn as active while it's handling a request. A
+// connection executing several requests concurrently is idle when all of
+// them are done.
+func (s *Server) setConnActive(conn io.ReadWriteCloser, active bool) {
+	c, ok := conn.(net.Conn)
+	if !ok {
+		return
+	}
+
+	s.mu.Lock()
+	state, ok := s.conns[c]
+	s.mu.Unlock()
+
+	if !ok {
+		return
+	}
+
+	// The mutex of state is held while updating the number of active
+	// requests, so the transitions are reported in order.
+	state.mu.Lock()
+	defer state.mu.Unlock()
+
+	s.mu.Lock()
+	if active {
+		state.active++
 	} else {
-		log.Printf(format, args...)
+		state.active--
+	}
+	n := state.active
+	s.mu.Unlock()
+
+	switch {
+	case active && n == 1:
+		s.reportConnState(c, state, StateActive)
+	case !active && n == 0:
+		s.reportConnState(c, state, StateIdle)
 	}
 }
+
+// closeConn closes conn, unless it has been closed by the server already.
+func (s *Server) closeConn(conn net.Conn) error {
+	s.mu.Lock()
+	state, ok := s.conns[conn]
+	if !ok {
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.conns, conn)
+	s.mu.Unlock()
+
+	state.cancel()
+	err := conn.Close()
+	s.setConnState(conn, state, StateClosed)
+
+	return err
+}
+
+// closeIdleConns closes all idle connections. It returns true when no
+// connections are left.
+func (s *Server) closeIdleConns() bool {
+	s.mu.Lock()
+	idle := make(map[net.Conn]*connState)
+	for c, state := range s.conns {
+		if state.active == 0 {
+			idle[c] = state
+			delete(s.conns, c)
+		}
+	}
+	left := len(s.conns)
+	s.mu.Unlock()
+
+	s.closeConns(idle)
+
+	return left == 0
+}
+
+// closeAllConns closes all connections, including active ones.
+func (s *Server) closeAllConns() {
+	s.mu.Lock()
+	conns := s.conns
+	s.conns = nil
+	s.mu.Unlock()
+
+	s.closeConns(conns)
+}
+
+// closeConns closes connections which are no longer tracked.
+func (s *Server) closeConns(conns map[net.Conn]*connState) {
+	for c, state := range conns {
+		state.cancel()
+		if err := c.Close(); err != nil {
+			s.logger().Error("failed to close connection", remoteAddrField(c.RemoteAddr()), errField(err))
+		}
+		s.setConnState(c, state, StateClosed)
+	}
+}
+
+// doneChan returns a channel which is closed when the server is closed.
+func (s *Server) doneChan() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.done == nil {
+		s.done = make(chan struct{})
+	}
+
+	return s.done
+}
+
+func (s *Server) isClosed() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.closed
+}
+
+// errStarted is returned when handlers, middleware or settings are changed
+// after the server started serving requests.
+var errStarted = errors.New("server already started")
+
+// start marks the server as started, after which handlers and middleware
+// can't be registered anymore.
+func (s *Server) start() {
+	s.mu.Lock()
+	s.started = true
+	s.mu.Unlock()
+
+	s.stats.start()
+}
+
+// configure calls f while holding the mutex of the server, so f can change
+// the handlers and middleware. It returns an error when the server already
+// started, as those are read without locking while serving requests.
+func (s *Server) configure(f func()) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.started {
+		return errStarted
+	}
+
+	f()
+	return nil
+}
+
+// Handle registers the handler for the given function code. Handlers must be
+// registered before the server starts serving requests. It returns an error
+// when the handler is nil, when the function code is outside the range of 1
+// through 127 or when the server already started.
+func (s *Server) Handle(functionCode uint8, h Handler) error {
+	if h == nil {
+		return errors.New("handler is nil")
+	}
+
+	if functionCode < 1 || functionCode > 127 {
+		return fmt.Errorf("invalid function code %d", functionCode)
+	}
+
+	return s.configure(func() {
+		s.setHandler(functionCode, h)
+	})
+}
+
+// setHandler registers the handler for the given function code. The mutex of
+// the server must be held.
+func (s *Server) setHandler(functionCode uint8, h Handler) {
+	if s.handlers == nil {
+		s.handlers = make(map[uint8]Handler)
+	}
+
+	s.handlers[functionCode] = h
+}
+
+// SetDefaultHandler sets the handler for requests with a function code without
+// handler. By default those requests are answered with an
+// IllegalFunctionError. It returns an error when the server already started.
+func (s *Server) SetDefaultHandler(h Handler) error {
+	return s.configure(func() {
+		s.defaultHandler = h
+	})
+}
+
+// HandleFunc registers the handler function for the given function code. It
+// returns an error under the same conditions as Handle.
+func (s *Server) HandleFunc(functionCode uint8, f func(w io.Writer, r Request)) error {
+	if f == nil {
+		return errors.New("handler is nil")
+	}
+
+	return s.Handle(functionCode, HandlerFunc(f))
+}
+
+// HandleRead registers a ReadHandler for the given function code. It returns
+// an error when the function code isn't 1, 2, 3 or 4.
+func (s *Server) HandleRead(functionCode uint8, f ReadHandlerFunc) error {
+	switch functionCode {
+	case ReadCoils, ReadDiscreteInputs, ReadHoldingRegisters, ReadInputRegisters:
+	default:
+		return fmt.Errorf("function code %d isn't a read function code", functionCode)
+	}
+
+	return s.Handle(functionCode, NewReadHandler(f))
+}
+
+// HandleWrite registers a WriteHandler for the given function code. It returns
+// an error when the function code isn't 5, 6, 15 or 16.
+func (s *Server) HandleWrite(functionCode uint8, f WriteHandlerFunc, signedness Signedness) error {
+	switch functionCode {
+	case WriteSingleCoil, WriteSingleRegister, WriteMultipleCoils, WriteMultipleRegisters:
+	default:
+		return fmt.Errorf("function code %d isn't a write function code", functionCode)
+	}
+
+	return s.Handle(functionCode, NewWriteHandler(f, signedness))
+}
+
+// Middleware wraps a Handler, for example to add logging or authorization to
+// it. Middleware can short-circuit a request by writing a response itself
+// without calling the wrapped handler.
+type Middleware func(Handler) Handler
+
+// Use adds middleware which is applied to the handlers of all function
+// codes. The middleware added first is the outermost, so it sees a request
+// first. Middleware applies to handlers registered before and after calling
+// Use. It returns an error when the server already started.
+func (s *Server) Use(mw ...Middleware) error {
+	return s.configure(func() {
+		s.middleware = append(s.middleware, mw...)
+	})
+}
+
+// UseFor adds middleware which is only applied to the handler of the given
+// function code. It runs inside the middleware added with Use. It returns an
+// error when the server already started.
+func (s *Server) UseFor(functionCode uint8, mw ...Middleware) error {
+	return s.configure(func() {
+		if s.fcMiddleware == nil {
+			s.fcMiddleware = make(map[uint8][]Middleware)
+		}
+
+		s.fcMiddleware[functionCode] = append(s.fcMiddleware[functionCode], mw...)
+	})
+}
+
+// wrap wraps h, the handler of given function code, in its middleware.
+func (s *Server) wrap(functionCode uint8, h Handler) Handler {
+	fcMiddleware := s.fcMiddleware[functionCode]
+	for i := len(fcMiddleware) - 1; i >= 0; i-- {
+		h = fcMiddleware[i](h)
+	}
+
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+
+	return h
+}
+
+// HandleMEI registers the handler for the given MEI type. Requests with
+// function code 43 are dispatched on their MEI type, so handlers for several
+// MEI types can coexist. It returns an error under the same conditions as
+// Handle.
+func (s *Server) HandleMEI(meiType uint8, h Handler) error {
+	if h == nil {
+		return errors.New("handler is nil")
+	}
+
+	return s.configure(func() {
+		m, ok := s.handlers[EncapsulatedInterfaceTransport].(*MEIHandler)
+		if !ok {
+			m = NewMEIHandler()
+			s.setHandler(EncapsulatedInterfaceTransport, m)
+		}
+
+		m.Handle(meiType, h)
+	})
+}
+
+// SetDeviceIdentification registers a handler responding on read device
+// identification requests with the given identification.
+func (s *Server) SetDeviceIdentification(id DeviceIdentification) error {
+	return s.HandleMEI(ReadDeviceIdentification, NewDeviceIdentificationHandler(id))
+}
+
+// logger returns the logger of the server. When no Logger is set, ErrorLog
+// is used.
+func (s *Server) logger() Logger {
+	if s.Logger != nil {
+		return s.Logger
+	}
+
+	return NewStdLogger(s.ErrorLog)
+}
@@ -3,8 +3,17 @@ package modbus
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
 	"time"
 
@@ -24,13 +33,57 @@ func (h RawHandler) ServeModbus(w io.Writer, r Request) {
 	h.handle(w, r)
 }
 
+// failingHandler is a HandlerE which fails after writing a response.
+type failingHandler struct{}
+
+func (h failingHandler) ServeModbus(w io.Writer, r Request) {
+	h.ServeModbusE(w, r)
+}
+
+func (h failingHandler) ServeModbusE(w io.Writer, r Request) error {
+	respond(w, NewResponse(r, []byte{0x0, 0xa}))
+	return errors.New("connection unusable")
+}
+
+func TestHandlerE(t *testing.T) {
+	var s Server
+	s.Handle(ReadHoldingRegisters, failingHandler{})
+
+	req := []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}
+	w := new(bytes.Buffer)
+	conn := &deadlineConn{
+		Reader: bytes.NewReader(bytes.Repeat(req, 2)),
+		Writer: w,
+	}
+
+	// The connection is closed after the first request.
+	err := s.handleConn(context.Background(), conn)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "connection unusable")
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, w.Bytes())
+
+	// The built-in handlers report write failures.
+	handlers := []HandlerE{
+		NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+			return []Value{Value{0xa}}, nil
+		}),
+		NewUnitMux(),
+		NewMEIHandler(),
+	}
+
+	for _, h := range handlers {
+		assert.NotNil(t, h.ServeModbusE(ErrorWriter{}, Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}))
+		assert.Nil(t, h.ServeModbusE(new(bytes.Buffer), Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}))
+	}
+}
+
 func TestSetTimeout(t *testing.T) {
-	s, err := NewServer(":")
+	s, err := NewServer("127.0.0.1:0")
 	assert.Nil(t, err)
-	assert.Equal(t, 0*time.Second, s.timeout)
+	assert.Equal(t, 0*time.Second, s.idleTimeout)
 
 	s.SetTimeout(5 * time.Second)
-	assert.Equal(t, 5*time.Second, s.timeout)
+	assert.Equal(t, 5*time.Second, s.idleTimeout)
 }
 
 // Connection is a struct implemention the io.ReadWriteCloser interface.
@@ -49,6 +102,9 @@ func (c Connection) Close() error { return c.close() }
 func TestListen(t *testing.T) {
 	s := Server{}
 
+	// The request is sent to unit ID 0, which must be answered.
+	WithBroadcast(false)(&s)
+
 	conn := Connection{
 		read: func(b []byte) (int, error) {
 			copy(b, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x0, 0x0, 0x0})
@@ -60,14 +116,14 @@ func TestListen(t *testing.T) {
 		},
 	}
 
-	err := s.handleConn(conn)
+	err := s.handleConn(context.Background(), conn)
 	assert.NotNil(t, err)
 
 	conn.read = func(b []byte) (int, error) {
 		return 0, errors.New("")
 	}
 
-	err = s.handleConn(conn)
+	err = s.handleConn(context.Background(), conn)
 	assert.NotNil(t, err)
 }
 
@@ -83,6 +139,7 @@ func TestReadMessage(t *testing.T) {
 		{[]byte{0x0, 0x0, 0x0}},
 		{[]byte{0x0, 0x0, 0x0, 0x0}},
 		{[]byte{0x0, 0x0, 0x0, 0x0, 0x0}},
+		{[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0}},
 	}
 
 	for _, test := range tests {
@@ -90,7 +147,7 @@ func TestReadMessage(t *testing.T) {
 		assert.NotNil(t, err)
 	}
 
-	data := []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x0}
+	data := []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x2, 0x1, 0x3}
 	msg, err := s.readMessage(bufio.NewReader(bytes.NewReader(data)))
 
 	assert.Nil(t, err)
@@ -98,9 +155,9 @@ func TestReadMessage(t *testing.T) {
 }
 
 func TestExecuteAndRespond(t *testing.T) {
-	s, _ := NewServer(":")
+	s, _ := NewServer("127.0.0.1:0")
 	writer := new(bytes.Buffer)
-	req := &Request{FunctionCode: ReadCoils}
+	req := &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadCoils}
 
 	// Try to execute a non-implemented function code. This fails,
 	// therefore the server tries to send a IllegalFunction exception
@@ -115,7 +172,7 @@ func TestExecuteAndRespond(t *testing.T) {
 	err = s.executeAndRespond(writer, req)
 
 	assert.Nil(t, err)
-	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x81, 0x1}, writer.Bytes())
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x81, 0x1}, writer.Bytes())
 
 	// Try again, but now executing an implemented function code.
 	// Everything should work.
@@ -130,3 +187,1309 @@ func TestExecuteAndRespond(t *testing.T) {
 	err = s.executeAndRespond(writer, req)
 	assert.Nil(t, err)
 }
+
+func TestHandleMEI(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s.SetDeviceIdentification(DeviceIdentification{VendorName: "ACS"})
+	s.HandleMEI(CANopenGeneralReference, NewMEIFuncHandler(func(unitID int, data []byte) ([]byte, error) {
+		return data, nil
+	}))
+
+	writer := new(bytes.Buffer)
+	assert.Nil(t, s.executeAndRespond(writer, &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xd, 0x1}}))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x4, 0x1, 0x2b, 0xd, 0x1}, writer.Bytes())
+
+	writer.Reset()
+	assert.Nil(t, s.executeAndRespond(writer, &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: EncapsulatedInterfaceTransport, Data: []byte{0xe, 0x4, 0x0}}))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xd, 0x1, 0x2b, 0xe, 0x4, 0x81, 0x0, 0x0, 0x1, 0x0, 0x3, 0x41, 0x43, 0x53}, writer.Bytes())
+}
+
+func TestHandle(t *testing.T) {
+	var s Server
+	h := NewPDUHandler(func(unitID int, data []byte) ([]byte, error) { return data, nil })
+
+	assert.Nil(t, s.Handle(1, h))
+	assert.Nil(t, s.Handle(127, h))
+	assert.NotNil(t, s.Handle(0, h))
+	assert.NotNil(t, s.Handle(128, h))
+	assert.NotNil(t, s.Handle(0xff, h))
+	assert.NotNil(t, s.Handle(1, nil))
+	assert.NotNil(t, s.HandleMEI(ReadDeviceIdentification, nil))
+
+	// Handlers, middleware and settings can't be changed once the server
+	// is serving requests.
+	l := pipeListener{conns: make(chan net.Conn)}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	conn := l.dial()
+	_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x1, 0x7f, 0x2})
+	assert.Nil(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 9))
+	assert.Nil(t, err)
+
+	mw := func(h Handler) Handler { return h }
+	assert.Equal(t, errStarted, s.Handle(2, h))
+	assert.Equal(t, errStarted, s.HandleMEI(ReadDeviceIdentification, NewDeviceIdentificationHandler(DeviceIdentification{})))
+	assert.Equal(t, errStarted, s.SetDefaultHandler(h))
+	assert.Equal(t, errStarted, s.Use(mw))
+	assert.Equal(t, errStarted, s.UseFor(1, mw))
+	assert.Equal(t, errStarted, s.SetErrorMapper(func(error) Error { return IllegalAddressError }))
+	assert.Equal(t, errStarted, s.SetIdleTimeout(time.Second))
+	assert.Equal(t, errStarted, s.SetRequestTimeout(time.Second))
+	assert.Equal(t, errStarted, s.SetWriteTimeout(time.Second))
+	assert.Equal(t, errStarted, s.ServeUnits(1))
+	assert.Equal(t, errStarted, s.SetUnknownUnitStrategy(DropUnknownUnits))
+	assert.Equal(t, errStarted, s.SetInvalidProtocolStrategy(CloseOnInvalidProtocol))
+	assert.Equal(t, errStarted, s.SetLengthMismatchStrategy(CloseOnLengthMismatch))
+	assert.Equal(t, errStarted, s.SetConnFilter(func(net.Addr) error { return nil }))
+	assert.Equal(t, errStarted, s.Instrument(&recordingInstrumentation{}))
+	assert.Equal(t, errStarted, s.SetAuthorizer(func(string, Request) error { return nil }))
+	assert.Equal(t, errStarted, s.SetDefaultRole("viewer"))
+
+	assert.Nil(t, conn.Close())
+	assert.Nil(t, s.Close())
+	assert.Nil(t, <-done)
+
+	_, ok := s.handlers[2]
+	assert.False(t, ok)
+	assert.Nil(t, s.defaultHandler)
+	assert.Nil(t, s.middleware)
+}
+
+// pipeListener is a net.Listener returning connections created with
+// net.Pipe.
+type pipeListener struct {
+	conns chan net.Conn
+}
+
+func (l pipeListener) Accept() (net.Conn, error) {
+	c, ok := <-l.conns
+	if !ok {
+		return nil, errors.New("listener is closed")
+	}
+
+	return c, nil
+}
+
+func (l pipeListener) Close() error {
+	close(l.conns)
+	return nil
+}
+
+func (l pipeListener) Addr() net.Addr { return &net.UnixAddr{Name: "pipe", Net: "pipe"} }
+
+// dial returns the client side of a new connection with the listener.
+func (l pipeListener) dial() net.Conn {
+	client, server := net.Pipe()
+	l.conns <- server
+	return client
+}
+
+func TestServe(t *testing.T) {
+	var s Server
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	conn := l.dial()
+	_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, buf)
+	assert.Nil(t, conn.Close())
+
+	// Serve returns an error when the listener fails, but not after the
+	// server has been closed.
+	assert.Nil(t, l.Close())
+	assert.NotNil(t, <-done)
+
+	var closed Server
+	l = pipeListener{conns: make(chan net.Conn)}
+	go func() {
+		done <- closed.Serve(l)
+	}()
+
+	assert.Nil(t, closed.Close())
+	assert.Nil(t, <-done)
+}
+
+func TestServeClosesPreviousListener(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+	addr := s.Addr().String()
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	// Once l accepts connections, the listener created by NewServer has
+	// been closed.
+	conn := l.dial()
+	_, err = net.Dial("tcp", addr)
+	assert.NotNil(t, err)
+
+	assert.Nil(t, conn.Close())
+	assert.Nil(t, s.Close())
+	assert.Nil(t, <-done)
+}
+
+// flakyListener is a pipeListener failing with a temporary error a number of
+// times before accepting connections.
+type flakyListener struct {
+	pipeListener
+	failures int
+
+	mu       sync.Mutex
+	failed   int
+	attempts []time.Time
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	l.attempts = append(l.attempts, time.Now())
+	if l.failed < l.failures {
+		l.failed++
+		l.mu.Unlock()
+		return nil, &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", syscall.EMFILE)}
+	}
+	l.mu.Unlock()
+
+	return l.pipeListener.Accept()
+}
+
+func TestServeTemporaryError(t *testing.T) {
+	l := new(recordingLogger)
+
+	s := Server{Logger: l}
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	fl := &flakyListener{pipeListener: pipeListener{conns: make(chan net.Conn)}, failures: 4}
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(fl)
+	}()
+
+	// Accepting is retried after 5, 10, 20 and 40ms.
+	conn := fl.dial()
+	_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Nil(t, conn.Close())
+
+	fl.mu.Lock()
+	attempts := fl.attempts[:5]
+	fl.mu.Unlock()
+
+	for i, delay := range []time.Duration{5, 10, 20, 40} {
+		assert.True(t, attempts[i+1].Sub(attempts[i]) >= delay*time.Millisecond, fmt.Sprintf("retry %d", i))
+	}
+	assert.Len(t, l.recorded("error"), 4)
+
+	assert.Nil(t, s.Close())
+	assert.Nil(t, <-done)
+}
+
+func TestBackoff(t *testing.T) {
+	var b backoff
+
+	var delays []time.Duration
+	for i := 0; i < 10; i++ {
+		delays = append(delays, b.next())
+	}
+
+	assert.Equal(t, []time.Duration{
+		5 * time.Millisecond, 10 * time.Millisecond, 20 * time.Millisecond, 40 * time.Millisecond,
+		80 * time.Millisecond, 160 * time.Millisecond, 320 * time.Millisecond, 640 * time.Millisecond,
+		time.Second, time.Second,
+	}, delays)
+
+	b.reset()
+	assert.Equal(t, 5*time.Millisecond, b.next())
+
+	assert.True(t, temporary(&net.OpError{Op: "accept", Err: os.NewSyscallError("accept", syscall.EMFILE)}))
+	assert.False(t, temporary(errors.New("listener is closed")))
+}
+
+func TestClose(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	addr := s.Addr().String()
+	done := make(chan struct{})
+	go func() {
+		s.Listen()
+		close(done)
+	}()
+
+	assert.Nil(t, s.Close())
+	<-done
+
+	// The second call returns the result of the first call.
+	assert.Nil(t, s.Close())
+
+	// The port has been released.
+	l, err := net.Listen("tcp", addr)
+	assert.Nil(t, err)
+	assert.Nil(t, l.Close())
+}
+
+func TestShutdown(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	var s Server
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		close(started)
+		<-release
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn, 2)}
+	go s.Serve(l)
+
+	// One connection executes a long-running request, the other is idle.
+	active := l.dial()
+	idle := l.dial()
+
+	go func() {
+		_, err := active.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+		assert.Nil(t, err)
+	}()
+	<-started
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// The idle connection is closed, while the request on the active
+	// connection is still being executed.
+	_, err := idle.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	select {
+	case <-done:
+		t.Fatal("Shutdown returned before request was answered")
+	default:
+	}
+
+	close(release)
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(active, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, buf)
+
+	assert.Nil(t, <-done)
+}
+
+// TestShutdownReceivingRequest verifies that Shutdown doesn't close a
+// connection while it's receiving a request.
+func TestShutdownReceivingRequest(t *testing.T) {
+	states := make(chan ConnState, 10)
+
+	var s Server
+	s.ConnState = func(conn net.Conn, state ConnState) {
+		states <- state
+	}
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn, 1)}
+	go s.Serve(l)
+
+	conn := l.dial()
+	assert.Equal(t, StateNew, <-states)
+
+	// Only the MBAP header has been delivered.
+	_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6})
+	assert.Nil(t, err)
+
+	select {
+	case state := <-states:
+		assert.Equal(t, StateActive, state)
+	case <-time.After(time.Second):
+		t.Fatal("connection isn't active while receiving request")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- s.Shutdown(context.Background())
+	}()
+
+	// Give Shutdown a few polls to close idle connections.
+	time.Sleep(3 * shutdownPollInterval)
+
+	_, err = conn.Write([]byte{0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, buf)
+
+	assert.Nil(t, <-done)
+}
+
+func TestShutdownTimeout(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+	defer close(release)
+
+	var s Server
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		close(started)
+		<-release
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn, 1)}
+	go s.Serve(l)
+
+	conn := l.dial()
+	go func() {
+		_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+		assert.Nil(t, err)
+	}()
+	<-started
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	// The request isn't answered in time, so the connection is closed.
+	assert.Equal(t, context.DeadlineExceeded, s.Shutdown(ctx))
+
+	_, err := conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestAddr(t *testing.T) {
+	var s Server
+	assert.Nil(t, s.Addr())
+
+	tcp, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, tcp.Addr().(*net.TCPAddr).Port)
+
+	// The address is still available after the server has been closed.
+	assert.Nil(t, tcp.Close())
+	assert.NotNil(t, tcp.Addr())
+
+	udp, err := NewUDPServer("127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.NotEqual(t, 0, udp.Addr().(*net.UDPAddr).Port)
+	assert.Nil(t, udp.Close())
+}
+
+func TestBaseContext(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	started := make(chan struct{})
+	errs := make(chan error, 1)
+
+	var s Server
+	s.BaseContext = func(net.Listener) context.Context { return ctx }
+	s.Handle(ReadHoldingRegisters, RawHandler{
+		handle: func(w io.Writer, r Request) {
+			close(started)
+			<-r.Context().Done()
+			errs <- r.Context().Err()
+			respond(w, NewErrorResponse(r, SlaveDeviceFailureError))
+		},
+	})
+
+	l := pipeListener{conns: make(chan net.Conn, 1)}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn := l.dial()
+	go func() {
+		_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+		assert.Nil(t, err)
+	}()
+	<-started
+
+	// Canceling the base context cancels the context of the request and
+	// closes the connection.
+	cancel()
+	assert.Equal(t, context.Canceled, <-errs)
+
+	_, err := io.Copy(ioutil.Discard, conn)
+	assert.Nil(t, err)
+}
+
+// deadlineConn is a connection recording its read deadlines.
+type deadlineConn struct {
+	io.Reader
+	io.Writer
+	deadlines []time.Time
+}
+
+func (c *deadlineConn) Close() error { return nil }
+
+func (c *deadlineConn) SetReadDeadline(t time.Time) error {
+	c.deadlines = append(c.deadlines, t)
+	return nil
+}
+
+func TestReadDeadline(t *testing.T) {
+	var s Server
+	s.SetTimeout(time.Second)
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	req := []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}
+	conn := &deadlineConn{
+		Reader: bytes.NewReader(bytes.Repeat(req, 3)),
+		Writer: new(bytes.Buffer),
+	}
+
+	start := time.Now()
+	assert.Nil(t, s.handleConn(context.Background(), conn))
+
+	// The deadline is extended before every request and before the
+	// final read which returns io.EOF.
+	assert.Len(t, conn.deadlines, 4)
+	for i, d := range conn.deadlines {
+		assert.False(t, d.Before(start.Add(time.Second)))
+		if i > 0 {
+			assert.False(t, d.Before(conn.deadlines[i-1]))
+		}
+	}
+}
+
+func TestWriteTimeout(t *testing.T) {
+	logs := new(bytes.Buffer)
+
+	var s Server
+	s.ErrorLog = log.New(logs, "", 0)
+	s.SetWriteTimeout(50 * time.Millisecond)
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn, 1)}
+	go s.Serve(l)
+	defer s.Close()
+
+	// The client sends a request, but never reads the response. Writing
+	// the response blocks until the write deadline expires, after which
+	// the connection is closed.
+	conn := l.dial()
+	_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	time.Sleep(100 * time.Millisecond)
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	assert.Contains(t, logs.String(), "goldfish: unable to handle requests remote_addr=pipe error=failed to write response")
+}
+
+func TestIdleTimeout(t *testing.T) {
+	l := new(recordingLogger)
+
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+	s.Logger = l
+	s.SetIdleTimeout(50 * time.Millisecond)
+
+	go s.Listen()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	// The server closes the connection after it has been idle for too
+	// long, which isn't an error.
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Nil(t, l.recorded("error"))
+	assert.Equal(t, []string{"closed idle connection"}, l.recorded("debug"))
+}
+
+func TestRequestTimeout(t *testing.T) {
+	var s Server
+	s.SetRequestTimeout(time.Second)
+
+	var deadline time.Time
+	var ok bool
+	s.Handle(ReadHoldingRegisters, RawHandler{
+		handle: func(w io.Writer, r Request) {
+			deadline, ok = r.Context().Deadline()
+			respond(w, NewResponse(r, []byte{0x0, 0xa}))
+		},
+	})
+
+	req := []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}
+	conn := &deadlineConn{
+		Reader: bytes.NewReader(req),
+		Writer: new(bytes.Buffer),
+	}
+
+	start := time.Now()
+	assert.Nil(t, s.handleConn(context.Background(), conn))
+
+	assert.True(t, ok)
+	assert.False(t, deadline.Before(start.Add(time.Second)))
+	assert.True(t, deadline.Before(time.Now().Add(time.Second)))
+}
+
+func TestHandlerContextDisconnect(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+	s.ErrorLog = log.New(ioutil.Discard, "", 0)
+
+	started := make(chan struct{})
+	result := make(chan error, 1)
+	s.Handle(ReadHoldingRegisters, NewReadHandlerCtx(func(ctx context.Context, unitID, start, quantity int) ([]Value, error) {
+		close(started)
+
+		select {
+		case <-ctx.Done():
+			result <- ctx.Err()
+		case <-time.After(5 * time.Second):
+			result <- nil
+		}
+		return nil, ctx.Err()
+	}))
+
+	go s.Listen()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.Nil(t, err)
+
+	_, err = conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	// The client disconnects while the request is executed.
+	<-started
+	assert.Nil(t, conn.Close())
+	assert.Equal(t, context.Canceled, <-result)
+}
+
+func TestMaxConnectionsBlock(t *testing.T) {
+	var s Server
+	WithMaxConnections(1, BlockConnections)(&s)
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+	defer s.Close()
+
+	first := l.dial()
+
+	// The second connection isn't accepted as long as the first
+	// connection is open.
+	dialed := make(chan net.Conn)
+	go func() {
+		dialed <- l.dial()
+	}()
+
+	select {
+	case <-dialed:
+		t.Fatal("connection has been accepted while limit was reached")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.Nil(t, first.Close())
+
+	select {
+	case conn := <-dialed:
+		assert.Nil(t, conn.Close())
+	case <-time.After(time.Second):
+		t.Fatal("connection hasn't been accepted after a slot was released")
+	}
+}
+
+func TestMaxConnectionsReject(t *testing.T) {
+	logs := new(bytes.Buffer)
+
+	var s Server
+	s.ErrorLog = log.New(logs, "", 0)
+	WithMaxConnections(1, RejectConnections)(&s)
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+
+	first := l.dial()
+	defer first.Close()
+
+	// The second connection is closed right away.
+	second := l.dial()
+	_, err := second.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	// The first connection is still served.
+	_, err = first.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+	_, err = io.ReadFull(first, make([]byte, 11))
+	assert.Nil(t, err)
+
+	assert.Nil(t, s.Close())
+	assert.Contains(t, logs.String(), "goldfish: rejected connection: maximum number of connections reached remote_addr=pipe max_connections=1")
+}
+
+func TestConnState(t *testing.T) {
+	var mu sync.Mutex
+	var states []ConnState
+	closed := make(chan struct{})
+
+	var s Server
+	s.ConnState = func(c net.Conn, cs ConnState) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		states = append(states, cs)
+		if cs == StateClosed {
+			close(closed)
+		}
+	}
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn := l.dial()
+	for i := 0; i < 2; i++ {
+		_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+		assert.Nil(t, err)
+		_, err = io.ReadFull(conn, make([]byte, 11))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, conn.Close())
+
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatal("connection hasn't been reported as closed")
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []ConnState{StateNew, StateActive, StateIdle, StateActive, StateIdle, StateClosed}, states)
+}
+
+func TestPanicRecovery(t *testing.T) {
+	logs := new(bytes.Buffer)
+
+	var s Server
+	s.ErrorLog = log.New(logs, "", 0)
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		if start == 1 {
+			panic("boom")
+		}
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn := l.dial()
+	defer conn.Close()
+
+	// The panic is answered with a SlaveDeviceFailureError.
+	_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x1, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 9)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x1, 0x83, 0x4}, buf)
+
+	// The connection keeps working.
+	_, err = conn.Write([]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	buf = make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, buf)
+
+	assert.Contains(t, logs.String(), "goldfish: panic while handling request transaction_id=1 unit_id=1 function_code=3 panic=boom")
+}
+
+func TestWithPanicRecovery(t *testing.T) {
+	var s Server
+	WithPanicRecovery(false)(&s)
+	s.Handle(ReadHoldingRegisters, RawHandler{
+		handle: func(w io.Writer, r Request) {
+			panic("boom")
+		},
+	})
+
+	req := Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadHoldingRegisters}
+	assert.Panics(t, func() {
+		s.executeAndRespond(new(bytes.Buffer), &req)
+	})
+}
+
+func TestUse(t *testing.T) {
+	var calls []string
+	middleware := func(name string) Middleware {
+		return func(h Handler) Handler {
+			return RawHandler{
+				handle: func(w io.Writer, r Request) {
+					calls = append(calls, name)
+					h.ServeModbus(w, r)
+				},
+			}
+		}
+	}
+
+	var s Server
+	s.Use(middleware("first"), middleware("second"))
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		calls = append(calls, "handler")
+		return []Value{Value{0xa}}, nil
+	}))
+	s.UseFor(ReadHoldingRegisters, middleware("third"))
+
+	// Middleware for a single function code only applies to that
+	// function code.
+	s.UseFor(ReadInputRegisters, middleware("fourth"))
+
+	// Middleware can short-circuit a request.
+	s.UseFor(ReadCoils, func(h Handler) Handler {
+		return RawHandler{
+			handle: func(w io.Writer, r Request) {
+				respond(w, NewErrorResponse(r, IllegalAddressError))
+			},
+		}
+	})
+	s.Handle(ReadCoils, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		calls = append(calls, "coils")
+		return nil, nil
+	}))
+
+	w := new(bytes.Buffer)
+	req := &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}
+	assert.Nil(t, s.executeAndRespond(w, req))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, w.Bytes())
+	assert.Equal(t, []string{"first", "second", "third", "handler"}, calls)
+
+	w.Reset()
+	calls = nil
+	req = &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadCoils, Data: []byte{0x0, 0x0, 0x0, 0x1}}
+	assert.Nil(t, s.executeAndRespond(w, req))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x81, 0x2}, w.Bytes())
+	assert.Equal(t, []string{"first", "second"}, calls)
+}
+
+func TestServeUnits(t *testing.T) {
+	var s Server
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	// All units are served by default.
+	w := new(bytes.Buffer)
+	assert.Nil(t, s.executeAndRespond(w, &Request{MBAP: MBAP{UnitID: 9}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x9, 0x3, 0x2, 0x0, 0xa}, w.Bytes())
+
+	s.ServeUnits(1, 2)
+
+	tests := []struct {
+		strategy UnknownUnitStrategy
+		unitID   uint8
+		expected []byte
+	}{
+		{RejectUnknownUnits, 2, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x2, 0x3, 0x2, 0x0, 0xa}},
+		{RejectUnknownUnits, 9, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x9, 0x83, 0xb}},
+		{DropUnknownUnits, 1, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}},
+		{DropUnknownUnits, 9, nil},
+	}
+
+	for _, test := range tests {
+		s.SetUnknownUnitStrategy(test.strategy)
+
+		w := new(bytes.Buffer)
+		req := &Request{MBAP: MBAP{UnitID: test.unitID}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}
+		assert.Nil(t, s.executeAndRespond(w, req))
+		assert.Equal(t, test.expected, w.Bytes())
+	}
+}
+
+func TestBroadcast(t *testing.T) {
+	logs := new(bytes.Buffer)
+
+	var written []int
+	var read bool
+
+	var s Server
+	s.ErrorLog = log.New(logs, "", 0)
+	s.Handle(WriteSingleRegister, NewWriteHandler(func(unitID, start int, values []Value) error {
+		written = append(written, values[0].Get())
+		if start > 0 {
+			return IllegalAddressError
+		}
+		return nil
+	}, Unsigned))
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		read = true
+		return []Value{Value{0xa}}, nil
+	}))
+
+	// Write requests are executed without a response, even when they
+	// fail. Read requests are ignored.
+	requests := []*Request{
+		{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+		{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x1, 0x0, 0x2}},
+		{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+	}
+
+	w := new(bytes.Buffer)
+	for _, req := range requests {
+		assert.Nil(t, s.executeAndRespond(w, req))
+	}
+
+	assert.Equal(t, 0, w.Len())
+	assert.Equal(t, []int{1, 2}, written)
+	assert.False(t, read)
+	assert.Contains(t, logs.String(), "goldfish: failed to execute broadcast request transaction_id=0 unit_id=0 function_code=6 exception_code=2")
+
+	// Without broadcast handling unit ID 0 is answered like any other.
+	WithBroadcast(false)(&s)
+	assert.Nil(t, s.executeAndRespond(w, requests[2]))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x0, 0x3, 0x2, 0x0, 0xa}, w.Bytes())
+	assert.True(t, read)
+}
+
+func TestInvalidProtocol(t *testing.T) {
+	var handled bool
+	h := NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		handled = true
+		return []Value{Value{0xa}}, nil
+	})
+
+	tests := []struct {
+		strategy InvalidProtocolStrategy
+		frame    string
+		logs     string
+		err      bool
+	}{
+		{DropInvalidProtocol, "\x00\x01\x00\x01\x00\x06\x01\x03\x00\x00\x00\x01", "goldfish: dropped frame with invalid protocol ID remote_addr=<nil> protocol_id=1\n", false},
+		{CloseOnInvalidProtocol, "\x00\x01\x00\x01\x00\x06\x01\x03\x00\x00\x00\x01", "", true},
+		// The first 6 bytes of a HTTP request are interpreted as MBAP
+		// header with an invalid length.
+		{DropInvalidProtocol, "GET / HTTP/1.1\r\n\r\n", "", true},
+	}
+
+	for _, test := range tests {
+		logs := new(bytes.Buffer)
+
+		var s Server
+		s.ErrorLog = log.New(logs, "", 0)
+		s.SetInvalidProtocolStrategy(test.strategy)
+		s.Handle(ReadHoldingRegisters, h)
+
+		conn := &deadlineConn{
+			Reader: strings.NewReader(test.frame),
+			Writer: new(bytes.Buffer),
+		}
+
+		err := s.handleConn(context.Background(), conn)
+		assert.Equal(t, test.err, err != nil)
+		assert.Equal(t, test.logs, logs.String())
+		assert.False(t, handled)
+		assert.Equal(t, 0, conn.Writer.(*bytes.Buffer).Len())
+	}
+}
+
+func TestHandleFunc(t *testing.T) {
+	var s Server
+
+	assert.Nil(t, s.HandleRead(ReadHoldingRegisters, func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+	assert.Nil(t, s.HandleWrite(WriteSingleRegister, func(unitID, start int, values []Value) error {
+		return nil
+	}, Signed))
+	assert.Nil(t, s.HandleFunc(0x41, func(w io.Writer, r Request) {
+		respond(w, NewRawResponse(r, []byte{0x1}))
+	}))
+
+	tests := []struct {
+		req      *Request
+		expected []byte
+	}{
+		{&Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}},
+		{&Request{MBAP: MBAP{UnitID: 1}, FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x0, 0x0, 0x1}}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x0, 0x0, 0x1}},
+		{&Request{MBAP: MBAP{UnitID: 1}, FunctionCode: 0x41}, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x41, 0x1}},
+	}
+
+	for _, test := range tests {
+		w := new(bytes.Buffer)
+		assert.Nil(t, s.executeAndRespond(w, test.req))
+		assert.Equal(t, test.expected, w.Bytes())
+	}
+
+	// The function code must match the kind of handler.
+	assert.NotNil(t, s.HandleRead(WriteSingleRegister, nil))
+	assert.NotNil(t, s.HandleWrite(ReadCoils, nil, Signed))
+	assert.NotNil(t, s.HandleFunc(0, nil))
+	assert.NotNil(t, s.HandleFunc(0x80, nil))
+}
+
+func TestDefaultHandler(t *testing.T) {
+	var s Server
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	// Without default handler, unknown function codes result in an
+	// IllegalFunctionError.
+	w := new(bytes.Buffer)
+	assert.Nil(t, s.executeAndRespond(w, &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: 0x41}))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0xc1, 0x1}, w.Bytes())
+
+	var codes []uint8
+	s.SetDefaultHandler(HandlerFunc(func(w io.Writer, r Request) {
+		codes = append(codes, r.FunctionCode)
+		respond(w, NewRawResponse(r, r.Data))
+	}))
+
+	w.Reset()
+	assert.Nil(t, s.executeAndRespond(w, &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: 0x41, Data: []byte{0x2}}))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x41, 0x2}, w.Bytes())
+
+	// Registered handlers take precedence.
+	w.Reset()
+	assert.Nil(t, s.executeAndRespond(w, &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}}))
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, w.Bytes())
+	assert.Equal(t, []uint8{0x41}, codes)
+}
+
+func TestRequestRemoteAddr(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	addrs := make(chan net.Addr, 1)
+	assert.Nil(t, s.HandleFunc(WriteSingleRegister, func(w io.Writer, r Request) {
+		addrs <- r.RemoteAddr()
+		respond(w, NewResponse(r, r.Data))
+	}))
+
+	go s.Listen()
+	defer s.Close()
+
+	conn, err := net.Dial("tcp", s.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x2, 0x0, 0x3})
+	assert.Nil(t, err)
+
+	resp := make([]byte, 12)
+	_, err = io.ReadFull(conn, resp)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x2, 0x0, 0x3}, resp)
+	assert.Equal(t, conn.LocalAddr().String(), (<-addrs).String())
+
+	// The address survives middleware.
+	var got net.Addr
+	var m Server
+	m.Use(func(h Handler) Handler {
+		return HandlerFunc(func(w io.Writer, r Request) {
+			h.ServeModbus(w, r.WithContext(context.Background()))
+		})
+	})
+	assert.Nil(t, m.HandleFunc(ReadCoils, func(w io.Writer, r Request) {
+		got = r.RemoteAddr()
+	}))
+
+	addr := &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: 502}
+	assert.Nil(t, m.executeAndRespond(new(bytes.Buffer), &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadCoils, remoteAddr: addr}))
+	assert.Equal(t, addr, got)
+}
+
+func TestErrorMapper(t *testing.T) {
+	errNotFound := errors.New("not found")
+	errUnknown := errors.New("unknown")
+
+	var s Server
+	l := new(recordingLogger)
+	s.Logger = l
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		switch start {
+		case 1:
+			return nil, errNotFound
+		case 2:
+			return nil, errUnknown
+		}
+
+		return nil, IllegalDataValueError
+	}))
+
+	tests := []struct {
+		mapper    func(error) Error
+		start     byte
+		exception byte
+	}{
+		// Without error mapper, errors result in a slave device
+		// failure.
+		{nil, 1, 0x4},
+		{func(err error) Error {
+			if err == errNotFound {
+				return IllegalAddressError
+			}
+			return SlaveDeviceBusyError
+		}, 1, 0x2},
+		{func(err error) Error {
+			return SlaveDeviceBusyError
+		}, 2, 0x6},
+		// The mapper isn't called for exceptions.
+		{func(err error) Error {
+			return SlaveDeviceBusyError
+		}, 3, 0x3},
+	}
+
+	for _, test := range tests {
+		s.SetErrorMapper(test.mapper)
+
+		w := new(bytes.Buffer)
+		req := &Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, test.start, 0x0, 0x1}}
+		assert.Nil(t, s.executeAndRespond(&errWriter{w: w, l: l}, req))
+		assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x83, test.exception}, w.Bytes())
+	}
+
+	// The original errors are logged.
+	assert.Equal(t, []string{"handler failed", "handler failed", "handler failed"}, l.messages["error"])
+}
+
+func TestLengthMismatch(t *testing.T) {
+	h := NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	})
+
+	valid := "\x00\x02\x00\x00\x00\x06\x01\x03\x00\x00\x00\x01"
+	resp := "\x00\x02\x00\x00\x00\x05\x01\x03\x02\x00\x0a"
+
+	tests := []struct {
+		strategy LengthMismatchStrategy
+		frame    string
+		resp     string
+		err      bool
+	}{
+		// The length is too short, the request lacks a byte.
+		{DropLengthMismatch, "\x00\x01\x00\x00\x00\x05\x01\x03\x00\x00\x00", resp, false},
+		{CloseOnLengthMismatch, "\x00\x01\x00\x00\x00\x05\x01\x03\x00\x00\x00", "", true},
+		// The length is too long, the request contains trailing bytes.
+		{DropLengthMismatch, "\x00\x01\x00\x00\x00\x08\x01\x03\x00\x00\x00\x01\xff\xff", resp, false},
+		{CloseOnLengthMismatch, "\x00\x01\x00\x00\x00\x08\x01\x03\x00\x00\x00\x01\xff\xff", "", true},
+	}
+
+	for _, test := range tests {
+		logs := new(bytes.Buffer)
+
+		var s Server
+		s.ErrorLog = log.New(logs, "", 0)
+		s.SetLengthMismatchStrategy(test.strategy)
+		s.Handle(ReadHoldingRegisters, h)
+
+		conn := &deadlineConn{
+			Reader: strings.NewReader(test.frame + valid),
+			Writer: new(bytes.Buffer),
+		}
+
+		err := s.handleConn(context.Background(), conn)
+		assert.Equal(t, test.err, err != nil)
+		assert.Equal(t, test.resp, conn.Writer.(*bytes.Buffer).String())
+
+		if !test.err {
+			assert.Equal(t, "goldfish: dropped frame with mismatching length remote_addr=<nil> transaction_id=1 unit_id=1 function_code=3\n", logs.String())
+		}
+	}
+}
+
+// TestByteCountMismatch verifies that a request of which the byte count
+// doesn't match its length is answered with an IllegalDataValueError, as the
+// length in the MBAP header is correct.
+func TestByteCountMismatch(t *testing.T) {
+	for _, strategy := range []LengthMismatchStrategy{DropLengthMismatch, CloseOnLengthMismatch} {
+		var s Server
+		s.SetLengthMismatchStrategy(strategy)
+		s.Handle(WriteMultipleRegisters, NewWriteHandler(func(unitID, start int, values []Value) error {
+			t.Fatal("handler func called for request with invalid byte count")
+			return nil
+		}, Unsigned))
+
+		conn := &deadlineConn{
+			Reader: strings.NewReader("\x00\x01\x00\x00\x00\x09\x01\x10\x00\x00\x00\x01\xff\x00\x01"),
+			Writer: new(bytes.Buffer),
+		}
+
+		assert.Nil(t, s.handleConn(context.Background(), conn))
+		assert.Equal(t, "\x00\x01\x00\x00\x00\x03\x01\x90\x03", conn.Writer.(*bytes.Buffer).String())
+	}
+}
+
+func TestReadMessageLength(t *testing.T) {
+	var s Server
+
+	tests := []struct {
+		length uint16
+		valid  bool
+	}{
+		{0, false},
+		{1, false},
+		{2, true},
+		{254, true},
+		{255, false},
+		{0x7fff, false},
+		{0xffff, false},
+	}
+
+	for _, test := range tests {
+		frame := []byte{0x0, 0x1, 0x0, 0x0, byte(test.length >> 8), byte(test.length)}
+		frame = append(frame, make([]byte, 260)...)
+
+		_, err := s.readMessage(bufio.NewReader(bytes.NewReader(frame)))
+		assert.Equal(t, test.valid, err == nil, fmt.Sprintf("length %d", test.length))
+	}
+}
+
+// oneByteReader returns the data of r one byte per Read call, like a
+// connection receiving a frame in many TCP segments.
+type oneByteReader struct {
+	r io.Reader
+}
+
+func (o oneByteReader) Read(b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	return o.r.Read(b[:1])
+}
+
+func TestReadMessageFragmented(t *testing.T) {
+	var s Server
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	req := []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}
+	w := new(bytes.Buffer)
+	conn := &deadlineConn{
+		Reader: oneByteReader{bytes.NewReader(bytes.Repeat(req, 2))},
+		Writer: w,
+	}
+
+	assert.Nil(t, s.handleConn(context.Background(), conn))
+
+	resp := []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}
+	assert.Equal(t, bytes.Repeat(resp, 2), w.Bytes())
+}
+
+func TestPipelining(t *testing.T) {
+	var s Server
+	WithPipelining(2)(&s)
+
+	// The first request is slow, the second request is answered while the
+	// first is still executing.
+	release := make(chan struct{})
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		if start == 0 {
+			<-release
+		}
+		return []Value{Value{start}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn := l.dial()
+	defer conn.Close()
+
+	_, err := conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+	_, err = conn.Write([]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x5, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0x5}, buf)
+
+	close(release)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0x0}, buf)
+}
+
+func TestPipeliningWriteError(t *testing.T) {
+	var s Server
+	WithPipelining(2)(&s)
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+
+	req := []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}
+	conn := Connection{
+		read: bytes.NewReader(bytes.Repeat(req, 3)).Read,
+		write: func(b []byte) (int, error) {
+			return 0, errors.New("broken pipe")
+		},
+		close: func() error { return nil },
+	}
+
+	err := s.handleConn(context.Background(), conn)
+	assert.EqualError(t, err, "failed to write response: broken pipe")
+}
+
+func TestServeClosedListener(t *testing.T) {
+	s, err := NewServer("127.0.0.1:0")
+	assert.Nil(t, err)
+	s.SetIdleTimeout(time.Second)
+
+	// Accept fails on a closed listener, which must stop Serve instead
+	// of using the nil connection.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	assert.Nil(t, l.Close())
+
+	done := make(chan error)
+	go func() {
+		done <- s.Serve(l)
+	}()
+
+	select {
+	case err := <-done:
+		assert.NotNil(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Serve didn't return")
+	}
+}
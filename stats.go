@@ -0,0 +1,129 @@
+package modbus
+
+import (
+	"expvar"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Stats contains runtime statistics of a server.
+type Stats struct {
+	// Requests is the number of requests executed.
+	Requests uint64
+
+	// RequestsByFunctionCode is the number of requests executed per
+	// function code.
+	RequestsByFunctionCode map[uint8]uint64
+
+	// Exceptions is the number of exception responses sent.
+	Exceptions uint64
+
+	// BytesRead and BytesWritten are the number of bytes of all requests
+	// read and all responses written.
+	BytesRead    uint64
+	BytesWritten uint64
+
+	// OpenConnections is the number of open connections.
+	OpenConnections int64
+
+	// Uptime is the time since the server started serving requests.
+	Uptime time.Duration
+}
+
+// serverStats contains the counters of a server. The counters are updated
+// atomically, so the 64 bit fields come first to keep them aligned on 32 bit
+// platforms.
+type serverStats struct {
+	requests      uint64
+	exceptions    uint64
+	bytesRead     uint64
+	bytesWritten  uint64
+	openConns     int64
+	started       int64
+	functionCodes [256]uint64
+}
+
+// start records the time the server started, unless it has been recorded
+// already.
+func (s *serverStats) start() {
+	atomic.CompareAndSwapInt64(&s.started, 0, time.Now().UnixNano())
+}
+
+// request counts a request with given function code and exception code.
+func (s *serverStats) request(functionCode, exception uint8) {
+	atomic.AddUint64(&s.requests, 1)
+	atomic.AddUint64(&s.functionCodes[functionCode], 1)
+
+	if exception != 0 {
+		atomic.AddUint64(&s.exceptions, 1)
+	}
+}
+
+// connOpened and connClosed track the number of open connections.
+func (s *serverStats) connOpened() {
+	atomic.AddInt64(&s.openConns, 1)
+}
+
+func (s *serverStats) connClosed() {
+	atomic.AddInt64(&s.openConns, -1)
+}
+
+func (s *serverStats) read(n int) {
+	atomic.AddUint64(&s.bytesRead, uint64(n))
+}
+
+func (s *serverStats) written(n int) {
+	atomic.AddUint64(&s.bytesWritten, uint64(n))
+}
+
+// Stats returns the current statistics of the server.
+func (s *Server) Stats() Stats {
+	stats := Stats{
+		Requests:               atomic.LoadUint64(&s.stats.requests),
+		RequestsByFunctionCode: make(map[uint8]uint64),
+		Exceptions:             atomic.LoadUint64(&s.stats.exceptions),
+		BytesRead:              atomic.LoadUint64(&s.stats.bytesRead),
+		BytesWritten:           atomic.LoadUint64(&s.stats.bytesWritten),
+		OpenConnections:        atomic.LoadInt64(&s.stats.openConns),
+	}
+
+	for fc := range s.stats.functionCodes {
+		if n := atomic.LoadUint64(&s.stats.functionCodes[fc]); n > 0 {
+			stats.RequestsByFunctionCode[uint8(fc)] = n
+		}
+	}
+
+	if started := atomic.LoadInt64(&s.stats.started); started != 0 {
+		stats.Uptime = time.Since(time.Unix(0, started))
+	}
+
+	return stats
+}
+
+// PublishExpvar publishes the statistics of the server through package
+// expvar. The names of the variables start with prefix, like
+// "<prefix>.requests". It panics when a variable with the same name has been
+// published already.
+func (s *Server) PublishExpvar(prefix string) {
+	vars := map[string]func() interface{}{
+		"requests":         func() interface{} { return s.Stats().Requests },
+		"exceptions":       func() interface{} { return s.Stats().Exceptions },
+		"bytes_read":       func() interface{} { return s.Stats().BytesRead },
+		"bytes_written":    func() interface{} { return s.Stats().BytesWritten },
+		"open_connections": func() interface{} { return s.Stats().OpenConnections },
+		"uptime_seconds":   func() interface{} { return s.Stats().Uptime.Seconds() },
+		"requests_by_function_code": func() interface{} {
+			// JSON objects require string keys.
+			m := make(map[string]uint64)
+			for fc, n := range s.Stats().RequestsByFunctionCode {
+				m[strconv.Itoa(int(fc))] = n
+			}
+			return m
+		},
+	}
+
+	for name, f := range vars {
+		expvar.Publish(prefix+"."+name, expvar.Func(f))
+	}
+}
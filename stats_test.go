@@ -0,0 +1,70 @@
+package modbus
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStats(t *testing.T) {
+	var s Server
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		if start > 0 {
+			return nil, IllegalAddressError
+		}
+		return []Value{Value{0xa}}, nil
+	}))
+
+	l := pipeListener{conns: make(chan net.Conn)}
+	go s.Serve(l)
+	defer s.Close()
+
+	conn := l.dial()
+	requests := []struct {
+		req    []byte
+		length int
+	}{
+		{[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1}, 11},
+		{[]byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x1, 0x0, 0x1}, 9},
+		{[]byte{0x0, 0x3, 0x0, 0x0, 0x0, 0x6, 0x1, 0x4, 0x0, 0x0, 0x0, 0x1}, 9},
+	}
+
+	for _, r := range requests {
+		_, err := conn.Write(r.req)
+		assert.Nil(t, err)
+		_, err = io.ReadFull(conn, make([]byte, r.length))
+		assert.Nil(t, err)
+	}
+	assert.Equal(t, int64(1), s.Stats().OpenConnections)
+
+	// The statistics are complete once the connection has been closed.
+	assert.Nil(t, conn.Close())
+	for i := 0; s.Stats().OpenConnections != 0; i++ {
+		if i == 100 {
+			t.Fatal("connection hasn't been closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	stats := s.Stats()
+	assert.Equal(t, uint64(3), stats.Requests)
+	assert.Equal(t, map[uint8]uint64{ReadHoldingRegisters: 2, ReadInputRegisters: 1}, stats.RequestsByFunctionCode)
+	assert.Equal(t, uint64(2), stats.Exceptions)
+	assert.Equal(t, uint64(36), stats.BytesRead)
+	assert.Equal(t, uint64(29), stats.BytesWritten)
+	assert.True(t, stats.Uptime > 0)
+
+	// Variables can't be unpublished, so every run uses a unique prefix.
+	prefix := fmt.Sprintf("goldfish_%d", time.Now().UnixNano())
+	s.PublishExpvar(prefix)
+	assert.Equal(t, "3", expvar.Get(prefix+".requests").String())
+	assert.Equal(t, "2", expvar.Get(prefix+".exceptions").String())
+	assert.Equal(t, `{"3":2,"4":1}`, expvar.Get(prefix+".requests_by_function_code").String())
+
+	assert.Panics(t, func() { s.PublishExpvar(prefix) })
+}
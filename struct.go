@@ -0,0 +1,337 @@
+package modbus
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// StructHandler can be used to respond on Modbus request with function codes
+// 3, 4, 6 and 16 using the fields of a struct as registers. Fields are mapped
+// to registers with a struct tag containing the table, the address and
+// optionally the word order:
+//
+//	type Pump struct {
+//		Speed uint16  `modbus:"hr,100"`
+//		Temp  float32 `modbus:"hr,102,abcd"`
+//		Hours uint32  `modbus:"ir,0,cdab"`
+//	}
+//
+// The table is either hr for holding registers or ir for input registers.
+// Fields of type bool, int16 and uint16 occupy a single register, fields of
+// type int32, uint32 and float32 occupy 2 registers and fields of type int64,
+// uint64 and float64 occupy 4 registers. The word order defaults to ABCD.
+//
+// Requests for addresses which aren't mapped are answered with an
+// IllegalAddressError. A write must cover the registers of every field it
+// touches completely.
+type StructHandler struct {
+	mu sync.Mutex
+	v  reflect.Value
+
+	holding map[int]register
+	input   map[int]register
+	fields  map[string]*structField
+
+	holdingRead *ReadHandler
+	inputRead   *ReadHandler
+	write       *WriteHandler
+}
+
+// structField is a struct field mapped to one or more registers.
+type structField struct {
+	index    int
+	size     int
+	order    WordOrder
+	validate func(interface{}) error
+}
+
+// register is a single register of a structField.
+type register struct {
+	field  *structField
+	offset int
+}
+
+// NewStructHandler creates a new StructHandler for v, which must be a pointer
+// to a struct. It returns an error when a struct tag is invalid or when fields
+// overlap.
+func NewStructHandler(v interface{}) (*StructHandler, error) {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return nil, fmt.Errorf("expected pointer to struct, got %T", v)
+	}
+
+	h := &StructHandler{
+		v:       rv.Elem(),
+		holding: make(map[int]register),
+		input:   make(map[int]register),
+		fields:  make(map[string]*structField),
+	}
+
+	t := h.v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag, ok := sf.Tag.Lookup("modbus")
+		if !ok || tag == "-" {
+			continue
+		}
+
+		if sf.PkgPath != "" {
+			return nil, fmt.Errorf("field %s is unexported", sf.Name)
+		}
+
+		if err := h.mapField(i, sf, tag); err != nil {
+			return nil, fmt.Errorf("invalid field %s: %v", sf.Name, err)
+		}
+	}
+
+	h.holdingRead = NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return h.read(h.holding, start, quantity)
+	})
+	h.inputRead = NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return h.read(h.input, start, quantity)
+	})
+	h.write = NewWriteHandler(func(unitID, start int, values []Value) error {
+		return h.update(start, values)
+	}, Unsigned)
+
+	return h, nil
+}
+
+// mapField maps the field with given index to the registers described by tag.
+func (h *StructHandler) mapField(index int, sf reflect.StructField, tag string) error {
+	parts := strings.Split(tag, ",")
+	if len(parts) < 2 || len(parts) > 3 {
+		return fmt.Errorf("invalid tag %q", tag)
+	}
+
+	var table map[int]register
+	switch parts[0] {
+	case "hr":
+		table = h.holding
+	case "ir":
+		table = h.input
+	default:
+		return fmt.Errorf("invalid table %q", parts[0])
+	}
+
+	addr, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return fmt.Errorf("invalid address %q", parts[1])
+	}
+
+	f := &structField{index: index, order: ABCD}
+	if len(parts) == 3 {
+		orders := map[string]WordOrder{"abcd": ABCD, "cdab": CDAB, "badc": BADC, "dcba": DCBA}
+		order, ok := orders[parts[2]]
+		if !ok {
+			return fmt.Errorf("invalid word order %q", parts[2])
+		}
+		f.order = order
+	}
+
+	switch sf.Type.Kind() {
+	case reflect.Bool, reflect.Int16, reflect.Uint16:
+		f.size = 1
+	case reflect.Int32, reflect.Uint32, reflect.Float32:
+		f.size = 2
+	case reflect.Int64, reflect.Uint64, reflect.Float64:
+		f.size = 4
+	default:
+		return fmt.Errorf("unsupported type %s", sf.Type)
+	}
+
+	if addr < 0 || addr+f.size > addressSpace {
+		return fmt.Errorf("address %d out of range", addr)
+	}
+
+	for i := 0; i < f.size; i++ {
+		if _, ok := table[addr+i]; ok {
+			return fmt.Errorf("register %d is already mapped", addr+i)
+		}
+
+		table[addr+i] = register{field: f, offset: i}
+	}
+
+	h.fields[sf.Name] = f
+	return nil
+}
+
+// SetValidator sets a function which validates new values of the field with
+// given name before they're written. The function is called with a value of
+// the type of the field. When it returns an error the request is answered
+// with an exception, errors which aren't an Error result in an
+// IllegalDataValueError. It returns an error when the field isn't mapped.
+func (h *StructHandler) SetValidator(field string, f func(v interface{}) error) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	sf, ok := h.fields[field]
+	if !ok {
+		return fmt.Errorf("field %s isn't mapped to registers", field)
+	}
+
+	sf.validate = f
+	return nil
+}
+
+// Lock locks the struct. Other goroutines accessing the fields of the struct
+// must hold the lock.
+func (h *StructHandler) Lock() {
+	h.mu.Lock()
+}
+
+// Unlock unlocks the struct.
+func (h *StructHandler) Unlock() {
+	h.mu.Unlock()
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (h *StructHandler) ServeModbus(w io.Writer, req Request) {
+	_ = h.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (h *StructHandler) ServeModbusE(w io.Writer, req Request) error {
+	switch req.FunctionCode {
+	case ReadHoldingRegisters:
+		return serveModbusE(h.holdingRead, w, req)
+	case ReadInputRegisters:
+		return serveModbusE(h.inputRead, w, req)
+	case WriteSingleRegister, WriteMultipleRegisters:
+		return serveModbusE(h.write, w, req)
+	default:
+		return respond(w, NewErrorResponse(req, IllegalFunctionError))
+	}
+}
+
+// read returns the values of the registers in table.
+func (h *StructHandler) read(table map[int]register, start, quantity int) ([]Value, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	values := make([]Value, 0, quantity)
+	for addr := start; addr < start+quantity; addr++ {
+		r, ok := table[addr]
+		if !ok {
+			return nil, IllegalAddressError
+		}
+
+		values = append(values, r.field.encode(h.v.Field(r.field.index))[r.offset])
+	}
+
+	return values, nil
+}
+
+// update writes values to the holding registers starting at start. No field
+// is updated unless all fields are valid.
+func (h *StructHandler) update(start int, values []Value) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	type change struct {
+		field *structField
+		value reflect.Value
+	}
+
+	var changes []change
+	for i := 0; i < len(values); {
+		r, ok := h.holding[start+i]
+		if !ok || r.offset != 0 || i+r.field.size > len(values) {
+			return IllegalAddressError
+		}
+
+		f := r.field
+		v, err := f.decode(values[i:i+f.size], h.v.Field(f.index).Type())
+		if err != nil {
+			return IllegalDataValueError
+		}
+
+		if f.validate != nil {
+			if err := f.validate(v.Interface()); err != nil {
+				var e Error
+				if !errors.As(err, &e) {
+					return IllegalDataValueError
+				}
+
+				return err
+			}
+		}
+
+		changes = append(changes, change{field: f, value: v})
+		i += f.size
+	}
+
+	for _, c := range changes {
+		h.v.Field(c.field.index).Set(c.value)
+	}
+
+	return nil
+}
+
+// encode converts the value of the field to registers.
+func (f *structField) encode(v reflect.Value) []Value {
+	switch v.Kind() {
+	case reflect.Bool:
+		return []Value{NewBoolValue(v.Bool())}
+	case reflect.Int16:
+		return []Value{Value{int(v.Int())}}
+	case reflect.Uint16:
+		return []Value{Value{int(v.Uint())}}
+	case reflect.Int32:
+		return Int32ToValues(int32(v.Int()), f.order)
+	case reflect.Uint32:
+		return Uint32ToValues(uint32(v.Uint()), f.order)
+	case reflect.Float32:
+		return Float32ToValues(float32(v.Float()), f.order)
+	case reflect.Int64:
+		return Int64ToValues(v.Int(), f.order)
+	case reflect.Uint64:
+		return Uint64ToValues(v.Uint(), f.order)
+	default:
+		return Float64ToValues(v.Float(), f.order)
+	}
+}
+
+// decode converts registers to a value of type t.
+func (f *structField) decode(values []Value, t reflect.Type) (reflect.Value, error) {
+	var v interface{}
+	var err error
+
+	switch t.Kind() {
+	case reflect.Bool:
+		switch values[0].v {
+		case 0, 1:
+			v = values[0].Bool()
+		default:
+			err = fmt.Errorf("%d isn't a valid boolean", values[0].v)
+		}
+	case reflect.Int16:
+		v = int16(uint16(values[0].v))
+	case reflect.Uint16:
+		v = uint16(values[0].v)
+	case reflect.Int32:
+		v, err = Int32FromValues(values, f.order)
+	case reflect.Uint32:
+		v, err = Uint32FromValues(values, f.order)
+	case reflect.Float32:
+		v, err = Float32FromValues(values, f.order)
+	case reflect.Int64:
+		v, err = Int64FromValues(values, f.order)
+	case reflect.Uint64:
+		v, err = Uint64FromValues(values, f.order)
+	default:
+		v, err = Float64FromValues(values, f.order)
+	}
+
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	return reflect.ValueOf(v).Convert(t), nil
+}
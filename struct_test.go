@@ -0,0 +1,158 @@
+package modbus
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type pump struct {
+	Running bool    `modbus:"hr,0"`
+	Speed   uint16  `modbus:"hr,1"`
+	Offset  int16   `modbus:"hr,2"`
+	Temp    float32 `modbus:"hr,4,cdab"`
+	Hours   uint32  `modbus:"ir,0"`
+	Energy  float64 `modbus:"ir,2,dcba"`
+	Name    string
+}
+
+func TestStructHandlerRead(t *testing.T) {
+	p := pump{Running: true, Speed: 1500, Offset: -2, Temp: 123.456, Hours: 0x12345678, Energy: 123456.789}
+	h, err := NewStructHandler(&p)
+	assert.Nil(t, err)
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x3}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x9, 0x0, 0x3, 0x6, 0x0, 0x1, 0x5, 0xdc, 0xff, 0xfe},
+		},
+		{
+			Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x4, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x7, 0x0, 0x3, 0x4, 0xe9, 0x79, 0x42, 0xf6},
+		},
+		{
+			Request{FunctionCode: ReadInputRegisters, Data: []byte{0x0, 0x0, 0x0, 0x6}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0xf, 0x0, 0x4, 0xc, 0x12, 0x34, 0x56, 0x78, 0xc9, 0x76, 0xbe, 0x9f, 0x0c, 0x24, 0xfe, 0x40},
+		},
+		{
+			// Register 3 isn't mapped.
+			Request{FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x2, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x83, 0x2},
+		},
+		{
+			Request{FunctionCode: ReadCoils, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x81, 0x1},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+}
+
+func TestStructHandlerWrite(t *testing.T) {
+	var p pump
+	h, err := NewStructHandler(&p)
+	assert.Nil(t, err)
+
+	assert.Nil(t, h.SetValidator("Speed", func(v interface{}) error {
+		if v.(uint16) > 3000 {
+			return errors.New("too fast")
+		}
+		return nil
+	}))
+	assert.NotNil(t, h.SetValidator("Name", nil))
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x2, 0xff, 0xfe}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x6, 0x0, 0x2, 0xff, 0xfe},
+		},
+		{
+			Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x0, 0x0, 0x2, 0x4, 0x0, 0x1, 0x5, 0xdc}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x0, 0x0, 0x2},
+		},
+		{
+			Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x4, 0x0, 0x2, 0x4, 0xe9, 0x79, 0x42, 0xf6}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x6, 0x0, 0x10, 0x0, 0x4, 0x0, 0x2},
+		},
+		{
+			// The validator rejects the speed, the other field isn't
+			// written either.
+			Request{FunctionCode: WriteMultipleRegisters, Data: []byte{0x0, 0x1, 0x0, 0x2, 0x4, 0x0c, 0x1c, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x90, 0x3},
+		},
+		{
+			// The write covers only half of the temperature.
+			Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x5, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2},
+		},
+		{
+			// Input registers can't be written.
+			Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x3, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x2},
+		},
+		{
+			// Booleans are either 0 or 1.
+			Request{FunctionCode: WriteSingleRegister, Data: []byte{0x0, 0x0, 0x0, 0x2}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x0, 0x86, 0x3},
+		},
+	}
+
+	for _, test := range tests {
+		buf := new(bytes.Buffer)
+		h.ServeModbus(buf, test.req)
+		assert.Equal(t, test.expected, buf.Bytes())
+	}
+
+	h.Lock()
+	defer h.Unlock()
+	assert.Equal(t, pump{Running: true, Speed: 1500, Offset: -2, Temp: 123.456}, p)
+}
+
+func TestNewStructHandlerInvalid(t *testing.T) {
+	tests := []interface{}{
+		pump{},
+		new(int),
+		&struct {
+			A uint16 `modbus:"hr"`
+		}{},
+		&struct {
+			A uint16 `modbus:"coil,1"`
+		}{},
+		&struct {
+			A uint16 `modbus:"hr,x"`
+		}{},
+		&struct {
+			A uint32 `modbus:"hr,1,abdc"`
+		}{},
+		&struct {
+			A string `modbus:"hr,1"`
+		}{},
+		&struct {
+			A uint32 `modbus:"hr,65535"`
+		}{},
+		&struct {
+			A uint32 `modbus:"hr,1"`
+			B uint16 `modbus:"hr,2"`
+		}{},
+		&struct {
+			a uint16 `modbus:"hr,1"`
+		}{},
+	}
+
+	for _, test := range tests {
+		_, err := NewStructHandler(test)
+		assert.NotNil(t, err)
+	}
+}
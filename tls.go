@@ -0,0 +1,129 @@
+package modbus
+
+import (
+	"crypto/tls"
+	"encoding/asn1"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// roleOID is the object identifier of the certificate extension containing
+// the role of a client, as described by the Modbus/TCP Security
+// specification.
+var roleOID = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 50316, 802, 1}
+
+// AuthorizerFunc decides if a client with given role is allowed to execute
+// a request. When it returns an error the request isn't executed and the
+// client receives an exception response. Errors which aren't of type Error
+// result in an IllegalFunctionError exception.
+type AuthorizerFunc func(role string, req Request) error
+
+// NewTLSServer creates a new server on given address which secures its
+// connections with TLS, as described by the Modbus/TCP Security
+// specification. The specification uses port 802 by default.
+//
+// The configuration must contain at least one certificate. The server requires
+// TLS 1.2 or higher. The specification mandates mutual authentication, so
+// clients must always present a certificate: a ClientAuth of tls.NoClientCert,
+// the zero value, is replaced by tls.RequireAndVerifyClientCert. Other client
+// authentication types are kept. To accept clients without a certificate,
+// call Serve with a listener created by tls.Listen instead.
+func NewTLSServer(address string, cfg *tls.Config, opts ...Option) (*Server, error) {
+	if cfg == nil {
+		return nil, fmt.Errorf("failed to start Modbus server: TLS configuration is missing")
+	}
+
+	cfg = cfg.Clone()
+	if cfg.MinVersion < tls.VersionTLS12 {
+		cfg.MinVersion = tls.VersionTLS12
+	}
+
+	if cfg.ClientAuth == tls.NoClientCert {
+		cfg.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	l, err := tls.Listen("tcp", address, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start Modbus server: %v", err)
+	}
+
+	s := &Server{
+		l:        l,
+		handlers: make(map[uint8]Handler),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
+}
+
+// SetAuthorizer sets the function that authorizes every request. The role of a
+// client is read from its certificate. Clients connecting without TLS or
+// without a role in their certificate get the default role. The connection of
+// a client with a malformed role in its certificate is closed. It returns an
+// error when the server already started.
+func (s *Server) SetAuthorizer(f AuthorizerFunc) error {
+	return s.configure(func() {
+		s.authorizer = f
+	})
+}
+
+// SetDefaultRole sets the role of clients without a role in their
+// certificate. It returns an error when the server already started.
+func (s *Server) SetDefaultRole(role string) error {
+	return s.configure(func() {
+		s.defaultRole = role
+	})
+}
+
+// role returns the role of the client on the other side of conn. It returns
+// an error when the certificate of the client contains a malformed role.
+func (s *Server) role(conn io.ReadWriter) (string, error) {
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return s.defaultRole, nil
+	}
+
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return s.defaultRole, nil
+	}
+
+	for _, ext := range certs[0].Extensions {
+		if !ext.Id.Equal(roleOID) {
+			continue
+		}
+
+		var role string
+		if _, err := asn1.Unmarshal(ext.Value, &role); err != nil {
+			return "", fmt.Errorf("failed to parse role: %v", err)
+		}
+
+		return role, nil
+	}
+
+	return s.defaultRole, nil
+}
+
+// authorize returns an error when a client with given role isn't allowed to
+// execute req.
+func (s *Server) authorize(role string, req Request) error {
+	if s.authorizer == nil {
+		return nil
+	}
+
+	err := s.authorizer(role, req)
+	if err == nil {
+		return nil
+	}
+
+	var e Error
+	if errors.As(err, &e) {
+		return err
+	}
+
+	return IllegalFunctionError
+}
@@ -0,0 +1,273 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// newCertificate creates a self-signed certificate with the given extensions,
+// usable by both clients and servers.
+func newCertificate(t *testing.T, extensions ...pkix.Extension) (tls.Certificate, *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "goldfish"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		ExtraExtensions:       extensions,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.Nil(t, err)
+
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+// newTLSServer starts a TLS server trusting the given client certificates.
+// It returns the server and a configuration for clients.
+func newTLSServer(t *testing.T, clients ...*x509.Certificate) (*Server, *tls.Config) {
+	serverCert, serverX509 := newCertificate(t)
+
+	clientCAs := x509.NewCertPool()
+	for _, c := range clients {
+		clientCAs.AddCert(c)
+	}
+
+	s, err := NewTLSServer("127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientCAs:    clientCAs,
+	})
+	assert.Nil(t, err)
+
+	rootCAs := x509.NewCertPool()
+	rootCAs.AddCert(serverX509)
+
+	return s, &tls.Config{RootCAs: rootCAs}
+}
+
+func TestNewTLSServer(t *testing.T) {
+	_, err := NewTLSServer("127.0.0.1:0", nil)
+	assert.NotNil(t, err)
+
+	clientCert, clientX509 := newCertificate(t)
+	s, cfg := newTLSServer(t, clientX509)
+	s.ErrorLog = log.New(new(bytes.Buffer), "", 0)
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+	addr := s.Addr().String()
+	go s.Listen()
+
+	// A client without certificate fails the handshake, which doesn't
+	// stop the server from accepting other clients.
+	conn, err := tls.Dial("tcp", addr, cfg)
+	if err == nil {
+		_, err = conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+		if err == nil {
+			_, err = conn.Read(make([]byte, 1))
+		}
+		conn.Close()
+	}
+	assert.NotNil(t, err)
+
+	cfg.Certificates = []tls.Certificate{clientCert}
+	conn, err = tls.Dial("tcp", addr, cfg)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	buf := make([]byte, 11)
+	_, err = io.ReadFull(conn, buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa}, buf)
+}
+
+func TestRoleAuthorization(t *testing.T) {
+	role, err := asn1.MarshalWithParams("operator", "utf8")
+	assert.Nil(t, err)
+
+	operatorCert, operatorX509 := newCertificate(t, pkix.Extension{Id: roleOID, Value: role})
+	anonymousCert, anonymousX509 := newCertificate(t)
+
+	s, cfg := newTLSServer(t, operatorX509, anonymousX509)
+	s.SetDefaultRole("viewer")
+	s.SetAuthorizer(func(role string, req Request) error {
+		switch {
+		case role == "operator":
+			return nil
+		case role == "viewer" && req.FunctionCode == ReadHoldingRegisters:
+			return nil
+		case role == "viewer" && req.FunctionCode == ReadInputRegisters:
+			return IllegalAddressError
+		}
+
+		return errors.New("not allowed")
+	})
+
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+	s.Handle(ReadInputRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xb}}, nil
+	}))
+	s.Handle(WriteSingleRegister, NewWriteHandler(func(unitID, start int, values []Value) error {
+		assert.Equal(t, []Value{Value{0x3}}, values)
+		return nil
+	}, Unsigned))
+	addr := s.Addr().String()
+	go s.Listen()
+
+	tests := []struct {
+		cert     tls.Certificate
+		req      []byte
+		expected []byte
+	}{
+		{
+			operatorCert,
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x1, 0x0, 0x3},
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x1, 0x0, 0x3},
+		},
+		{
+			anonymousCert,
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x6, 0x0, 0x1, 0x0, 0x3},
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x1, 0x86, 0x1},
+		},
+		{
+			anonymousCert,
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1},
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0xa},
+		},
+		{
+			anonymousCert,
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x4, 0x0, 0x0, 0x0, 0x1},
+			[]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x3, 0x1, 0x84, 0x2},
+		},
+	}
+
+	for _, test := range tests {
+		cfg.Certificates = []tls.Certificate{test.cert}
+		conn, err := tls.Dial("tcp", addr, cfg)
+		assert.Nil(t, err)
+
+		_, err = conn.Write(test.req)
+		assert.Nil(t, err)
+
+		buf := make([]byte, len(test.expected))
+		_, err = io.ReadFull(conn, buf)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, buf)
+		assert.Nil(t, conn.Close())
+	}
+}
+
+func TestMalformedRole(t *testing.T) {
+	cert, x509Cert := newCertificate(t, pkix.Extension{Id: roleOID, Value: []byte{0xc, 0x8, 'o', 'p'}})
+
+	logs := new(bytes.Buffer)
+	s, cfg := newTLSServer(t, x509Cert)
+	s.ErrorLog = log.New(logs, "", 0)
+	s.SetDefaultRole("operator")
+	s.SetAuthorizer(func(role string, req Request) error {
+		t.Errorf("request of client with malformed role authorized as %q", role)
+		return nil
+	})
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}}, nil
+	}))
+	addr := s.Addr().String()
+	go s.Listen()
+	defer s.Close()
+
+	cfg.Certificates = []tls.Certificate{cert}
+	conn, err := tls.Dial("tcp", addr, cfg)
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte{0x0, 0x1, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x1})
+	assert.Nil(t, err)
+
+	// The connection is closed instead of falling back to the default
+	// role.
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Contains(t, logs.String(), "failed to parse role")
+}
+
+// writeDeadlineConn is a deadlineConn recording its write deadlines.
+type writeDeadlineConn struct {
+	*deadlineConn
+	writeDeadlines []time.Time
+}
+
+func (c *writeDeadlineConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadlines = append(c.writeDeadlines, t)
+	return nil
+}
+
+func TestRejectedRequest(t *testing.T) {
+	var s Server
+	s.SetAuthorizer(func(role string, req Request) error {
+		return IllegalAddressError
+	})
+	s.Handle(WriteSingleRegister, NewWriteHandler(func(unitID, start int, values []Value) error {
+		t.Error("rejected request executed")
+		return nil
+	}, Unsigned))
+
+	// A rejected broadcast request isn't answered.
+	frames := "\x00\x01\x00\x00\x00\x06\x00\x06\x00\x01\x00\x03" +
+		"\x00\x02\x00\x00\x00\x06\x01\x06\x00\x01\x00\x03"
+
+	conn := &writeDeadlineConn{deadlineConn: &deadlineConn{
+		Reader: bytes.NewReader([]byte(frames)),
+		Writer: new(bytes.Buffer),
+	}}
+	s.SetWriteTimeout(time.Second)
+
+	assert.Nil(t, s.handleConn(context.Background(), conn))
+	assert.Equal(t, []byte{0x0, 0x2, 0x0, 0x0, 0x0, 0x3, 0x1, 0x86, 0x2}, conn.Writer.(*bytes.Buffer).Bytes())
+
+	// Like executed requests, rejected requests get a write deadline and
+	// their responses are counted.
+	assert.Len(t, conn.writeDeadlines, 2)
+	stats := s.Stats()
+	assert.Equal(t, uint64(1), stats.Exceptions)
+	assert.Equal(t, uint64(9), stats.BytesWritten)
+
+	// Failing to write the exception closes the connection.
+	failing := Connection{
+		read: bytes.NewReader([]byte(frames[12:])).Read,
+		write: func(b []byte) (int, error) {
+			return 0, errors.New("broken pipe")
+		},
+	}
+	assert.NotNil(t, s.handleConn(context.Background(), failing))
+}
@@ -0,0 +1,123 @@
+package modbus
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+)
+
+// maxADULength is the maximum length of a Modbus TCP/IP ADU: a MBAP header
+// of 7 bytes followed by a PDU of at most 253 bytes.
+const maxADULength = 260
+
+// NewUDPServer creates a new server on given address. Requests are received
+// as datagrams, each datagram contains a single request framed with a MBAP
+// header. Options which configure connections, like WithFraming,
+// WithPipelining and WithMaxConnections, have no effect on a UDP server.
+func NewUDPServer(address string, opts ...Option) (*Server, error) {
+	pc, err := net.ListenPacket("udp", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start Modbus server: %v", err)
+	}
+
+	s := &Server{
+		pc:       pc,
+		handlers: make(map[uint8]Handler),
+	}
+
+	for _, opt := range opts {
+		opt(s)
+	}
+
+	return s, nil
+}
+
+// serveUDP reads datagrams and handles every datagram in its own goroutine.
+// It returns when the PacketConn is closed.
+func (s *Server) serveUDP(pc net.PacketConn) {
+	s.start()
+
+	var retry backoff
+	for {
+		// The buffer is one byte larger than the largest valid ADU, so
+		// oversized datagrams can be detected.
+		buf := make([]byte, maxADULength+1)
+		n, addr, err := pc.ReadFrom(buf)
+		if err != nil {
+			if temporary(err) {
+				delay := retry.next()
+				s.logger().Error("failed to read datagram", errField(err), Field{Key: "retry_in", Value: delay})
+
+				select {
+				case <-time.After(delay):
+				case <-s.doneChan():
+					return
+				}
+				continue
+			}
+			return
+		}
+		retry.reset()
+
+		go func() {
+			if err := s.handleDatagram(pc, addr, buf[:n]); err != nil {
+				s.logger().Info("dropped datagram", remoteAddrField(addr), errField(err))
+			}
+		}()
+	}
+}
+
+func (s *Server) handleDatagram(pc net.PacketConn, addr net.Addr, b []byte) error {
+	if err := s.filterConn(addr); err != nil {
+		return fmt.Errorf("client rejected: %v", err)
+	}
+	s.stats.read(len(b))
+
+	if len(b) > maxADULength {
+		return fmt.Errorf("datagram exceeds maximum length of %d bytes", maxADULength)
+	}
+
+	// A request consists of a MBAP header of 7 bytes and a function code.
+	if len(b) < 8 {
+		return fmt.Errorf("datagram has invalid length of %d bytes", len(b))
+	}
+
+	if length := int(binary.BigEndian.Uint16(b[4:6])); length+6 != len(b) {
+		return fmt.Errorf("length field of %d doesn't match length of datagram", length)
+	}
+
+	var req Request
+	if err := req.UnmarshalBinary(b); err != nil {
+		return fmt.Errorf("failed to parse request: %v", err)
+	}
+
+	if req.ProtocolID != modbusProtocolID {
+		return fmt.Errorf("invalid protocol ID %d", req.ProtocolID)
+	}
+
+	ctx, cancel := s.requestContext(context.Background())
+	defer cancel()
+	req.ctx = ctx
+	req.remoteAddr = addr
+
+	buf := new(bytes.Buffer)
+	if err := s.instrumentedExecute(&errWriter{w: buf, l: s.logger()}, &req); err != nil {
+		return err
+	}
+
+	// Requests can be dropped without a response.
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	n, err := pc.WriteTo(buf.Bytes(), addr)
+	s.stats.written(n)
+	if err != nil {
+		return fmt.Errorf("failed to write response: %v", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,62 @@
+package modbus
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUDPServer(t *testing.T) {
+	s, err := NewUDPServer("127.0.0.1:0")
+	assert.Nil(t, err)
+
+	s.Handle(ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0xa}, Value{0x102}}, nil
+	}))
+
+	done := make(chan struct{})
+	go func() {
+		s.Listen()
+		close(done)
+	}()
+
+	conn, err := net.Dial("udp", s.Addr().String())
+	assert.Nil(t, err)
+	defer conn.Close()
+
+	datagrams := [][]byte{
+		// Length field doesn't match the length of the datagram.
+		{0x0, 0x1, 0x0, 0x0, 0x0, 0x7, 0x1, 0x3, 0x0, 0x0, 0x0, 0x2},
+		// Datagram is too short.
+		{0x0, 0x2, 0x0, 0x0, 0x0, 0x1, 0x1},
+		// Valid request.
+		{0x0, 0x3, 0x0, 0x0, 0x0, 0x6, 0x1, 0x3, 0x0, 0x0, 0x0, 0x2},
+	}
+
+	// The invalid datagrams are dropped, so only the last datagram is
+	// answered.
+	for _, d := range datagrams {
+		_, err := conn.Write(d)
+		assert.Nil(t, err)
+	}
+
+	assert.Nil(t, conn.SetReadDeadline(time.Now().Add(time.Second)))
+	buf := make([]byte, maxADULength)
+	n, err := conn.Read(buf)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte{0x0, 0x3, 0x0, 0x0, 0x0, 0x7, 0x1, 0x3, 0x4, 0x0, 0xa, 0x1, 0x2}, buf[:n])
+
+	// Closing the connection stops the server.
+	assert.Nil(t, s.pc.Close())
+	<-done
+}
+
+func TestUDPServerOptions(t *testing.T) {
+	s, err := NewUDPServer("127.0.0.1:0", WithBroadcast(false))
+	assert.Nil(t, err)
+	defer s.pc.Close()
+
+	assert.True(t, s.noBroadcast)
+}
@@ -0,0 +1,84 @@
+package modbus
+
+import (
+	"io"
+	"sort"
+)
+
+// UnitMux can be used to respond on Modbus requests for several logical
+// devices, which are distinguished by their unit ID. It dispatches the request
+// based on the unit ID and the function code. Register the UnitMux with the
+// server for every function code it handles:
+//
+//	for _, fc := range mux.FunctionCodes() {
+//		s.Handle(fc, mux)
+//	}
+type UnitMux struct {
+	units       map[uint8]map[uint8]Handler
+	unknownUnit error
+}
+
+// NewUnitMux creates a new UnitMux. Requests for units without handlers are
+// answered with a GatewayTargetDeviceFailedToRespondError.
+func NewUnitMux() *UnitMux {
+	return &UnitMux{
+		units:       make(map[uint8]map[uint8]Handler),
+		unknownUnit: GatewayTargetDeviceFailedToRespondError,
+	}
+}
+
+// HandleUnit registers the handler for the given unit ID and function code.
+func (m *UnitMux) HandleUnit(unitID, functionCode uint8, h Handler) {
+	handlers, ok := m.units[unitID]
+	if !ok {
+		handlers = make(map[uint8]Handler)
+		m.units[unitID] = handlers
+	}
+
+	handlers[functionCode] = h
+}
+
+// SetUnknownUnitError sets the error responded on requests for units without
+// handlers.
+func (m *UnitMux) SetUnknownUnitError(err error) {
+	m.unknownUnit = err
+}
+
+// FunctionCodes returns the function codes handled for at least one unit, in
+// ascending order.
+func (m *UnitMux) FunctionCodes() []uint8 {
+	seen := make(map[uint8]bool)
+	var codes []uint8
+	for _, handlers := range m.units {
+		for fc := range handlers {
+			if !seen[fc] {
+				seen[fc] = true
+				codes = append(codes, fc)
+			}
+		}
+	}
+
+	sort.Slice(codes, func(i, j int) bool { return codes[i] < codes[j] })
+	return codes
+}
+
+// ServeModbus handles a Modbus request and returns a response.
+func (m UnitMux) ServeModbus(w io.Writer, req Request) {
+	_ = m.ServeModbusE(w, req)
+}
+
+// ServeModbusE is like ServeModbus, but it returns an error when writing the
+// response failed.
+func (m UnitMux) ServeModbusE(w io.Writer, req Request) error {
+	handlers, ok := m.units[req.UnitID]
+	if !ok {
+		return respond(w, NewErrorResponse(req, m.unknownUnit))
+	}
+
+	h, ok := handlers[req.FunctionCode]
+	if !ok {
+		return respond(w, NewErrorResponse(req, IllegalFunctionError))
+	}
+
+	return serveModbusE(h, w, req)
+}
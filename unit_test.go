@@ -0,0 +1,58 @@
+package modbus
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUnitMux(t *testing.T) {
+	mux := NewUnitMux()
+	mux.HandleUnit(1, ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0x1}}, nil
+	}))
+	mux.HandleUnit(2, ReadHoldingRegisters, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0x2}}, nil
+	}))
+	mux.HandleUnit(2, ReadCoils, NewReadHandler(func(unitID, start, quantity int) ([]Value, error) {
+		return []Value{Value{0x1}}, nil
+	}))
+
+	assert.Equal(t, []uint8{ReadCoils, ReadHoldingRegisters}, mux.FunctionCodes())
+
+	tests := []struct {
+		req      Request
+		expected []byte
+	}{
+		{
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x1, 0x3, 0x2, 0x0, 0x1},
+		},
+		{
+			Request{MBAP: MBAP{UnitID: 2}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x5, 0x2, 0x3, 0x2, 0x0, 0x2},
+		},
+		// Unit 1 doesn't handle function code 1.
+		{
+			Request{MBAP: MBAP{UnitID: 1}, FunctionCode: ReadCoils, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x1, 0x81, 0x1},
+		},
+		// Unit 3 is unknown.
+		{
+			Request{MBAP: MBAP{UnitID: 3}, FunctionCode: ReadHoldingRegisters, Data: []byte{0x0, 0x0, 0x0, 0x1}},
+			[]byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x3, 0x83, 0xb},
+		},
+	}
+
+	for _, test := range tests {
+		w := new(bytes.Buffer)
+		mux.ServeModbus(w, test.req)
+		assert.Equal(t, test.expected, w.Bytes())
+	}
+
+	mux.SetUnknownUnitError(IllegalAddressError)
+	w := new(bytes.Buffer)
+	mux.ServeModbus(w, Request{MBAP: MBAP{UnitID: 3}, FunctionCode: ReadCoils})
+	assert.Equal(t, []byte{0x0, 0x0, 0x0, 0x0, 0x0, 0x3, 0x3, 0x81, 0x2}, w.Bytes())
+}
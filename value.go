@@ -0,0 +1,395 @@
+package modbus
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// MarshalValues marshals values to their binary form, every value is
+// marshaled as 2 bytes big-endian. It returns an error when a value is outside
+// range of -32768 through 65535.
+func MarshalValues(values []Value) ([]byte, error) {
+	b := make([]byte, len(values)*2)
+	for i, v := range values {
+		if v.v < -32768 || v.v > 65535 {
+			return nil, fmt.Errorf("failed to marshal value %d: %d doesn't fit in 16 bits", i, v.v)
+		}
+
+		binary.BigEndian.PutUint16(b[i*2:], uint16(v.v))
+	}
+
+	return b, nil
+}
+
+// UnmarshalValues unmarshals values from their binary form, every value is 2
+// bytes big-endian. It returns an error when the length of b is odd.
+func UnmarshalValues(b []byte, s Signedness) ([]Value, error) {
+	if len(b)%2 != 0 {
+		return nil, fmt.Errorf("failed to unmarshal values: byte slice has odd length of %d", len(b))
+	}
+
+	values := make([]Value, len(b)/2)
+	for i := range values {
+		u := binary.BigEndian.Uint16(b[i*2:])
+		values[i].v = int(u)
+		if s == Signed {
+			values[i].v = int(int16(u))
+		}
+	}
+
+	return values, nil
+}
+
+// ValuesFromUint16 converts unsigned integers to values.
+func ValuesFromUint16(u []uint16) []Value {
+	values := make([]Value, len(u))
+	for i, v := range u {
+		values[i].v = int(v)
+	}
+
+	return values
+}
+
+// ValuesFromInt16 converts signed integers to values.
+func ValuesFromInt16(s []int16) []Value {
+	values := make([]Value, len(s))
+	for i, v := range s {
+		values[i].v = int(v)
+	}
+
+	return values
+}
+
+// Uint16sFromValues converts values to unsigned integers. It returns an error
+// when one of the values is negative.
+func Uint16sFromValues(values []Value) ([]uint16, error) {
+	u := make([]uint16, len(values))
+	for i := range values {
+		v, err := values[i].Uint16()
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert value %d: %v", i, err)
+		}
+
+		u[i] = v
+	}
+
+	return u, nil
+}
+
+// WordOrder is the order of the registers of a value which spans multiple
+// registers, and of the bytes within those registers. The presets are named
+// after the order in which the bytes of a 32-bit value 0xAABBCCDD end up in 2
+// registers:
+//
+// ===== =============== ===============
+// Order First register  Second register
+// ===== =============== ===============
+// ABCD  0xAABB          0xCCDD
+// CDAB  0xCCDD          0xAABB
+// BADC  0xBBAA          0xDDCC
+// DCBA  0xDDCC          0xBBAA
+// ===== =============== ===============
+//
+// Values spanning 4 registers follow the same pattern, with DCBA the value is
+// stored completely little-endian.
+type WordOrder int
+
+const (
+	// BigWordFirst stores the most significant word in the first register.
+	BigWordFirst WordOrder = iota
+
+	// LittleWordFirst stores the least significant word in the first
+	// register.
+	LittleWordFirst
+
+	// BADC stores the most significant word in the first register, with
+	// the bytes of every register swapped.
+	BADC
+
+	// DCBA stores the least significant word in the first register, with
+	// the bytes of every register swapped.
+	DCBA
+
+	// ABCD is an alias for BigWordFirst.
+	ABCD = BigWordFirst
+
+	// CDAB is an alias for LittleWordFirst.
+	CDAB = LittleWordFirst
+)
+
+// littleWordFirst returns true if the least significant word is stored in the
+// first register.
+func (o WordOrder) littleWordFirst() bool {
+	return o == LittleWordFirst || o == DCBA
+}
+
+// swapBytes returns true if the bytes within the registers are swapped.
+func (o WordOrder) swapBytes() bool {
+	return o == BADC || o == DCBA
+}
+
+// Uint32ToValues converts an unsigned 32-bit integer to 2 values.
+func Uint32ToValues(u uint32, order WordOrder) []Value {
+	return wordsToValues(uint64(u), 2, order)
+}
+
+// Uint32FromValues converts 2 values to an unsigned 32-bit integer. It returns
+// an error when the length of values isn't 2.
+func Uint32FromValues(values []Value, order WordOrder) (uint32, error) {
+	bits, err := valuesToWords(values, 2, order)
+	return uint32(bits), err
+}
+
+// Int32ToValues converts a signed 32-bit integer to 2 values.
+func Int32ToValues(i int32, order WordOrder) []Value {
+	return wordsToValues(uint64(uint32(i)), 2, order)
+}
+
+// Int32FromValues converts 2 values to a signed 32-bit integer. It returns an
+// error when the length of values isn't 2.
+func Int32FromValues(values []Value, order WordOrder) (int32, error) {
+	bits, err := valuesToWords(values, 2, order)
+	return int32(uint32(bits)), err
+}
+
+// Uint64ToValues converts an unsigned 64-bit integer to 4 values.
+func Uint64ToValues(u uint64, order WordOrder) []Value {
+	return wordsToValues(u, 4, order)
+}
+
+// Uint64FromValues converts 4 values to an unsigned 64-bit integer. It returns
+// an error when the length of values isn't 4.
+func Uint64FromValues(values []Value, order WordOrder) (uint64, error) {
+	return valuesToWords(values, 4, order)
+}
+
+// Int64ToValues converts a signed 64-bit integer to 4 values.
+func Int64ToValues(i int64, order WordOrder) []Value {
+	return wordsToValues(uint64(i), 4, order)
+}
+
+// Int64FromValues converts 4 values to a signed 64-bit integer. It returns an
+// error when the length of values isn't 4.
+func Int64FromValues(values []Value, order WordOrder) (int64, error) {
+	bits, err := valuesToWords(values, 4, order)
+	return int64(bits), err
+}
+
+// Float32ToValues converts an IEEE-754 single precision float to 2 values.
+func Float32ToValues(f float32, order WordOrder) []Value {
+	return wordsToValues(uint64(math.Float32bits(f)), 2, order)
+}
+
+// Float32FromValues converts 2 values to an IEEE-754 single precision float.
+// It returns an error when the length of values isn't 2.
+func Float32FromValues(values []Value, order WordOrder) (float32, error) {
+	bits, err := valuesToWords(values, 2, order)
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Float32frombits(uint32(bits)), nil
+}
+
+// Float64ToValues converts an IEEE-754 double precision float to 4 values.
+func Float64ToValues(f float64, order WordOrder) []Value {
+	return wordsToValues(math.Float64bits(f), 4, order)
+}
+
+// Float64FromValues converts 4 values to an IEEE-754 double precision float.
+// It returns an error when the length of values isn't 4.
+func Float64FromValues(values []Value, order WordOrder) (float64, error) {
+	bits, err := valuesToWords(values, 4, order)
+	if err != nil {
+		return 0, err
+	}
+
+	return math.Float64frombits(bits), nil
+}
+
+// Bit returns whether bit n of v is set, bit 0 is the least significant bit.
+// It returns false when n is larger than 15.
+func Bit(v Value, n uint) bool {
+	if n > 15 {
+		return false
+	}
+
+	return uint16(v.v)&(1<<n) != 0
+}
+
+// SetBit returns a copy of v with bit n set or cleared, bit 0 is the least
+// significant bit. It returns an error when n is larger than 15. The returned
+// value is unsigned.
+func SetBit(v Value, n uint, on bool) (Value, error) {
+	if n > 15 {
+		return v, fmt.Errorf("bit %d doesn't exist in 16-bit value", n)
+	}
+
+	u := uint16(v.v)
+	if on {
+		u |= 1 << n
+	} else {
+		u &^= 1 << n
+	}
+
+	return Value{int(u)}, nil
+}
+
+// BitsToValue packs 16 flags into a value, the first flag is stored in the
+// least significant bit.
+func BitsToValue(bits [16]bool) Value {
+	var u uint16
+	for i, b := range bits {
+		if b {
+			u |= 1 << uint(i)
+		}
+	}
+
+	return Value{int(u)}
+}
+
+// ByteOrder is the order of the characters of a string within a register.
+type ByteOrder int
+
+const (
+	// HighByteFirst stores the first character in the high byte of a
+	// register.
+	HighByteFirst ByteOrder = iota
+
+	// LowByteFirst stores the first character in the low byte of a
+	// register.
+	LowByteFirst
+)
+
+// StringToValues packs s into the given number of registers, 2 characters per
+// register. A shorter string is padded with NUL characters, a longer string is
+// truncated.
+func StringToValues(s string, registers int, order ByteOrder) []Value {
+	b := make([]byte, registers*2)
+	copy(b, s)
+
+	values := make([]Value, registers)
+	for i := range values {
+		high, low := b[i*2], b[i*2+1]
+		if order == LowByteFirst {
+			high, low = low, high
+		}
+
+		values[i].v = int(high)<<8 | int(low)
+	}
+
+	return values
+}
+
+// StringFromValues unpacks a string stored 2 characters per register. The
+// string ends at the first NUL character.
+func StringFromValues(values []Value, order ByteOrder) string {
+	b := make([]byte, 0, len(values)*2)
+	for _, v := range values {
+		high, low := byte(v.v>>8), byte(v.v)
+		if order == LowByteFirst {
+			high, low = low, high
+		}
+
+		b = append(b, high, low)
+	}
+
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return string(b)
+}
+
+// BCDToValues encodes n as packed BCD in the given number of registers, 4
+// digits per register. The most significant digits are stored in the first
+// register. It returns an error when n doesn't fit.
+func BCDToValues(n uint64, registers int) ([]Value, error) {
+	if registers < 1 {
+		return nil, fmt.Errorf("invalid number of registers %d", registers)
+	}
+
+	values := make([]Value, registers)
+	for i := registers - 1; i >= 0; i-- {
+		for j := uint(0); j < 4; j++ {
+			values[i].v |= int(n%10) << (4 * j)
+			n /= 10
+		}
+	}
+
+	if n != 0 {
+		return nil, fmt.Errorf("number doesn't fit in %d registers", registers)
+	}
+
+	return values, nil
+}
+
+// BCDFromValues decodes a number encoded as packed BCD, the most significant
+// digits are stored in the first register. It returns an error when a nibble
+// isn't a decimal digit or when the number overflows an uint64.
+func BCDFromValues(values []Value) (uint64, error) {
+	var n uint64
+	for i, v := range values {
+		for j := 3; j >= 0; j-- {
+			d := uint64(v.v>>(4*uint(j))) & 0xf
+			if d > 9 {
+				return 0, fmt.Errorf("value %d contains invalid BCD digit 0x%x", i, d)
+			}
+
+			if n > (math.MaxUint64-d)/10 {
+				return 0, errors.New("number overflows uint64")
+			}
+
+			n = n*10 + d
+		}
+	}
+
+	return n, nil
+}
+
+// wordsToValues splits the n least significant words of bits into values.
+func wordsToValues(bits uint64, n int, order WordOrder) []Value {
+	values := make([]Value, n)
+	for i := range values {
+		j := i
+		if order.littleWordFirst() {
+			j = n - 1 - i
+		}
+
+		w := uint16(bits >> uint(16*(n-1-i)))
+		if order.swapBytes() {
+			w = w<<8 | w>>8
+		}
+
+		values[j].v = int(w)
+	}
+
+	return values
+}
+
+// valuesToWords joins n values into a single integer.
+func valuesToWords(values []Value, n int, order WordOrder) (uint64, error) {
+	if len(values) != n {
+		return 0, fmt.Errorf("expected %d values, got %d", n, len(values))
+	}
+
+	var bits uint64
+	for i := range values {
+		j := i
+		if order.littleWordFirst() {
+			j = n - 1 - i
+		}
+
+		w := uint16(values[j].v)
+		if order.swapBytes() {
+			w = w<<8 | w>>8
+		}
+
+		bits = bits<<16 | uint64(w)
+	}
+
+	return bits, nil
+}
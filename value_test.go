@@ -0,0 +1,348 @@
+package modbus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMarshalValues(t *testing.T) {
+	tests := []struct {
+		b      []byte
+		s      Signedness
+		values []Value
+	}{
+		{[]byte{0x3c, 0x13, 0xf3, 0x88}, Signed, []Value{Value{0x3c13}, Value{-3192}}},
+		{[]byte{0x3c, 0x13, 0xf3, 0x88}, Unsigned, []Value{Value{0x3c13}, Value{62344}}},
+		{[]byte{0x0, 0x0, 0x1, 0x0, 0x0, 0x1}, Signed, []Value{Value{0}, Value{256}, Value{1}}},
+		{[]byte{}, Unsigned, []Value{}},
+	}
+
+	for _, test := range tests {
+		values, err := UnmarshalValues(test.b, test.s)
+		assert.Nil(t, err)
+		assert.Equal(t, test.values, values)
+
+		b, err := MarshalValues(values)
+		assert.Nil(t, err)
+		assert.Equal(t, test.b, b)
+	}
+
+	_, err := UnmarshalValues([]byte{0x3c, 0x13, 0xf3}, Signed)
+	assert.NotNil(t, err)
+
+	_, err = MarshalValues([]Value{Value{65536}})
+	assert.NotNil(t, err)
+}
+
+func TestValuesFromUint16(t *testing.T) {
+	values := ValuesFromUint16([]uint16{0, 32767, 32768, 65535})
+	assert.Equal(t, []Value{Value{0}, Value{32767}, Value{32768}, Value{65535}}, values)
+
+	u, err := Uint16sFromValues(values)
+	assert.Nil(t, err)
+	assert.Equal(t, []uint16{0, 32767, 32768, 65535}, u)
+
+	assert.Equal(t, []Value{}, ValuesFromUint16(nil))
+}
+
+func TestValuesFromInt16(t *testing.T) {
+	values := ValuesFromInt16([]int16{-32768, -1, 0, 32767})
+	assert.Equal(t, []Value{Value{-32768}, Value{-1}, Value{0}, Value{32767}}, values)
+
+	// Negative values can't be converted to unsigned integers.
+	_, err := Uint16sFromValues(values)
+	assert.NotNil(t, err)
+}
+
+func TestUint32(t *testing.T) {
+	tests := []struct {
+		u      uint32
+		order  WordOrder
+		values []Value
+	}{
+		{0x12345678, BigWordFirst, []Value{Value{0x1234}, Value{0x5678}}},
+		{0x12345678, LittleWordFirst, []Value{Value{0x5678}, Value{0x1234}}},
+		{0xffffffff, BigWordFirst, []Value{Value{0xffff}, Value{0xffff}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.values, Uint32ToValues(test.u, test.order))
+
+		u, err := Uint32FromValues(test.values, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, test.u, u)
+	}
+
+	_, err := Uint32FromValues(make([]Value, 1), BigWordFirst)
+	assert.NotNil(t, err)
+}
+
+func TestInt32(t *testing.T) {
+	tests := []struct {
+		i      int32
+		order  WordOrder
+		values []Value
+	}{
+		{-1, BigWordFirst, []Value{Value{0xffff}, Value{0xffff}}},
+		{-2, LittleWordFirst, []Value{Value{0xfffe}, Value{0xffff}}},
+		{-2147483648, BigWordFirst, []Value{Value{0x8000}, Value{0x0}}},
+		{2147483647, LittleWordFirst, []Value{Value{0xffff}, Value{0x7fff}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.values, Int32ToValues(test.i, test.order))
+
+		i, err := Int32FromValues(test.values, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, test.i, i)
+	}
+
+	// Values created as signed integers are decoded the same way.
+	i, err := Int32FromValues(ValuesFromInt16([]int16{-1, -2}), BigWordFirst)
+	assert.Nil(t, err)
+	assert.Equal(t, int32(-2), i)
+
+	_, err = Int32FromValues(make([]Value, 3), BigWordFirst)
+	assert.NotNil(t, err)
+}
+
+func TestUint64(t *testing.T) {
+	tests := []struct {
+		u      uint64
+		order  WordOrder
+		values []Value
+	}{
+		{0x0123456789abcdef, BigWordFirst, []Value{Value{0x0123}, Value{0x4567}, Value{0x89ab}, Value{0xcdef}}},
+		{0x0123456789abcdef, LittleWordFirst, []Value{Value{0xcdef}, Value{0x89ab}, Value{0x4567}, Value{0x0123}}},
+		{0xffffffffffffffff, BigWordFirst, []Value{Value{0xffff}, Value{0xffff}, Value{0xffff}, Value{0xffff}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.values, Uint64ToValues(test.u, test.order))
+
+		u, err := Uint64FromValues(test.values, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, test.u, u)
+	}
+
+	_, err := Uint64FromValues(make([]Value, 2), BigWordFirst)
+	assert.NotNil(t, err)
+}
+
+func TestInt64(t *testing.T) {
+	tests := []struct {
+		i      int64
+		order  WordOrder
+		values []Value
+	}{
+		{-1, BigWordFirst, []Value{Value{0xffff}, Value{0xffff}, Value{0xffff}, Value{0xffff}}},
+		{-2, LittleWordFirst, []Value{Value{0xfffe}, Value{0xffff}, Value{0xffff}, Value{0xffff}}},
+		{-9223372036854775808, BigWordFirst, []Value{Value{0x8000}, Value{0x0}, Value{0x0}, Value{0x0}}},
+		{1, LittleWordFirst, []Value{Value{0x1}, Value{0x0}, Value{0x0}, Value{0x0}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.values, Int64ToValues(test.i, test.order))
+
+		i, err := Int64FromValues(test.values, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, test.i, i)
+	}
+
+	_, err := Int64FromValues(make([]Value, 5), BigWordFirst)
+	assert.NotNil(t, err)
+}
+
+func TestFloat32(t *testing.T) {
+	tests := []struct {
+		f      float32
+		order  WordOrder
+		values []Value
+	}{
+		{123.456, BigWordFirst, []Value{Value{0x42f6}, Value{0xe979}}},
+		{123.456, LittleWordFirst, []Value{Value{0xe979}, Value{0x42f6}}},
+		{-1, BigWordFirst, []Value{Value{0xbf80}, Value{0x0}}},
+		{0, LittleWordFirst, []Value{Value{0x0}, Value{0x0}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.values, Float32ToValues(test.f, test.order))
+
+		f, err := Float32FromValues(test.values, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, test.f, f)
+	}
+
+	// Values created as signed integers are decoded the same way.
+	f, err := Float32FromValues(ValuesFromInt16([]int16{-16512, 0}), BigWordFirst)
+	assert.Nil(t, err)
+	assert.Equal(t, float32(-1), f)
+
+	_, err = Float32FromValues([]Value{Value{0x42f6}}, BigWordFirst)
+	assert.NotNil(t, err)
+
+	_, err = Float32FromValues(make([]Value, 3), BigWordFirst)
+	assert.NotNil(t, err)
+}
+
+func TestFloat64(t *testing.T) {
+	tests := []struct {
+		f      float64
+		order  WordOrder
+		values []Value
+	}{
+		{123456.789, BigWordFirst, []Value{Value{0x40fe}, Value{0x240c}, Value{0x9fbe}, Value{0x76c9}}},
+		{123456.789, LittleWordFirst, []Value{Value{0x76c9}, Value{0x9fbe}, Value{0x240c}, Value{0x40fe}}},
+		{-0.5, BigWordFirst, []Value{Value{0xbfe0}, Value{0x0}, Value{0x0}, Value{0x0}}},
+		// Completely little-endian.
+		{123456.789, DCBA, []Value{Value{0xc976}, Value{0xbe9f}, Value{0x0c24}, Value{0xfe40}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.values, Float64ToValues(test.f, test.order))
+
+		f, err := Float64FromValues(test.values, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, test.f, f)
+	}
+
+	_, err := Float64FromValues(make([]Value, 2), BigWordFirst)
+	assert.NotNil(t, err)
+
+	_, err = Float64FromValues(make([]Value, 5), LittleWordFirst)
+	assert.NotNil(t, err)
+}
+
+func TestString(t *testing.T) {
+	tests := []struct {
+		s         string
+		registers int
+		order     ByteOrder
+		values    []Value
+		expected  string
+	}{
+		{"ACS-01", 3, HighByteFirst, []Value{Value{0x4143}, Value{0x532d}, Value{0x3031}}, "ACS-01"},
+		// Odd-length strings are padded with NUL characters.
+		{"ACS", 3, HighByteFirst, []Value{Value{0x4143}, Value{0x5300}, Value{0x0}}, "ACS"},
+		{"ACS", 2, LowByteFirst, []Value{Value{0x4341}, Value{0x53}}, "ACS"},
+		// Strings which are too long are truncated.
+		{"goldfish", 3, HighByteFirst, []Value{Value{0x676f}, Value{0x6c64}, Value{0x6669}}, "goldfi"},
+		{"", 1, LowByteFirst, []Value{Value{0x0}}, ""},
+	}
+
+	for _, test := range tests {
+		values := StringToValues(test.s, test.registers, test.order)
+		assert.Equal(t, test.values, values)
+		assert.Equal(t, test.expected, StringFromValues(values, test.order))
+	}
+}
+
+func TestBCD(t *testing.T) {
+	tests := []struct {
+		n         uint64
+		registers int
+		values    []Value
+	}{
+		{0, 1, []Value{Value{0x0}}},
+		{1234, 1, []Value{Value{0x1234}}},
+		{9999, 1, []Value{Value{0x9999}}},
+		{12345678, 2, []Value{Value{0x1234}, Value{0x5678}}},
+		{42, 3, []Value{Value{0x0}, Value{0x0}, Value{0x42}}},
+		{18446744073709551615, 5, []Value{Value{0x1844}, Value{0x6744}, Value{0x0737}, Value{0x0955}, Value{0x1615}}},
+	}
+
+	for _, test := range tests {
+		values, err := BCDToValues(test.n, test.registers)
+		assert.Nil(t, err)
+		assert.Equal(t, test.values, values)
+
+		n, err := BCDFromValues(values)
+		assert.Nil(t, err)
+		assert.Equal(t, test.n, n)
+	}
+
+	// The number doesn't fit.
+	_, err := BCDToValues(10000, 1)
+	assert.NotNil(t, err)
+
+	_, err = BCDToValues(0, 0)
+	assert.NotNil(t, err)
+
+	// Nibbles must be decimal digits.
+	_, err = BCDFromValues([]Value{Value{0x12a4}})
+	assert.NotNil(t, err)
+
+	// The number overflows uint64.
+	_, err = BCDFromValues([]Value{Value{0x1844}, Value{0x6744}, Value{0x0737}, Value{0x0955}, Value{0x1616}})
+	assert.NotNil(t, err)
+}
+
+func TestWordOrder(t *testing.T) {
+	tests := []struct {
+		order  WordOrder
+		values []Value
+	}{
+		{ABCD, []Value{Value{0xaabb}, Value{0xccdd}}},
+		{CDAB, []Value{Value{0xccdd}, Value{0xaabb}}},
+		{BADC, []Value{Value{0xbbaa}, Value{0xddcc}}},
+		{DCBA, []Value{Value{0xddcc}, Value{0xbbaa}}},
+	}
+
+	for _, test := range tests {
+		assert.Equal(t, test.values, Uint32ToValues(0xaabbccdd, test.order))
+
+		u, err := Uint32FromValues(test.values, test.order)
+		assert.Nil(t, err)
+		assert.Equal(t, uint32(0xaabbccdd), u)
+	}
+
+	// The order applies to every register of a value spanning 4
+	// registers.
+	assert.Equal(t, []Value{Value{0x2301}, Value{0x6745}, Value{0xab89}, Value{0xefcd}}, Uint64ToValues(0x0123456789abcdef, BADC))
+	assert.Equal(t, []Value{Value{0xefcd}, Value{0xab89}, Value{0x6745}, Value{0x2301}}, Uint64ToValues(0x0123456789abcdef, DCBA))
+}
+
+func TestBit(t *testing.T) {
+	v := Value{0x8001}
+	assert.True(t, Bit(v, 0))
+	assert.False(t, Bit(v, 1))
+	assert.True(t, Bit(v, 15))
+	assert.False(t, Bit(v, 16))
+
+	// Negative values are interpreted as two's complement.
+	assert.True(t, Bit(Value{-32768}, 15))
+}
+
+func TestSetBit(t *testing.T) {
+	tests := []struct {
+		v        Value
+		n        uint
+		on       bool
+		expected Value
+	}{
+		{Value{0x0}, 0, true, Value{0x1}},
+		{Value{0x1}, 0, false, Value{0x0}},
+		{Value{0x0}, 15, true, Value{0x8000}},
+		{Value{-1}, 15, false, Value{0x7fff}},
+		{Value{0x8000}, 15, true, Value{0x8000}},
+	}
+
+	for _, test := range tests {
+		v, err := SetBit(test.v, test.n, test.on)
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, v)
+	}
+
+	_, err := SetBit(Value{0x0}, 16, true)
+	assert.NotNil(t, err)
+}
+
+func TestBitsToValue(t *testing.T) {
+	var bits [16]bool
+	assert.Equal(t, Value{0x0}, BitsToValue(bits))
+
+	bits[0] = true
+	bits[15] = true
+	assert.Equal(t, Value{0x8001}, BitsToValue(bits))
+}